@@ -0,0 +1,335 @@
+package vistar
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+type AdV2 struct {
+	Id                   string  `json:"id"`
+	AssetId              string  `json:"asset_id,omitempty"`
+	AssetUrl             string  `json:"asset_url"`
+	OriginalAssetUrl     string  `json:"original_asset_url,omitempty"`
+	MimeType             string  `json:"mime_type,omitempty"`
+	Width                int64   `json:"width,omitempty"`
+	Height               int64   `json:"height,omitempty"`
+	LengthInSeconds      float64 `json:"length_in_seconds,omitempty"`
+	LengthInMilliseconds int64   `json:"length_in_milliseconds,omitempty"`
+	LeaseExpiry          int64   `json:"lease_expiry,omitempty"`
+	DisplayTime          int64   `json:"display_time,omitempty"`
+	ProofOfPlayUrl       string  `json:"proof_of_play_url"`
+	ExpirationUrl        string  `json:"expiration_url"`
+	DisplayAreaId        string  `json:"display_area_id,omitempty"`
+	CreativeId           string  `json:"creative_id,omitempty"`
+	CampaignId           string  `json:"campaign_id,omitempty"`
+	Advertiser           string  `json:"advertiser,omitempty"`
+	CreativeCategory     string  `json:"creative_category,omitempty"`
+
+	// Extra holds the fields returned by the ad server that are not covered
+	// above, and those of the optional fields above that had an unexpected
+	// type.
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+type AssetV2 struct {
+	AssetId              string  `json:"asset_id,omitempty"`
+	AssetUrl             string  `json:"asset_url"`
+	MimeType             string  `json:"mime_type,omitempty"`
+	Width                int64   `json:"width,omitempty"`
+	Height               int64   `json:"height,omitempty"`
+	LengthInSeconds      float64 `json:"length_in_seconds,omitempty"`
+	LengthInMilliseconds int64   `json:"length_in_milliseconds,omitempty"`
+	CreativeId           string  `json:"creative_id,omitempty"`
+	CampaignId           string  `json:"campaign_id,omitempty"`
+	Advertiser           string  `json:"advertiser,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+type InvalidAdError struct {
+	AdId   string
+	Errors ValidationErrors
+}
+
+func (e *InvalidAdError) Error() string {
+	return fmt.Sprintf("invalid ad %s: %s", e.AdId, e.Errors.Error())
+}
+
+// InvalidResponseError lists why ads or assets of a response were left out.
+// GetAdV2 and GetAssetsV2 return it alongside the valid ones.
+type InvalidResponseError struct {
+	Errors []error
+}
+
+func (e *InvalidResponseError) Error() string {
+	messages := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Sprintf("%d invalid: %s", len(e.Errors),
+		strings.Join(messages, "; "))
+}
+
+var adV2Fields = jsonFieldNames(reflect.TypeOf(AdV2{}))
+var assetV2Fields = jsonFieldNames(reflect.TypeOf(AssetV2{}))
+
+var adV2RequiredFields = map[string]bool{
+	"id":                true,
+	"asset_url":         true,
+	"proof_of_play_url": true,
+	"expiration_url":    true,
+}
+var assetV2RequiredFields = map[string]bool{"asset_url": true}
+
+// NewAdV2 converts the ad. A required field with an unexpected type fails
+// the conversion with an *InvalidAdError, an optional one is left at its
+// zero value and kept in Extra.
+func NewAdV2(ad Ad) (*AdV2, error) {
+	typed := &AdV2{}
+	mismatched, errs, err := decodeLeniently(ad, typed, adV2RequiredFields)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(errs) > 0 {
+		adId, _ := ad["id"].(string)
+		return nil, &InvalidAdError{AdId: adId, Errors: errs}
+	}
+
+	typed.Extra = mergeExtra(typed.Extra, mismatched)
+	return typed, nil
+}
+
+// NewAssetV2 converts the asset like NewAdV2, failing with ValidationErrors
+// if a required field has an unexpected type.
+func NewAssetV2(asset Asset) (*AssetV2, error) {
+	typed := &AssetV2{}
+	mismatched, errs, err := decodeLeniently(asset, typed,
+		assetV2RequiredFields)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	typed.Extra = mergeExtra(typed.Extra, mismatched)
+	return typed, nil
+}
+
+func (a *AdV2) Validate() error {
+	var errs ValidationErrors
+	if a.Id == "" {
+		errs.add("id", "is required")
+	}
+
+	if a.AssetUrl == "" {
+		errs.add("asset_url", "is required")
+	}
+
+	if a.ProofOfPlayUrl == "" {
+		errs.add("proof_of_play_url", "is required")
+	}
+
+	if a.ExpirationUrl == "" {
+		errs.add("expiration_url", "is required")
+	}
+
+	if a.Width < 0 {
+		errs.add("width", "must not be negative, got %d", a.Width)
+	}
+
+	if a.Height < 0 {
+		errs.add("height", "must not be negative, got %d", a.Height)
+	}
+
+	if a.LeaseExpiry < 0 {
+		errs.add("lease_expiry", "must not be negative, got %d",
+			a.LeaseExpiry)
+	}
+
+	if len(errs) > 0 {
+		return &InvalidAdError{AdId: a.Id, Errors: errs}
+	}
+	return nil
+}
+
+func (a *AssetV2) Validate() error {
+	var errs ValidationErrors
+	if a.AssetUrl == "" {
+		errs.add("asset_url", "is required")
+	}
+
+	if a.Width < 0 {
+		errs.add("width", "must not be negative, got %d", a.Width)
+	}
+
+	if a.Height < 0 {
+		errs.add("height", "must not be negative, got %d", a.Height)
+	}
+	return errs.errorOrNil()
+}
+
+func (a *AdV2) UnmarshalJSON(data []byte) error {
+	type adV2 AdV2
+	err := json.Unmarshal(data, (*adV2)(a))
+	if err != nil {
+		return err
+	}
+
+	a.Extra, err = unknownJSONFields(data, adV2Fields)
+	return err
+}
+
+func (a AdV2) MarshalJSON() ([]byte, error) {
+	type adV2 AdV2
+	return marshalWithExtra(adV2(a), a.Extra)
+}
+
+func (a *AssetV2) UnmarshalJSON(data []byte) error {
+	type assetV2 AssetV2
+	err := json.Unmarshal(data, (*assetV2)(a))
+	if err != nil {
+		return err
+	}
+
+	a.Extra, err = unknownJSONFields(data, assetV2Fields)
+	return err
+}
+
+func (a AssetV2) MarshalJSON() ([]byte, error) {
+	type assetV2 AssetV2
+	return marshalWithExtra(assetV2(a), a.Extra)
+}
+
+// decodeLeniently unmarshals fields into v, a pointer to a struct. The
+// fields that don't fit their type are reported as ValidationErrors if they
+// are required, and are otherwise left out of v and returned.
+func decodeLeniently(fields map[string]interface{}, v interface{},
+	required map[string]bool) (map[string]json.RawMessage, ValidationErrors,
+	error) {
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := json.Unmarshal(data, v); err == nil {
+		return nil, nil, nil
+	}
+
+	raw := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, nil, err
+	}
+
+	names := make([]string, 0, len(raw))
+	for name := range raw {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs ValidationErrors
+	mismatched := make(map[string]json.RawMessage)
+	t := reflect.TypeOf(v).Elem()
+	for _, name := range names {
+		field, err := json.Marshal(map[string]json.RawMessage{name: raw[name]})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if json.Unmarshal(field, reflect.New(t).Interface()) == nil {
+			continue
+		}
+
+		if required[name] {
+			errs.add(name, "has an unexpected type")
+		} else {
+			mismatched[name] = raw[name]
+		}
+		delete(raw, name)
+	}
+
+	if len(errs) > 0 {
+		return nil, errs, nil
+	}
+
+	data, err = json.Marshal(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reflect.ValueOf(v).Elem().Set(reflect.Zero(t))
+	return mismatched, nil, json.Unmarshal(data, v)
+}
+
+func mergeExtra(extra map[string]json.RawMessage,
+	more map[string]json.RawMessage) map[string]json.RawMessage {
+	if len(more) == 0 {
+		return extra
+	}
+
+	if extra == nil {
+		extra = make(map[string]json.RawMessage, len(more))
+	}
+
+	for name, value := range more {
+		extra[name] = value
+	}
+	return extra
+}
+
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	names := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+func unknownJSONFields(data []byte, known map[string]bool) (
+	map[string]json.RawMessage, error) {
+	fields := make(map[string]json.RawMessage)
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	for name := range fields {
+		if known[name] {
+			delete(fields, name)
+		}
+	}
+
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return fields, nil
+}
+
+func marshalWithExtra(v interface{},
+	extra map[string]json.RawMessage) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || len(extra) == 0 {
+		return data, err
+	}
+
+	fields := make(map[string]json.RawMessage)
+	err = json.Unmarshal(data, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, value := range extra {
+		if _, ok := fields[name]; !ok {
+			fields[name] = value
+		}
+	}
+	return json.Marshal(fields)
+}
@@ -0,0 +1,198 @@
+package vistar
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdV2UnmarshalKeepsUnknownFields(t *testing.T) {
+	data := []byte(`{"id": "1", "asset_url": "url1", "width": 1920,
+		"lease_expiry": 1500000000, "deal_id": "deal", "impressions": 2.5}`)
+
+	ad := &AdV2{}
+	err := json.Unmarshal(data, ad)
+
+	assert.Nil(t, err)
+	assert.Equal(t, ad.Id, "1")
+	assert.Equal(t, ad.AssetUrl, "url1")
+	assert.Equal(t, ad.Width, int64(1920))
+	assert.Equal(t, ad.LeaseExpiry, int64(1500000000))
+	assert.Equal(t, ad.Extra, map[string]json.RawMessage{
+		"deal_id":     json.RawMessage(`"deal"`),
+		"impressions": json.RawMessage(`2.5`),
+	})
+}
+
+func TestAdV2MarshalIncludesExtraFields(t *testing.T) {
+	ad := &AdV2{
+		Id:       "1",
+		AssetUrl: "url1",
+		Extra: map[string]json.RawMessage{
+			"deal_id": json.RawMessage(`"deal"`),
+			"id":      json.RawMessage(`"ignored"`),
+		},
+	}
+
+	data, err := json.Marshal(ad)
+	assert.Nil(t, err)
+
+	fields := map[string]interface{}{}
+	json.Unmarshal(data, &fields)
+	assert.Equal(t, fields["id"], "1")
+	assert.Equal(t, fields["deal_id"], "deal")
+}
+
+func TestNewAdV2(t *testing.T) {
+	ad, err := NewAdV2(Ad{
+		"id":           "1",
+		"asset_url":    "url1",
+		"lease_expiry": float64(1500000000),
+		"mime_type":    "video/mp4",
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, ad.Id, "1")
+	assert.Equal(t, ad.LeaseExpiry, int64(1500000000))
+	assert.Equal(t, ad.MimeType, "video/mp4")
+	assert.Nil(t, ad.Extra)
+
+	_, err = NewAdV2(Ad{"id": 1})
+	invalidErr, ok := err.(*InvalidAdError)
+	assert.True(t, ok)
+	assert.Equal(t, invalidErr.Errors[0].Field, "id")
+
+	// An optional field with an unexpected type doesn't make the ad
+	// unplayable, it is kept in Extra.
+	ad, err = NewAdV2(Ad{
+		"id":        "1",
+		"asset_url": "url1",
+		"width":     "wide",
+		"height":    float64(1080),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, ad.AssetUrl, "url1")
+	assert.Equal(t, ad.Width, int64(0))
+	assert.Equal(t, ad.Height, int64(1080))
+	assert.Equal(t, ad.Extra, map[string]json.RawMessage{
+		"width": json.RawMessage(`"wide"`),
+	})
+}
+
+func TestAdV2Validate(t *testing.T) {
+	ad := &AdV2{
+		Id:             "1",
+		AssetUrl:       "url1",
+		ProofOfPlayUrl: "pop-url",
+		ExpirationUrl:  "expire-url",
+	}
+	assert.Nil(t, ad.Validate())
+
+	ad = &AdV2{Id: "1", Width: -1}
+	err := ad.Validate()
+	invalidErr, ok := err.(*InvalidAdError)
+	assert.True(t, ok)
+	assert.Equal(t, invalidErr.AdId, "1")
+	assert.Len(t, invalidErr.Errors, 4)
+	assert.Equal(t, err.Error(), "invalid ad 1: asset_url: is required, "+
+		"proof_of_play_url: is required, expiration_url: is required, "+
+		"width: must not be negative, got -1")
+}
+
+func TestAssetV2Validate(t *testing.T) {
+	asset, err := NewAssetV2(Asset{"asset_url": "url1", "width": 10.0})
+	assert.Nil(t, err)
+	assert.Nil(t, asset.Validate())
+
+	asset = &AssetV2{Height: -1}
+	assert.Equal(t, asset.Validate().Error(),
+		"asset_url: is required, height: must not be negative, got -1")
+}
+
+func TestGetAdV2(t *testing.T) {
+	adResponse := &AdResponse{
+		[]Ad{
+			{
+				"id":                "1",
+				"asset_url":         "url1",
+				"proof_of_play_url": "pop-url",
+				"expiration_url":    "expire-url",
+			},
+			{
+				"id":             "2",
+				"expiration_url": "expire-url",
+			},
+			{
+				"asset_url": "url3",
+			},
+		},
+	}
+
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			response, _ := json.Marshal(adResponse)
+			w.Write(response)
+		}),
+	)
+	defer ts.Close()
+
+	pop := NewTestProofOfPlay()
+	client := NewClient(&ClientConfig{ReqTimeout: time.Second})
+	defer client.Close()
+	client.pop = pop
+
+	ads, err := client.GetAdV2(context.Background(), &request{
+		url:  ts.URL,
+		data: newTestData(),
+	})
+
+	assert.Len(t, ads, 1)
+	assert.Equal(t, ads[0].Id, "1")
+	invalidErr, ok := err.(*InvalidResponseError)
+	assert.True(t, ok)
+	assert.Len(t, invalidErr.Errors, 1)
+	assert.Equal(t, invalidErr.Errors[0].(*InvalidAdError).AdId, "2")
+
+	assert.Len(t, pop.requests, 2)
+	assert.Equal(t, client.GetInProgressAds(), map[string]Ad{
+		"1": adResponse.Advertisement[0],
+	})
+}
+
+func TestGetAssetsV2(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"asset": [{"asset_url": "url1"},
+				{"asset_url": "url2", "width": -1}]}`))
+		}),
+	)
+	defer ts.Close()
+
+	var events []Event
+	client := NewClient(&ClientConfig{
+		ReqTimeout: time.Second,
+		EventHandler: EventHandlerFunc(func(event Event) {
+			events = append(events, event)
+		}),
+	})
+	defer client.Close()
+
+	assets, err := client.GetAssetsV2(context.Background(), &request{
+		assetEndpointUrl: ts.URL,
+		data:             newTestData(),
+	})
+
+	assert.Len(t, assets, 1)
+	assert.Equal(t, assets[0].AssetUrl, "url1")
+	invalidErr, ok := err.(*InvalidResponseError)
+	assert.True(t, ok)
+	assert.Len(t, invalidErr.Errors, 1)
+	assert.Len(t, events, 1)
+	assert.Equal(t, events[0].Name, EventAdServerReturnedInvalidAsset)
+	assert.Equal(t, events[0].Url, "url2")
+}
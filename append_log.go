@@ -0,0 +1,124 @@
+package vistar
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// appendLog is a file of JSON records, one per line. Changes are appended
+// to it, and it is compacted by rewriting it with only the records that are
+// still needed. It is not safe for concurrent use, its owner locks around
+// it.
+type appendLog struct {
+	path    string
+	file    *os.File
+	records int
+	// skipped is the number of lines that the last load could not apply.
+	skipped int
+}
+
+func newAppendLog(path string) *appendLog {
+	return &appendLog{path: path}
+}
+
+// load calls apply with every line of the log. A line that apply returns an
+// error for is skipped and counted, such a line is left behind if the
+// process died in the middle of a write.
+func (l *appendLog) load(apply func([]byte) error) error {
+	l.skipped = 0
+
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		if err := apply(scanner.Bytes()); err != nil {
+			l.skipped++
+		}
+	}
+	return scanner.Err()
+}
+
+func (l *appendLog) append(record interface{}) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	l.records++
+	return l.file.Sync()
+}
+
+// compact replaces the log with the records that write encodes, and reopens
+// it for appending.
+func (l *appendLog) compact(
+	write func(encode func(interface{}) error) error) error {
+	records := 0
+	err := writeFileAtomic(l.path, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		return write(func(record interface{}) error {
+			records++
+			return encoder.Encode(record)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if l.file != nil {
+		l.file.Close()
+	}
+
+	l.records = records
+	l.file, err = os.OpenFile(l.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE,
+		0644)
+	return err
+}
+
+func (l *appendLog) close() error {
+	return l.file.Close()
+}
+
+// writeFileAtomic replaces the file at path with what write produces, by
+// writing to a temporary file in the same directory and renaming it.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
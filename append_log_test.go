@@ -0,0 +1,58 @@
+package vistar
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppendLog(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "append-log")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "records.log")
+
+	log := newAppendLog(path)
+	assert.Nil(t, log.load(func(line []byte) error {
+		t.Fatal("empty log has no lines")
+		return nil
+	}))
+
+	assert.Nil(t, log.compact(func(encode func(interface{}) error) error {
+		return encode(&fileFinalizedRecord{Id: "1"})
+	}))
+	assert.Equal(t, log.records, 1)
+
+	assert.Nil(t, log.append(&fileFinalizedRecord{Id: "2"}))
+	assert.Equal(t, log.records, 2)
+
+	// Simulate a crash in the middle of a write.
+	log.file.Write([]byte(`{"id": "3`))
+	assert.Nil(t, log.close())
+
+	var ids []string
+	log = newAppendLog(path)
+	err := log.load(func(line []byte) error {
+		record := &fileFinalizedRecord{}
+		if err := json.Unmarshal(line, record); err != nil {
+			return err
+		}
+		ids = append(ids, record.Id)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, ids, []string{"1", "2"})
+	assert.Equal(t, log.skipped, 1)
+
+	assert.Nil(t, log.compact(func(encode func(interface{}) error) error {
+		return encode(&fileFinalizedRecord{Id: "2"})
+	}))
+	assert.Nil(t, log.append(&fileFinalizedRecord{Id: "4"}))
+	assert.Nil(t, log.close())
+
+	data, _ := ioutil.ReadFile(path)
+	assert.Equal(t, string(data), "{\"id\":\"2\"}\n{\"id\":\"4\"}\n")
+}
@@ -0,0 +1,270 @@
+package vistar
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var DefaultAuditLogMaxSize int64 = 10 * 1024 * 1024
+var DefaultAuditLogMaxAge = 24 * time.Hour
+
+const auditLogTimeFormat = "20060102T150405.000"
+
+type AuditLogConfig struct {
+	// Path is the file that events are appended to. Rotated segments are
+	// gzipped next to it, with the time of rotation in their name.
+	Path string
+	// MaxSize and MaxAge trigger a rotation once the current segment is
+	// larger or older. They default to DefaultAuditLogMaxSize and
+	// DefaultAuditLogMaxAge.
+	MaxSize int64
+	MaxAge  time.Duration
+	// MaxSegments is the number of rotated segments that are kept, 0 keeps
+	// them all.
+	MaxSegments int
+}
+
+type auditRecord struct {
+	Time     time.Time              `json:"time"`
+	Event    string                 `json:"event"`
+	Level    string                 `json:"level"`
+	Message  string                 `json:"message,omitempty"`
+	AdId     string                 `json:"ad_id,omitempty"`
+	Url      string                 `json:"url,omitempty"`
+	Status   int                    `json:"status,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+	Duration float64                `json:"duration_ms,omitempty"`
+	Fields   map[string]interface{} `json:"fields,omitempty"`
+}
+
+// AuditLog is an EventHandler that appends every event it receives to a
+// JSON lines file, so that the requests, cached assets, confirms and expires
+// of a screen can be reconstructed. Subscribe it to an EventBus to keep disk
+// writes off the request path.
+type AuditLog struct {
+	path        string
+	maxSize     int64
+	maxAge      time.Duration
+	maxSegments int
+	now         func() time.Time
+	lock        sync.Mutex
+	file        *os.File
+	size        int64
+	openedAt    time.Time
+	err         error
+}
+
+func NewAuditLog(config *AuditLogConfig) (*AuditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(config.Path), 0755); err != nil {
+		return nil, err
+	}
+
+	a := &AuditLog{
+		path:        config.Path,
+		maxSize:     config.MaxSize,
+		maxAge:      config.MaxAge,
+		maxSegments: config.MaxSegments,
+		now:         time.Now,
+	}
+
+	if a.maxSize <= 0 {
+		a.maxSize = DefaultAuditLogMaxSize
+	}
+
+	if a.maxAge <= 0 {
+		a.maxAge = DefaultAuditLogMaxAge
+	}
+
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) HandleEvent(event Event) {
+	record := &auditRecord{
+		Time:     event.Time,
+		Event:    event.Name,
+		Level:    event.Level.String(),
+		Message:  event.Message,
+		AdId:     event.AdId,
+		Url:      event.Url,
+		Status:   event.Status,
+		Duration: float64(event.Duration) / float64(time.Millisecond),
+		Fields:   event.Fields,
+	}
+
+	if event.Err != nil {
+		record.Error = event.Err.Error()
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		a.setError(err)
+		return
+	}
+	data = append(data, '\n')
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.file == nil {
+		return
+	}
+
+	if a.size > 0 && (a.size+int64(len(data)) > a.maxSize ||
+		a.now().Sub(a.openedAt) >= a.maxAge) {
+		if err := a.rotateLocked(); err != nil {
+			a.err = err
+			return
+		}
+	}
+
+	n, err := a.file.Write(data)
+	a.size += int64(n)
+	if err != nil {
+		a.err = err
+	}
+}
+
+// Close closes the current segment, without rotating it. It returns the
+// last error that prevented an event from being written, if any.
+func (a *AuditLog) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.file == nil {
+		return a.err
+	}
+
+	err := a.file.Close()
+	a.file = nil
+	if a.err != nil {
+		return a.err
+	}
+	return err
+}
+
+func (a *AuditLog) setError(err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.err = err
+}
+
+// open appends to the current segment if there is one. Its age is taken from
+// its modification time, as its creation time isn't available.
+func (a *AuditLog) open() error {
+	file, err := os.OpenFile(a.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE,
+		0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	a.file = file
+	a.size = info.Size()
+	a.openedAt = a.now()
+	if a.size > 0 {
+		a.openedAt = info.ModTime()
+	}
+	return nil
+}
+
+func (a *AuditLog) rotateLocked() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	a.file = nil
+
+	rotated := a.segmentPrefix() + a.now().UTC().Format(auditLogTimeFormat) +
+		filepath.Ext(a.path)
+	if err := os.Rename(a.path, rotated); err != nil {
+		return err
+	}
+
+	if err := a.open(); err != nil {
+		return err
+	}
+
+	if err := gzipFile(rotated); err != nil {
+		return err
+	}
+	return a.pruneLocked()
+}
+
+// segmentPrefix is the start of the names of the rotated segments, audit.log
+// is rotated to audit-<time>.log.gz.
+func (a *AuditLog) segmentPrefix() string {
+	return strings.TrimSuffix(a.path, filepath.Ext(a.path)) + "-"
+}
+
+// Segments returns the paths of the rotated segments, oldest first.
+func (a *AuditLog) Segments() ([]string, error) {
+	segments, err := filepath.Glob(
+		globEscape(a.segmentPrefix()) + "*" + filepath.Ext(a.path) + ".gz")
+	if err != nil {
+		return nil, err
+	}
+
+	// The time in the names sorts chronologically.
+	sort.Strings(segments)
+	return segments, nil
+}
+
+func (a *AuditLog) pruneLocked() error {
+	if a.maxSegments <= 0 {
+		return nil
+	}
+
+	segments, err := a.Segments()
+	if err != nil {
+		return err
+	}
+
+	for len(segments) > a.maxSegments {
+		if err := os.Remove(segments[0]); err != nil {
+			return err
+		}
+		segments = segments[1:]
+	}
+	return nil
+}
+
+// gzipFile replaces path with path.gz.
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	err = writeFileAtomic(path+".gz", func(w io.Writer) error {
+		gz := gzip.NewWriter(w)
+		if _, err := io.Copy(gz, src); err != nil {
+			return err
+		}
+		return gz.Close()
+	})
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func globEscape(path string) string {
+	replacer := strings.NewReplacer(`*`, `\*`, `?`, `\?`, `[`, `\[`)
+	return replacer.Replace(path)
+}
@@ -0,0 +1,206 @@
+package vistar
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readAuditRecords(t *testing.T, path string) []map[string]interface{} {
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	var scanner *bufio.Scanner
+	if filepath.Ext(path) == ".gz" {
+		gz, err := gzip.NewReader(f)
+		assert.Nil(t, err)
+		scanner = bufio.NewScanner(gz)
+	} else {
+		scanner = bufio.NewScanner(f)
+	}
+
+	records := make([]map[string]interface{}, 0)
+	for scanner.Scan() {
+		record := make(map[string]interface{})
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestAuditLogWritesEvents(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "audit-log")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit", "audit.log")
+	audit, err := NewAuditLog(&AuditLogConfig{Path: path})
+	assert.Nil(t, err)
+
+	at := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	audit.HandleEvent(Event{
+		Name:     EventAdConfirmed,
+		Level:    EventLevelDebug,
+		Time:     at,
+		AdId:     "ad-1",
+		Url:      "http://pop",
+		Status:   200,
+		Duration: 1500 * time.Microsecond,
+		Fields:   map[string]interface{}{"display_time": 10},
+	})
+	audit.HandleEvent(Event{
+		Name:  EventAdExpired,
+		Level: EventLevelDebug,
+		Time:  at,
+		AdId:  "ad-2",
+		Err:   errors.New("connection refused"),
+	})
+	assert.Nil(t, audit.Close())
+
+	records := readAuditRecords(t, path)
+	assert.Equal(t, len(records), 2)
+	assert.Equal(t, records[0]["event"], EventAdConfirmed)
+	assert.Equal(t, records[0]["level"], "debug")
+	assert.Equal(t, records[0]["time"], "2020-01-01T12:00:00Z")
+	assert.Equal(t, records[0]["ad_id"], "ad-1")
+	assert.Equal(t, records[0]["status"], float64(200))
+	assert.Equal(t, records[0]["duration_ms"], 1.5)
+	assert.Equal(t, records[0]["fields"],
+		map[string]interface{}{"display_time": float64(10)})
+	assert.Equal(t, records[1]["error"], "connection refused")
+
+	// Reopening appends to the same segment.
+	audit, err = NewAuditLog(&AuditLogConfig{Path: path})
+	assert.Nil(t, err)
+	audit.HandleEvent(Event{Name: EventAdExpired, Time: at})
+	assert.Nil(t, audit.Close())
+	assert.Equal(t, len(readAuditRecords(t, path)), 3)
+}
+
+func TestAuditLogRotatesBySize(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "audit-log")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	audit, err := NewAuditLog(&AuditLogConfig{
+		Path:        path,
+		MaxSize:     300,
+		MaxSegments: 2,
+	})
+	assert.Nil(t, err)
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	audit.now = func() time.Time { return now }
+
+	for i := 0; i < 8; i++ {
+		now = now.Add(time.Second)
+		audit.HandleEvent(Event{
+			Name:    EventAdConfirmed,
+			Time:    now,
+			Message: "adId: ad-1, code: 200",
+			AdId:    "ad-1",
+		})
+	}
+	assert.Nil(t, audit.Close())
+
+	segments, err := audit.Segments()
+	assert.Nil(t, err)
+	assert.Equal(t, len(segments), 2)
+
+	total := len(readAuditRecords(t, path))
+	for i, segment := range segments {
+		records := readAuditRecords(t, segment)
+		assert.True(t, len(records) > 0)
+		total += len(records)
+
+		info, err := os.Stat(segment)
+		assert.Nil(t, err)
+		assert.True(t, info.Size() < 300)
+
+		if i > 0 {
+			assert.True(t, segment > segments[i-1])
+		}
+	}
+	// Older segments have been pruned.
+	assert.True(t, total < 8)
+
+	matches, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "*"))
+	assert.Equal(t, len(matches), 3)
+}
+
+func TestAuditLogRotatesByAge(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "audit-log")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	audit, err := NewAuditLog(&AuditLogConfig{
+		Path:   path,
+		MaxAge: time.Hour,
+	})
+	assert.Nil(t, err)
+
+	now := time.Now()
+	audit.now = func() time.Time { return now }
+	audit.HandleEvent(Event{Name: "a", Time: now})
+	audit.HandleEvent(Event{Name: "b", Time: now})
+
+	now = now.Add(time.Hour)
+	audit.HandleEvent(Event{Name: "c", Time: now})
+	assert.Nil(t, audit.Close())
+
+	segments, err := audit.Segments()
+	assert.Nil(t, err)
+	assert.Equal(t, len(segments), 1)
+	assert.Equal(t, len(readAuditRecords(t, segments[0])), 2)
+
+	records := readAuditRecords(t, path)
+	assert.Equal(t, len(records), 1)
+	assert.Equal(t, records[0]["event"], "c")
+}
+
+func TestAuditLogRecordsSanitizedAdRequests(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"advertisement": [{"id": "ad-1",
+				"proof_of_play_url": "http://pop",
+				"expiration_url": "http://expire"}]}`))
+		}))
+	defer ts.Close()
+
+	dir, _ := ioutil.TempDir("", "audit-log")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	audit, err := NewAuditLog(&AuditLogConfig{Path: path})
+	assert.Nil(t, err)
+
+	client := NewClient(&ClientConfig{EventHandler: audit})
+	requestData := newTestData()
+	requestData.ApiKey = "secret"
+	_, err = client.GetAd(&request{url: ts.URL, data: requestData})
+	assert.Nil(t, err)
+	client.Close()
+	assert.Nil(t, audit.Close())
+
+	records := readAuditRecords(t, path)
+	assert.Equal(t, len(records), 2)
+	assert.Equal(t, records[0]["event"], EventAdStateChanged)
+	assert.Equal(t, records[1]["event"], EventAdRequest)
+	fields := records[1]["fields"].(map[string]interface{})
+	assert.Equal(t, fields["ad_ids"], []interface{}{"ad-1"})
+	assert.Equal(t, fields["urls"], []interface{}{ts.URL})
+
+	data := fields["request"].(map[string]interface{})
+	assert.Equal(t, data["api_key"], "REDACTED")
+	assert.Equal(t, data["network_id"], "network")
+}
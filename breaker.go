@@ -0,0 +1,234 @@
+package vistar
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+type CircuitState int
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+type CircuitBreakerConfig struct {
+	// WindowSize is the number of most recent requests the failure rate is
+	// computed over.
+	WindowSize int
+	// MinRequests is the number of requests in the window required before
+	// the breaker can open.
+	MinRequests          int
+	FailureRateThreshold float64
+	CoolDown             time.Duration
+	// HalfOpenRequests is the number of trial requests let through after
+	// the cool-down, all of which have to succeed to close the breaker.
+	HalfOpenRequests int
+}
+
+func DefaultCircuitBreakerConfig() *CircuitBreakerConfig {
+	return &CircuitBreakerConfig{
+		WindowSize:           20,
+		MinRequests:          5,
+		FailureRateThreshold: 0.5,
+		CoolDown:             30 * time.Second,
+		HalfOpenRequests:     1,
+	}
+}
+
+type CircuitBreakerStats struct {
+	State     string    `json:"state"`
+	Failures  int64     `json:"failures"`
+	Successes int64     `json:"successes"`
+	Rejected  int64     `json:"rejected"`
+	OpenedAt  time.Time `json:"opened_at"`
+}
+
+type circuitTransition struct {
+	from CircuitState
+	to   CircuitState
+}
+
+type circuitBreaker struct {
+	config            *CircuitBreakerConfig
+	now               func() time.Time
+	lock              sync.Mutex
+	state             CircuitState
+	outcomes          []bool
+	next              int
+	recorded          int
+	halfOpenInFlight  int
+	halfOpenSuccesses int
+	stats             CircuitBreakerStats
+}
+
+// newCircuitBreaker fills the zero fields of config with those of
+// DefaultCircuitBreakerConfig.
+func newCircuitBreaker(config *CircuitBreakerConfig) *circuitBreaker {
+	defaults := DefaultCircuitBreakerConfig()
+	if config == nil {
+		config = defaults
+	}
+
+	filled := *config
+	if filled.WindowSize <= 0 {
+		filled.WindowSize = defaults.WindowSize
+	}
+
+	if filled.MinRequests <= 0 {
+		filled.MinRequests = defaults.MinRequests
+	}
+
+	if filled.FailureRateThreshold <= 0 {
+		filled.FailureRateThreshold = defaults.FailureRateThreshold
+	}
+
+	if filled.CoolDown <= 0 {
+		filled.CoolDown = defaults.CoolDown
+	}
+
+	if filled.HalfOpenRequests <= 0 {
+		filled.HalfOpenRequests = defaults.HalfOpenRequests
+	}
+
+	return &circuitBreaker{
+		config:   &filled,
+		now:      time.Now,
+		outcomes: make([]bool, filled.WindowSize),
+	}
+}
+
+// allow reports whether a request may be made, and the state transition it
+// caused, if any.
+func (b *circuitBreaker) allow() (bool, *circuitTransition) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var transition *circuitTransition
+	if b.state == CircuitOpen &&
+		b.now().Sub(b.stats.OpenedAt) >= b.config.CoolDown {
+		transition = b.setStateLocked(CircuitHalfOpen)
+	}
+
+	switch b.state {
+	case CircuitOpen:
+		b.stats.Rejected++
+		return false, transition
+	case CircuitHalfOpen:
+		if b.halfOpenInFlight >= b.halfOpenRequests() {
+			b.stats.Rejected++
+			return false, transition
+		}
+		b.halfOpenInFlight++
+	}
+	return true, transition
+}
+
+func (b *circuitBreaker) record(success bool) *circuitTransition {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if success {
+		b.stats.Successes++
+	} else {
+		b.stats.Failures++
+	}
+
+	switch b.state {
+	case CircuitHalfOpen:
+		b.halfOpenInFlight--
+		if !success {
+			return b.setStateLocked(CircuitOpen)
+		}
+
+		b.halfOpenSuccesses++
+		if b.halfOpenSuccesses >= b.halfOpenRequests() {
+			return b.setStateLocked(CircuitClosed)
+		}
+	case CircuitClosed:
+		b.outcomes[b.next] = success
+		b.next = (b.next + 1) % len(b.outcomes)
+		if b.recorded < len(b.outcomes) {
+			b.recorded++
+		}
+
+		if b.recorded >= b.config.MinRequests &&
+			b.failureRateLocked() >= b.config.FailureRateThreshold {
+			return b.setStateLocked(CircuitOpen)
+		}
+	}
+	return nil
+}
+
+// cancel releases a request allowed by allow that was abandoned before it
+// had an outcome.
+func (b *circuitBreaker) cancel() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.state == CircuitHalfOpen && b.halfOpenInFlight > 0 {
+		b.halfOpenInFlight--
+	}
+}
+
+func (b *circuitBreaker) snapshot() CircuitBreakerStats {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	stats := b.stats
+	stats.State = b.state.String()
+	return stats
+}
+
+func (b *circuitBreaker) halfOpenRequests() int {
+	if b.config.HalfOpenRequests < 1 {
+		return 1
+	}
+	return b.config.HalfOpenRequests
+}
+
+func (b *circuitBreaker) failureRateLocked() float64 {
+	if b.recorded == 0 {
+		return 0
+	}
+
+	failures := 0
+	for i := 0; i < b.recorded; i++ {
+		if !b.outcomes[i] {
+			failures++
+		}
+	}
+	return float64(failures) / float64(b.recorded)
+}
+
+func (b *circuitBreaker) setStateLocked(state CircuitState) *circuitTransition {
+	transition := &circuitTransition{from: b.state, to: state}
+	b.state = state
+	b.halfOpenInFlight = 0
+	b.halfOpenSuccesses = 0
+
+	switch state {
+	case CircuitOpen:
+		b.stats.OpenedAt = b.now()
+	case CircuitClosed:
+		b.next = 0
+		b.recorded = 0
+	}
+	return transition
+}
@@ -0,0 +1,221 @@
+package vistar
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreakerOpensOnFailureRate(t *testing.T) {
+	breaker := newCircuitBreaker(&CircuitBreakerConfig{
+		WindowSize:           4,
+		MinRequests:          4,
+		FailureRateThreshold: 0.5,
+		CoolDown:             time.Minute,
+	})
+
+	assert.Nil(t, breaker.record(true))
+	assert.Nil(t, breaker.record(false))
+	assert.Nil(t, breaker.record(true))
+
+	transition := breaker.record(false)
+	assert.Equal(t, transition,
+		&circuitTransition{from: CircuitClosed, to: CircuitOpen})
+
+	allowed, transition := breaker.allow()
+	assert.False(t, allowed)
+	assert.Nil(t, transition)
+
+	stats := breaker.snapshot()
+	assert.Equal(t, stats.State, "open")
+	assert.Equal(t, stats.Failures, int64(2))
+	assert.Equal(t, stats.Successes, int64(2))
+	assert.Equal(t, stats.Rejected, int64(1))
+}
+
+func TestCircuitBreakerDefaultsZeroFields(t *testing.T) {
+	config := &CircuitBreakerConfig{CoolDown: time.Minute}
+	breaker := newCircuitBreaker(config)
+
+	assert.Equal(t, breaker.config, &CircuitBreakerConfig{
+		WindowSize:           20,
+		MinRequests:          5,
+		FailureRateThreshold: 0.5,
+		CoolDown:             time.Minute,
+		HalfOpenRequests:     1,
+	})
+	assert.Equal(t, config, &CircuitBreakerConfig{CoolDown: time.Minute})
+
+	// Successful requests never open the breaker.
+	for i := 0; i < 10; i++ {
+		allowed, transition := breaker.allow()
+		assert.True(t, allowed)
+		assert.Nil(t, transition)
+		assert.Nil(t, breaker.record(true))
+	}
+
+	for i := 0; i < 9; i++ {
+		assert.Nil(t, breaker.record(false))
+	}
+	assert.NotNil(t, breaker.record(false))
+
+	// The breaker stays open for the cool down.
+	allowed, transition := breaker.allow()
+	assert.False(t, allowed)
+	assert.Nil(t, transition)
+}
+
+func TestCircuitBreakerWindowSlides(t *testing.T) {
+	breaker := newCircuitBreaker(&CircuitBreakerConfig{
+		WindowSize:           3,
+		MinRequests:          3,
+		FailureRateThreshold: 0.6,
+		CoolDown:             time.Minute,
+	})
+
+	breaker.record(false)
+	breaker.record(true)
+	breaker.record(true)
+	breaker.record(true)
+	assert.Nil(t, breaker.record(false))
+
+	assert.Equal(t, breaker.record(false),
+		&circuitTransition{from: CircuitClosed, to: CircuitOpen})
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	breaker := newCircuitBreaker(&CircuitBreakerConfig{
+		WindowSize:           1,
+		MinRequests:          1,
+		FailureRateThreshold: 1,
+		CoolDown:             time.Minute,
+		HalfOpenRequests:     1,
+	})
+	now := time.Now()
+	breaker.now = func() time.Time { return now }
+
+	breaker.record(false)
+	assert.Equal(t, breaker.snapshot().State, "open")
+
+	now = now.Add(time.Minute)
+	allowed, transition := breaker.allow()
+	assert.True(t, allowed)
+	assert.Equal(t, transition,
+		&circuitTransition{from: CircuitOpen, to: CircuitHalfOpen})
+
+	// Only one trial request is allowed.
+	allowed, _ = breaker.allow()
+	assert.False(t, allowed)
+
+	assert.Equal(t, breaker.record(false),
+		&circuitTransition{from: CircuitHalfOpen, to: CircuitOpen})
+
+	now = now.Add(time.Minute)
+	allowed, _ = breaker.allow()
+	assert.True(t, allowed)
+	assert.Equal(t, breaker.record(true),
+		&circuitTransition{from: CircuitHalfOpen, to: CircuitClosed})
+
+	allowed, _ = breaker.allow()
+	assert.True(t, allowed)
+}
+
+func TestCircuitBreakerCancelReleasesTrialRequest(t *testing.T) {
+	breaker := newCircuitBreaker(&CircuitBreakerConfig{
+		WindowSize:           1,
+		MinRequests:          1,
+		FailureRateThreshold: 1,
+		CoolDown:             time.Minute,
+	})
+
+	breaker.record(false)
+	breaker.now = func() time.Time { return time.Now().Add(time.Minute) }
+	allowed, _ := breaker.allow()
+	assert.True(t, allowed)
+
+	breaker.cancel()
+	allowed, _ = breaker.allow()
+	assert.True(t, allowed)
+}
+
+func TestGetAdFailsFastWhenCircuitIsOpen(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}),
+	)
+	defer ts.Close()
+
+	events := make([]*eventCall, 0)
+	client := &client{
+		pop:            NewTestProofOfPlay(),
+		httpClient:     ts.Client(),
+		bandwidthStats: make(map[string]Stats),
+		breakers:       make(map[string]*circuitBreaker),
+		breakerConfig: &CircuitBreakerConfig{
+			WindowSize:           2,
+			MinRequests:          2,
+			FailureRateThreshold: 1,
+			CoolDown:             time.Minute,
+		},
+		events: NewEventFuncHandler(func(name string, message string,
+			source string, level string) {
+			events = append(events, &eventCall{
+				name: name, message: message, level: level})
+		}),
+	}
+
+	request := &request{url: ts.URL, data: newTestData()}
+	for i := 0; i < 2; i++ {
+		_, err := client.GetAdContext(context.Background(), request)
+		assert.NotEqual(t, err, ErrCircuitOpen)
+	}
+
+	_, err := client.GetAdContext(context.Background(), request)
+	assert.Equal(t, err, ErrCircuitOpen)
+	assert.Equal(t, calls, 2)
+
+	last := events[len(events)-1]
+	assert.Equal(t, last.name, "circuit-breaker-state-changed")
+	assert.Equal(t, last.level, "warning")
+	assert.Equal(t, last.message,
+		"url: "+ts.URL+", from: closed, to: open")
+
+	stats := client.GetCircuitBreakerStats()
+	assert.Equal(t, stats[ts.URL].State, "open")
+	assert.Equal(t, stats[ts.URL].Rejected, int64(1))
+}
+
+func TestCircuitBreakerIgnoresClientErrors(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+		}),
+	)
+	defer ts.Close()
+
+	client := &client{
+		pop:            NewTestProofOfPlay(),
+		httpClient:     ts.Client(),
+		bandwidthStats: make(map[string]Stats),
+		breakers:       make(map[string]*circuitBreaker),
+		breakerConfig: &CircuitBreakerConfig{
+			WindowSize:           1,
+			MinRequests:          1,
+			FailureRateThreshold: 1,
+		},
+	}
+
+	request := &request{url: ts.URL, data: newTestData()}
+	client.GetAd(request)
+	_, err := client.GetAd(request)
+
+	assert.NotEqual(t, err, ErrCircuitOpen)
+	assert.Equal(t, client.GetCircuitBreakerStats()[ts.URL].State, "closed")
+}
@@ -2,9 +2,11 @@ package vistar
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"sync"
@@ -16,9 +18,13 @@ var MissingRequestData = errors.New("missing request data")
 var ProcessExpiredAdInterval = 1 * time.Minute
 
 type CacheFunc func(string, time.Duration) (string, error)
+type CacheContextFunc func(context.Context, string, time.Duration) (
+	string, error)
 type EventFunc func(string, string, string, string)
 type PoPFunc func(string, string, *ProofOfPlayRequest) (
 	*http.Response, error)
+type PoPContextFunc func(context.Context, string, string,
+	*ProofOfPlayRequest) (*http.Response, error)
 
 type Ad map[string]interface{}
 type AdResponse struct {
@@ -32,151 +38,565 @@ type AssetResponse struct {
 
 type Client interface {
 	GetAd(Request) (*AdResponse, error)
+	GetAdContext(context.Context, Request) (*AdResponse, error)
 	Expire(string) error
+	ExpireContext(context.Context, string) error
 	Confirm(string, int64) (string, error)
+	ConfirmContext(context.Context, string, int64) (string, error)
+	ConfirmPlayed(string, int64, time.Duration) (string, error)
+	ConfirmPlayedContext(context.Context, string, int64, time.Duration) (
+		string, error)
+	MarkPlaying(string) error
+	MarkPlayed(string, time.Duration) error
+	GetAdStatus(string) (AdStatus, bool)
+	GetInProgressAdsByState(...AdState) map[string]Ad
+	GetStuckAds(time.Duration) map[string]AdStatus
 	GetInProgressAds() map[string]Ad
 	GetAssets(Request) (*AssetResponse, error)
+	GetAssetsContext(context.Context, Request) (*AssetResponse, error)
+	GetAdV2(context.Context, Request) ([]*AdV2, error)
+	GetAssetsV2(context.Context, Request) ([]*AssetV2, error)
 	GetStats() map[string]Stats
+	SnapshotStats() map[string]Stats
+	ResetStats() map[string]Stats
+	GetWindowStats(StatsWindow) map[string]Stats
+	GetCircuitBreakerStats() map[string]CircuitBreakerStats
 	Close()
 }
 
 type ClientConfig struct {
-	ReqTimeout     time.Duration
+	ReqTimeout time.Duration
+	// EventFn is called with the events of level info and above, use
+	// EventHandler to receive them as Event values.
 	EventFn        EventFunc
 	CacheFn        CacheFunc
+	CacheContextFn CacheContextFunc
 	AssetTTL       time.Duration
 	ExpiryInterval time.Duration
-	PoPFn          PoPFunc
+	// PoPFn or PoPContextFn send the proof of play and expiration requests.
+	// Without either, they are sent with the client's own http.Client.
+	PoPFn        PoPFunc
+	PoPContextFn PoPContextFunc
+	PoPQueue     *PoPQueueConfig
+	// PoPBatch sends confirms and expires in batches, in front of the queue
+	// if there is one.
+	PoPBatch    *PoPBatchConfig
+	RetryPolicy *RetryPolicy
+	// CircuitBreaker enables a circuit breaker per endpoint. Its zero fields
+	// default to those of DefaultCircuitBreakerConfig.
+	CircuitBreaker *CircuitBreakerConfig
+	// ServerUrls and AssetEndpointUrls are used, with failover, for the
+	// requests that don't have urls of their own.
+	ServerUrls        []string
+	AssetEndpointUrls []string
+	// HealthCheckInterval is how often endpoints that failed are probed.
+	// Defaults to DefaultHealthCheckInterval.
+	HealthCheckInterval time.Duration
+	// ExpireLapsedLeases expires in progress ads LeaseExpiryMargin before
+	// their lease expires, instead of dropping them once it has expired.
+	// Ads that are playing or have played are kept until their lease has
+	// expired, so that they can still be confirmed.
+	ExpireLapsedLeases bool
+	LeaseExpiryMargin  time.Duration
+	// DisplayTimeSkew is how far the display time of a confirm may be
+	// before the ad was received or after the present. Defaults to
+	// DefaultDisplayTimeSkew.
+	DisplayTimeSkew time.Duration
+	// ExpireOnClose expires all in progress ads when the client is closed.
+	ExpireOnClose bool
+	// InProgressStore defaults to an in memory store. The client closes the
+	// store when it is closed.
+	InProgressStore InProgressStore
+	// FinalizedLedger records the ads that were confirmed or expired, so
+	// that confirming or expiring them again returns ErrAlreadyFinalized.
+	// Defaults to an in memory ledger of the last DefaultFinalizedLedgerSize
+	// ads. The client closes the ledger when it is closed.
+	FinalizedLedger FinalizedLedger
+	Metrics         Metrics
+	EventHandler    EventHandler
+	// EventBus receives the client's events when set, and EventHandler and
+	// EventFn are then called asynchronously with the bus's buffer size and
+	// drop policy. They only receive this client's events, while the bus's
+	// subscribers receive the events of every client it is shared with. The
+	// bus is not closed with the client.
+	EventBus *EventBus
+	// Transport makes the client's HTTP requests, it defaults to
+	// http.DefaultTransport. It is wrapped to measure bandwidth, so it
+	// should not decompress responses itself.
+	Transport http.RoundTripper
 }
 
 type client struct {
 	httpClient       *http.Client
+	retryPolicy      *RetryPolicy
+	breakerConfig    *CircuitBreakerConfig
+	breakerLock      sync.Mutex
+	breakers         map[string]*circuitBreaker
+	endpoints        *endpointHealth
+	serverUrls       []string
+	assetUrls        []string
+	expireLapsed     bool
+	leaseMargin      time.Duration
+	expireOnClose    bool
+	displayTimeSkew  time.Duration
+	playbackLock     sync.Mutex
+	playback         map[string]*adPlayback
 	pop              ProofOfPlay
 	assetTTL         time.Duration
-	cacheFn          CacheFunc
-	eventFn          EventFunc
-	lock             sync.RWMutex
-	inProgressAds    map[string]Ad
+	cacheFn          CacheContextFunc
+	events           EventHandler
+	subscription     *Subscription
+	inProgress       InProgressStore
+	finalized        FinalizedLedger
+	metrics          Metrics
 	statsLock        sync.RWMutex
 	bandwidthStats   map[string]Stats
+	statsRings       []*statsRing
+	closeOnce        sync.Once
 	closeCh          chan struct{}
 	adExpiryInterval time.Duration
 }
 
 func NewClientForTesting(config *ClientConfig,
 	expiryInterval time.Duration) *client {
+	return newClient(config, expiryInterval)
+}
+
+func NewClient(config *ClientConfig) *client {
+	return newClient(config, ProcessExpiredAdInterval)
+}
+
+func newClient(config *ClientConfig, expiryInterval time.Duration) *client {
 	httpClient := &http.Client{Timeout: config.ReqTimeout}
-	pop := NewProofOfPlay(config.EventFn, config.PoPFn)
+
+	popFn := config.PoPContextFn
+	if popFn == nil {
+		popFn = contextPoPFunc(config.PoPFn)
+	}
+
+	if popFn == nil {
+		popFn = NewHTTPPoPFunc(httpClient)
+	}
+	events := combineEventHandlers(config.EventHandler,
+		NewEventFuncHandler(config.EventFn))
+	var subscription *Subscription
+	if config.EventBus != nil {
+		if events != nil {
+			// The client's own handlers get their own fan-out, so that they
+			// don't receive the events of other clients sharing the bus.
+			own := config.EventBus.fork()
+			subscription = own.Subscribe(events, nil)
+			events = eventHandlers{own, config.EventBus}
+		} else {
+			events = config.EventBus
+		}
+	}
+	pop := NewProofOfPlayContext(nil, popFn)
+	pop.events = events
+	pop.metrics = config.Metrics
+
+	cacheFn := config.CacheContextFn
+	if cacheFn == nil {
+		cacheFn = contextCacheFunc(config.CacheFn)
+	}
 
 	c := &client{
 		pop:              pop,
 		assetTTL:         config.AssetTTL,
 		httpClient:       httpClient,
-		eventFn:          config.EventFn,
-		cacheFn:          config.CacheFn,
-		inProgressAds:    make(map[string]Ad),
+		retryPolicy:      config.RetryPolicy,
+		breakerConfig:    config.CircuitBreaker,
+		breakers:         make(map[string]*circuitBreaker),
+		events:           events,
+		subscription:     subscription,
+		cacheFn:          cacheFn,
+		inProgress:       config.InProgressStore,
+		finalized:        config.FinalizedLedger,
+		metrics:          config.Metrics,
 		bandwidthStats:   make(map[string]Stats),
-		closeCh:          make(chan struct{}, 1),
+		statsRings:       newStatsRings(),
+		endpoints:        newEndpointHealth(),
+		serverUrls:       config.ServerUrls,
+		assetUrls:        config.AssetEndpointUrls,
+		expireLapsed:     config.ExpireLapsedLeases,
+		leaseMargin:      config.LeaseExpiryMargin,
+		expireOnClose:    config.ExpireOnClose,
+		displayTimeSkew:  config.DisplayTimeSkew,
+		playback:         make(map[string]*adPlayback),
+		closeCh:          make(chan struct{}),
 		adExpiryInterval: expiryInterval,
 	}
+	httpClient.Transport = newCountingTransport(config.Transport,
+		c.updateTransferStats)
 
-	go c.processExpiredAds()
-	return c
-}
+	if c.inProgress == nil {
+		c.inProgress = NewMemoryInProgressStore()
+	}
 
-func NewClient(config *ClientConfig) *client {
-	httpClient := &http.Client{Timeout: config.ReqTimeout}
-	pop := NewProofOfPlay(config.EventFn, config.PoPFn)
+	if c.finalized == nil {
+		c.finalized = NewMemoryFinalizedLedger(DefaultFinalizedLedgerSize)
+	}
 
-	c := &client{
-		pop:              pop,
-		assetTTL:         config.AssetTTL,
-		httpClient:       httpClient,
-		eventFn:          config.EventFn,
-		cacheFn:          config.CacheFn,
-		inProgressAds:    make(map[string]Ad),
-		bandwidthStats:   make(map[string]Stats),
-		closeCh:          make(chan struct{}, 1),
-		adExpiryInterval: ProcessExpiredAdInterval,
+	if c.displayTimeSkew <= 0 {
+		c.displayTimeSkew = DefaultDisplayTimeSkew
+	}
+	pop.statsFn = c.updateRequestStats
+
+	if config.PoPQueue != nil {
+		queue, err := NewPoPQueue(pop, config.PoPQueue)
+		if err != nil {
+			c.publishEvent(Event{
+				Name:  EventPoPQueueFailed,
+				Level: EventLevelWarning,
+				Message: fmt.Sprintf("dir: %s, error: %s",
+					config.PoPQueue.Dir, err.Error()),
+				Err:    err,
+				Fields: map[string]interface{}{"dir": config.PoPQueue.Dir},
+			})
+		} else {
+			c.pop = queue
+		}
+	}
+
+	if config.PoPBatch != nil {
+		c.pop = NewPoPBatcher(c.pop, events, config.PoPBatch)
+	}
+
+	healthCheckInterval := config.HealthCheckInterval
+	if healthCheckInterval <= 0 {
+		healthCheckInterval = DefaultHealthCheckInterval
 	}
 
 	go c.processExpiredAds()
+	go c.processHealthChecks(healthCheckInterval)
 	return c
 }
 
+// contextCacheFunc adapts a CacheFunc so that it is skipped once the context
+// is done. The wrapped function itself cannot be interrupted.
+func contextCacheFunc(fn CacheFunc) CacheContextFunc {
+	if fn == nil {
+		return nil
+	}
+
+	return func(ctx context.Context, url string, ttl time.Duration) (
+		string, error) {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		return fn(url, ttl)
+	}
+}
+
+// Close can be called more than once, only the first call has an effect.
 func (c *client) Close() {
-	c.closeCh <- struct{}{}
+	c.closeOnce.Do(c.close)
 }
 
+func (c *client) close() {
+	close(c.closeCh)
+
+	if c.expireOnClose {
+		for adId := range c.GetInProgressAds() {
+			ad, ok := c.removeFromInProgressList(adId)
+			if ok {
+				c.finishPlayback(adId, AdStateExpired)
+				c.expireAd(ad, EventAdExpiredOnClose)
+			}
+		}
+	}
+
+	if err := c.inProgress.Close(); err != nil {
+		c.publishStoreError(err)
+	}
+
+	if err := c.finalized.Close(); err != nil {
+		c.publishLedgerError(err)
+	}
+
+	if closer, ok := c.pop.(io.Closer); ok {
+		closer.Close()
+	}
+
+	if c.subscription != nil {
+		c.subscription.Unsubscribe()
+	}
+}
+
+// GetStats is the same as SnapshotStats.
 func (c *client) GetStats() map[string]Stats {
+	return c.SnapshotStats()
+}
+
+// SnapshotStats returns a copy of the stats per url since the client was
+// created or the stats were last reset.
+func (c *client) SnapshotStats() map[string]Stats {
+	c.statsLock.RLock()
+	defer c.statsLock.RUnlock()
+
+	ret := make(map[string]Stats, len(c.bandwidthStats))
+	for url, stats := range c.bandwidthStats {
+		ret[url] = copyStats(stats)
+	}
+	return ret
+}
+
+// ResetStats returns the stats per url and starts counting from zero, no
+// request is lost or counted twice between the two. The rolling windows are
+// not reset.
+func (c *client) ResetStats() map[string]Stats {
 	c.statsLock.Lock()
 	defer c.statsLock.Unlock()
 
-	return c.bandwidthStats
+	ret := c.bandwidthStats
+	if ret == nil {
+		ret = map[string]Stats{}
+	}
+	c.bandwidthStats = make(map[string]Stats)
+	return ret
 }
 
-func (c *client) GetInProgressAds() map[string]Ad {
-	c.lock.RLock()
-	defer c.lock.RUnlock()
+// GetWindowStats returns the stats per url of the requests made within the
+// window, up to the present.
+func (c *client) GetWindowStats(window StatsWindow) map[string]Stats {
+	c.statsLock.RLock()
+	defer c.statsLock.RUnlock()
+
+	if int(window) < 0 || int(window) >= len(c.statsRings) {
+		return map[string]Stats{}
+	}
+	return c.statsRings[window].snapshot(time.Now())
+}
+
+func (c *client) GetCircuitBreakerStats() map[string]CircuitBreakerStats {
+	c.breakerLock.Lock()
+	defer c.breakerLock.Unlock()
 
-	ret := map[string]Ad{}
-	for k, v := range c.inProgressAds {
-		ret[k] = v
+	ret := map[string]CircuitBreakerStats{}
+	for url, breaker := range c.breakers {
+		ret[url] = breaker.snapshot()
 	}
 	return ret
 }
 
+func (c *client) GetInProgressAds() map[string]Ad {
+	ads, err := c.inProgress.List()
+	if err != nil {
+		c.publishStoreError(err)
+		return map[string]Ad{}
+	}
+	return ads
+}
+
+// AssetInUse reports whether path is the cached asset of an ad that is in
+// progress, including the ads that are playing. It can be given to
+// DiskCache.SetInUse so that the cache doesn't evict them.
+func (c *client) AssetInUse(path string) bool {
+	for _, ad := range c.GetInProgressAds() {
+		if local, _ := ad["asset_url"].(string); local == path {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *client) Expire(adId string) error {
-	ad, ok := c.removeFromInProgressList(adId)
-	if !ok {
-		return AdNotFound
+	return c.ExpireContext(context.Background(), adId)
+}
+
+func (c *client) ExpireContext(ctx context.Context, adId string) error {
+	ad, err := c.finalize(adId)
+	if err != nil {
+		return err
 	}
 
-	err := c.pop.Expire(ad)
-	return err
+	c.finishPlayback(adId, AdStateExpired)
+	return c.pop.ExpireContext(ctx, ad)
 }
 
 func (c *client) Confirm(adId string, displayTime int64) (string, error) {
-	ad, ok := c.removeFromInProgressList(adId)
-	if !ok {
-		return "", AdNotFound
+	return c.ConfirmContext(context.Background(), adId, displayTime)
+}
+
+// ConfirmContext checks the required completion, like ConfirmPlayed, of an
+// ad that was marked as played.
+func (c *client) ConfirmContext(ctx context.Context, adId string,
+	displayTime int64) (string, error) {
+	if playback, ok := c.playbackOf(adId); ok &&
+		playback.state == AdStatePlayed {
+		return c.ConfirmPlayedContext(ctx, adId, displayTime, playback.played)
+	}
+
+	displayTime = c.resolveDisplayTime(adId, displayTime)
+	if err := c.validateConfirm(adId, displayTime).errorOrNil(); err != nil {
+		return "", err
+	}
+
+	ad, err := c.finalize(adId)
+	if err != nil {
+		return "", err
+	}
+
+	c.finishPlayback(adId, AdStateConfirmed)
+
+	err = c.pop.ConfirmContext(ctx, ad, displayTime)
+	return originalAssetUrl(ad), err
+}
+
+// ConfirmAsync is like Confirm, but it does not wait for the request to be
+// sent when the client batches proof of play.
+func (c *client) ConfirmAsync(adId string, displayTime int64) (*PoPFuture,
+	error) {
+	displayTime = c.resolveDisplayTime(adId, displayTime)
+	if err := c.validateConfirm(adId, displayTime).errorOrNil(); err != nil {
+		return nil, err
+	}
+
+	playback, _ := c.playbackOf(adId)
+	ad, err := c.finalize(adId)
+	if err != nil {
+		return nil, err
+	}
+
+	if playback.state == AdStatePlayed {
+		incomplete := c.checkCompletion(adId, ad, playback, playback.played)
+		if incomplete != nil {
+			future := newPoPFuture()
+			c.expireNoWait(context.Background(), ad, func(err error) {
+				if err == nil {
+					err = incomplete
+				}
+				future.resolve(err)
+			})
+			return future, nil
+		}
 	}
 
-	err := c.pop.Confirm(ad, displayTime)
-	return ad["original_asset_url"].(string), err
+	c.finishPlayback(adId, AdStateConfirmed)
+
+	if batcher, ok := c.pop.(*popBatcher); ok {
+		return batcher.ConfirmAsync(ad, displayTime), nil
+	}
+	return resolvedPoPFuture(c.pop.Confirm(ad, displayTime)), nil
+}
+
+// ExpireAsync is like Expire, but it does not wait for the request to be
+// sent when the client batches proof of play.
+func (c *client) ExpireAsync(adId string) (*PoPFuture, error) {
+	ad, err := c.finalize(adId)
+	if err != nil {
+		return nil, err
+	}
+
+	c.finishPlayback(adId, AdStateExpired)
+
+	if batcher, ok := c.pop.(*popBatcher); ok {
+		return batcher.ExpireAsync(ad), nil
+	}
+	return resolvedPoPFuture(c.pop.Expire(ad)), nil
 }
 
 func (c *client) GetAd(request Request) (*AdResponse, error) {
-	body, err := c.post(request.ServerUrl(), request)
+	return c.GetAdContext(context.Background(), request)
+}
+
+func (c *client) GetAdContext(ctx context.Context, request Request) (
+	resp *AdResponse, err error) {
+	start := time.Now()
+	defer func() {
+		c.publishAdRequest(request, resp, err, time.Since(start))
+	}()
+
+	if data := request.Data(); data != nil {
+		if err := data.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	body, err := c.postWithFailover(ctx, c.serverUrlsOf(request), request)
 	if err != nil {
 		return nil, err
 	}
 
-	resp := &AdResponse{}
+	resp = &AdResponse{}
 	err = json.Unmarshal(body, resp)
 	if err != nil {
 		return nil, err
 	}
 
+	if c.metrics != nil {
+		c.metrics.AdsReturned(len(resp.Advertisement))
+	}
+
 	if len(resp.Advertisement) == 0 {
-		c.publishEvent("ad-server-returned-no-ads", "", "warning")
+		c.publishEvent(Event{
+			Name:  EventAdServerReturnedNoAds,
+			Level: EventLevelWarning,
+		})
 		return resp, nil
 	}
 
+	c.markInvalidAds(resp)
+	c.trackPlayback(resp, start, request.Data())
+
 	if c.cacheFn != nil {
-		c.cacheAds(resp)
+		c.cacheAds(ctx, resp)
 	} else {
 		for _, ad := range resp.Advertisement {
-			c.addToInProgressList(ad)
+			if shouldExpire, _ := ad["should_expire"].(bool); !shouldExpire {
+				adId, _ := ad["id"].(string)
+				c.setAdState(adId, AdStateReady)
+				c.addToInProgressList(ad)
+			}
 		}
 	}
 
-	cleanedResponse := c.tryToExpireAds(resp)
+	cleanedResponse := c.tryToExpireAds(ctx, resp)
 	return cleanedResponse, nil
 }
 
+// publishAdRequest records the request data, without the api key, and the
+// ads returned for auditing.
+func (c *client) publishAdRequest(request Request, resp *AdResponse,
+	err error, duration time.Duration) {
+	if c.events == nil {
+		return
+	}
+
+	fields := map[string]interface{}{
+		"urls":    c.serverUrlsOf(request),
+		"request": request.Data().sanitized(),
+	}
+
+	message := ""
+	if resp != nil {
+		adIds := make([]string, 0, len(resp.Advertisement))
+		for _, ad := range resp.Advertisement {
+			adId, _ := ad["id"].(string)
+			adIds = append(adIds, adId)
+		}
+		fields["ad_ids"] = adIds
+		message = fmt.Sprintf("ads: %d", len(adIds))
+	}
+
+	c.publishEvent(Event{
+		Name:     EventAdRequest,
+		Level:    EventLevelDebug,
+		Message:  message,
+		Err:      err,
+		Duration: duration,
+		Fields:   fields,
+	})
+}
+
 func (c *client) GetAssets(request Request) (*AssetResponse, error) {
-	body, err := c.post(request.AssetEndpointUrl(), request)
+	return c.GetAssetsContext(context.Background(), request)
+}
+
+func (c *client) GetAssetsContext(ctx context.Context, request Request) (
+	*AssetResponse, error) {
+	body, err := c.postWithFailover(ctx, c.assetEndpointUrlsOf(request),
+		request)
 	if err != nil {
 		return nil, err
 	}
@@ -188,13 +608,107 @@ func (c *client) GetAssets(request Request) (*AssetResponse, error) {
 	}
 
 	if len(resp.Assets) == 0 {
-		c.publishEvent("ad-server-returned-no-assets", "", "warning")
+		c.publishEvent(Event{
+			Name:  EventAdServerReturnedNoAssets,
+			Level: EventLevelWarning,
+		})
 	}
 
 	return resp, nil
 }
 
-func (c *client) post(url string, request Request) ([]byte, error) {
+// GetAdV2 returns the ads as typed structs. Ads that fail validation are
+// left out, expired and reported through an EventAdServerReturnedInvalidAd
+// event, and their *InvalidAdError are returned in an
+// *InvalidResponseError alongside the valid ads.
+func (c *client) GetAdV2(ctx context.Context, request Request) ([]*AdV2,
+	error) {
+	resp, err := c.GetAdContext(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	var invalid []error
+	ads := make([]*AdV2, 0, len(resp.Advertisement))
+	for _, ad := range resp.Advertisement {
+		typed, err := NewAdV2(ad)
+		if err == nil {
+			err = typed.Validate()
+		}
+
+		if err != nil {
+			adId, _ := ad["id"].(string)
+			if _, ok := err.(*InvalidAdError); !ok {
+				err = &InvalidAdError{
+					AdId: adId,
+					Errors: ValidationErrors{{Field: "ad",
+						Message: err.Error()}},
+				}
+			}
+
+			invalid = append(invalid, err)
+			c.publishEvent(Event{
+				Name:    EventAdServerReturnedInvalidAd,
+				Level:   EventLevelWarning,
+				Message: fmt.Sprintf("adId: %s, error: %s", adId, err.Error()),
+				AdId:    adId,
+				Err:     err,
+			})
+			c.ExpireContext(ctx, adId)
+			continue
+		}
+		ads = append(ads, typed)
+	}
+
+	if len(invalid) > 0 {
+		return ads, &InvalidResponseError{Errors: invalid}
+	}
+	return ads, nil
+}
+
+// GetAssetsV2 returns the assets as typed structs. Assets that fail
+// validation are left out, reported through an
+// EventAdServerReturnedInvalidAsset event, and their errors are returned in
+// an *InvalidResponseError alongside the valid assets.
+func (c *client) GetAssetsV2(ctx context.Context, request Request) (
+	[]*AssetV2, error) {
+	resp, err := c.GetAssetsContext(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	var invalid []error
+	assets := make([]*AssetV2, 0, len(resp.Assets))
+	for _, asset := range resp.Assets {
+		typed, err := NewAssetV2(asset)
+		if err == nil {
+			err = typed.Validate()
+		}
+
+		if err != nil {
+			invalid = append(invalid, err)
+			assetUrl, _ := asset["asset_url"].(string)
+			c.publishEvent(Event{
+				Name:  EventAdServerReturnedInvalidAsset,
+				Level: EventLevelWarning,
+				Message: fmt.Sprintf("url: %s, error: %s", assetUrl,
+					err.Error()),
+				Url: assetUrl,
+				Err: err,
+			})
+			continue
+		}
+		assets = append(assets, typed)
+	}
+
+	if len(invalid) > 0 {
+		return assets, &InvalidResponseError{Errors: invalid}
+	}
+	return assets, nil
+}
+
+func (c *client) post(ctx context.Context, url string, request Request) (
+	[]byte, error) {
 	reqData := request.Data()
 	if reqData == nil {
 		return nil, MissingRequestData
@@ -205,70 +719,199 @@ func (c *client) post(url string, request Request) ([]byte, error) {
 		return nil, err
 	}
 
-	hreq, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
+	for attempt := 1; ; attempt++ {
+		breaker := c.circuitBreaker(url)
+		if breaker != nil {
+			allowed, transition := breaker.allow()
+			c.publishCircuitTransition(url, transition)
+			if !allowed {
+				return nil, ErrCircuitOpen
+			}
+		}
+
+		body, status, header, err := c.postOnce(ctx, url, data)
+		if breaker != nil {
+			if ctx.Err() != nil {
+				breaker.cancel()
+			} else {
+				c.publishCircuitTransition(url,
+					breaker.record(!isServerFailure(status, err)))
+			}
+		}
+		if err == nil || attempt >= c.retryPolicy.attempts() ||
+			ctx.Err() != nil || !c.retryPolicy.shouldRetry(status, err) {
+			return body, err
+		}
+
+		delay := c.retryPolicy.delay(attempt, header)
+		c.updateRetryStats(url)
+		c.publishEvent(Event{
+			Name:  EventAdServerRequestRetry,
+			Level: EventLevelWarning,
+			Message: fmt.Sprintf("url: %s, attempt: %d, delay: %s, error: %s",
+				url, attempt, delay, err.Error()),
+			Url:      url,
+			Status:   status,
+			Err:      err,
+			Duration: delay,
+			Fields:   map[string]interface{}{"attempt": attempt},
+		})
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// postOnce makes a single request. The status code is 0 and the header is
+// nil when no response was received.
+func (c *client) postOnce(ctx context.Context, url string, data []byte) (
+	body []byte, status int, header http.Header, err error) {
+	start := time.Now()
+	defer func() {
+		latency := time.Since(start)
+		c.updateRequestStats(url, latency, status, err)
+		if c.metrics != nil {
+			c.metrics.AdRequest(url, latency, status, err)
+		}
+	}()
+
+	hreq, err := http.NewRequestWithContext(withStatsKey(ctx, url), "POST",
+		url, bytes.NewBuffer(data))
 	if err != nil {
-		return nil, err
+		return nil, 0, nil, err
 	}
 
 	hreq.Header.Set("Content-Type", "application/json")
 	resp, err := c.httpClient.Do(hreq)
 	if err != nil {
-		return nil, err
+		return nil, 0, nil, err
 	}
 	defer resp.Body.Close()
 
-	c.updateBandwidthStats(
-		url, getRequestLength(hreq), getResponseLength(resp))
-
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err = ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, resp.StatusCode, resp.Header, err
 	}
 
 	if resp.StatusCode >= http.StatusBadRequest {
-		c.publishEvent(
-			"ad-server-endpoint-failed",
-			fmt.Sprintf("url: %s, code: %d, body: %s", url, resp.StatusCode,
-				string(body)),
-			"warning")
-		return nil, fmt.Errorf("Ad server returned an error. url: %s, "+
-			"code: %d, body: %s", url, resp.StatusCode, string(body))
+		c.publishEvent(Event{
+			Name:  EventAdServerEndpointFailed,
+			Level: EventLevelWarning,
+			Message: fmt.Sprintf("url: %s, code: %d, body: %s", url,
+				resp.StatusCode, string(body)),
+			Url:      url,
+			Status:   resp.StatusCode,
+			Duration: time.Since(start),
+			Fields:   map[string]interface{}{"body": string(body)},
+		})
+		return nil, resp.StatusCode, resp.Header, &ServerError{
+			Url:        url,
+			StatusCode: resp.StatusCode,
+			Body:       string(body),
+		}
 	}
-	return body, err
+	return body, resp.StatusCode, resp.Header, nil
 }
 
-func (c *client) cacheAds(resp *AdResponse) {
+func (c *client) cacheAds(ctx context.Context, resp *AdResponse) {
 	if c.cacheFn == nil {
 		return
 	}
 	var wg sync.WaitGroup
 	for _, ad := range resp.Advertisement {
-		originalUrl := ad["asset_url"].(string)
+		if shouldExpire, _ := ad["should_expire"].(bool); shouldExpire {
+			continue
+		}
+
+		adId, _ := ad["id"].(string)
+		originalUrl, ok := ad["asset_url"].(string)
+		if !ok {
+			c.setAdState(adId, AdStateFailed)
+			c.publishEvent(Event{
+				Name:  EventAdServerReturnedInvalidAd,
+				Level: EventLevelWarning,
+				Message: fmt.Sprintf("adId: %s, error: missing asset_url",
+					ad["id"]),
+				AdId: adId,
+				Err:  errors.New("missing asset_url"),
+			})
+			ad["should_expire"] = true
+			continue
+		}
+
+		c.setAdState(adId, AdStateCaching)
 		wg.Add(1)
 		go func(ad Ad) {
 			defer wg.Done()
-			local, err := c.cacheFn(originalUrl, c.assetTTL)
+			start := time.Now()
+			local, err := c.cacheFn(ctx, originalUrl, c.assetTTL)
 			if err != nil {
-				c.publishEvent("app-cache-failed",
-					fmt.Sprintf("url: %s, error: %s", originalUrl, err.Error()),
-					"warning")
+				if c.metrics != nil {
+					c.metrics.CacheFailure(originalUrl)
+				}
+				c.publishEvent(Event{
+					Name:  EventAppCacheFailed,
+					Level: EventLevelWarning,
+					Message: fmt.Sprintf("url: %s, error: %s", originalUrl,
+						err.Error()),
+					AdId: adId,
+					Url:  originalUrl,
+					Err:  err,
+				})
+				c.setAdState(adId, AdStateFailed)
 				ad["should_expire"] = true
 				return
 			}
 			ad["original_asset_url"] = originalUrl
 			ad["asset_url"] = local
+			c.publishEvent(Event{
+				Name:     EventAdCached,
+				Level:    EventLevelDebug,
+				Message:  fmt.Sprintf("url: %s, path: %s", originalUrl, local),
+				AdId:     adId,
+				Url:      originalUrl,
+				Duration: time.Since(start),
+				Fields:   map[string]interface{}{"path": local},
+			})
+			c.setAdState(adId, AdStateReady)
 			c.addToInProgressList(ad)
 		}(ad)
 	}
 	wg.Wait()
 }
 
-func (c *client) tryToExpireAds(resp *AdResponse) *AdResponse {
+// markInvalidAds flags the ads that can't be tracked because they don't have
+// an id, so that they are expired rather than handed to the caller.
+func (c *client) markInvalidAds(resp *AdResponse) {
+	for _, ad := range resp.Advertisement {
+		if _, ok := ad["id"].(string); !ok {
+			c.publishEvent(Event{
+				Name:    EventAdServerReturnedInvalidAd,
+				Level:   EventLevelWarning,
+				Message: "adId: , error: missing id",
+				Err:     errors.New("missing id"),
+			})
+			ad["should_expire"] = true
+		}
+	}
+}
+
+func (c *client) tryToExpireAds(ctx context.Context,
+	resp *AdResponse) *AdResponse {
 	cleaned := &AdResponse{}
 	for _, ad := range resp.Advertisement {
 		shouldExpire, ok := ad["should_expire"].(bool)
 		if ok && shouldExpire {
-			c.pop.Expire(ad)
+			adId, _ := ad["id"].(string)
+			c.finishPlayback(adId, AdStateExpired)
+			if adId == "" || c.recordFinalized(adId) {
+				c.expireNoWait(ctx, ad, nil)
+			}
 			continue
 		}
 		cleaned.Advertisement = append(cleaned.Advertisement, ad)
@@ -277,37 +920,213 @@ func (c *client) tryToExpireAds(resp *AdResponse) *AdResponse {
 }
 
 func (c *client) addToInProgressList(ad Ad) {
-	c.lock.Lock()
-	defer c.lock.Unlock()
+	if _, ok := ad["id"].(string); !ok {
+		return
+	}
 
-	adId := ad["id"].(string)
-	c.inProgressAds[adId] = ad
+	if err := c.inProgress.Put(ad); err != nil {
+		c.publishStoreError(err)
+	}
 }
 
 func (c *client) removeFromInProgressList(adId string) (Ad, bool) {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-
-	ad, ok := c.inProgressAds[adId]
-	delete(c.inProgressAds, adId)
+	ad, ok, err := c.inProgress.Remove(adId)
+	if err != nil {
+		c.publishStoreError(err)
+	}
 	return ad, ok
 }
 
-func (c client) publishEvent(name string, message string, level string) {
-	if c.eventFn == nil {
-		return
+// finalize removes the ad from the in progress list and records it as
+// finalized, so that it is confirmed or expired only once.
+func (c *client) finalize(adId string) (Ad, error) {
+	ad, ok := c.removeFromInProgressList(adId)
+	if !ok {
+		if c.isFinalized(adId) {
+			return nil, c.alreadyFinalized(adId)
+		}
+		return nil, AdNotFound
+	}
+
+	if !c.recordFinalized(adId) {
+		c.forgetPlayback(adId)
+		return nil, c.alreadyFinalized(adId)
+	}
+	return ad, nil
+}
+
+// recordFinalized returns false if the ad was already finalized. If the
+// ledger fails the ad is treated as not finalized, so that it is still
+// reported.
+func (c *client) recordFinalized(adId string) bool {
+	if c.finalized == nil {
+		return true
+	}
+
+	added, err := c.finalized.Add(adId)
+	if err != nil {
+		c.publishLedgerError(err)
+		return true
 	}
-	c.eventFn(name, message, "", level)
+	return added
+}
+
+func (c *client) isFinalized(adId string) bool {
+	if c.finalized == nil {
+		return false
+	}
+
+	ok, err := c.finalized.Contains(adId)
+	if err != nil {
+		c.publishLedgerError(err)
+	}
+	return ok
+}
+
+func (c *client) alreadyFinalized(adId string) error {
+	c.publishEvent(Event{
+		Name:    EventAdAlreadyFinalized,
+		Level:   EventLevelWarning,
+		Message: fmt.Sprintf("adId: %s", adId),
+		AdId:    adId,
+		Err:     ErrAlreadyFinalized,
+	})
+	return ErrAlreadyFinalized
+}
+
+func (c *client) publishLedgerError(err error) {
+	c.publishEvent(Event{
+		Name:    EventFinalizedLedgerFailed,
+		Level:   EventLevelWarning,
+		Message: err.Error(),
+		Err:     err,
+	})
+}
+
+func (c *client) publishStoreError(err error) {
+	c.publishEvent(Event{
+		Name:    EventInProgressStoreFailed,
+		Level:   EventLevelWarning,
+		Message: err.Error(),
+		Err:     err,
+	})
+}
+
+func (c *client) publishEvent(event Event) {
+	publishEvent(c.events, event)
 }
 
 func (c *client) updateBandwidthStats(url string, sentBytes int64,
 	receivedBytes int64) {
+	c.updateTransferStats(url, sentBytes, receivedBytes, receivedBytes)
+}
+
+// updateTransferStats records the bytes of a request, receivedBytes is the
+// size on the wire and decompressedBytes the size after decompression.
+func (c *client) updateTransferStats(url string, sentBytes int64,
+	receivedBytes int64, decompressedBytes int64) {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+
+	if c.metrics != nil {
+		c.metrics.Bytes(url, sentBytes, receivedBytes)
+	}
+
+	c.updateStatsLocked(url, time.Now(), func(stats *Stats) {
+		updateStats(stats, sentBytes, receivedBytes)
+		stats.BytesReceivedDecompressed += decompressedBytes
+	})
+}
+
+func (c *client) updateRequestStats(url string, latency time.Duration,
+	status int, err error) {
 	c.statsLock.Lock()
 	defer c.statsLock.Unlock()
 
+	now := time.Now()
+	c.updateStatsLocked(url, now, func(stats *Stats) {
+		updateRequestStats(stats, latency, status, err, now)
+	})
+}
+
+// updateStatsLocked applies update to the stats of url and to its stats in
+// each rolling window.
+func (c *client) updateStatsLocked(url string, now time.Time,
+	update func(*Stats)) {
+	if c.bandwidthStats == nil {
+		c.bandwidthStats = make(map[string]Stats)
+	}
+
+	if c.statsRings == nil {
+		c.statsRings = newStatsRings()
+	}
+
 	urlStats := c.bandwidthStats[url]
-	updateStats(&urlStats, sentBytes, receivedBytes)
+	update(&urlStats)
 	c.bandwidthStats[url] = urlStats
+
+	for _, ring := range c.statsRings {
+		update(ring.stats(url, now))
+	}
+}
+
+func (c *client) circuitBreaker(url string) *circuitBreaker {
+	if c.breakerConfig == nil {
+		return nil
+	}
+
+	c.breakerLock.Lock()
+	defer c.breakerLock.Unlock()
+
+	breaker, ok := c.breakers[url]
+	if !ok {
+		breaker = newCircuitBreaker(c.breakerConfig)
+		c.breakers[url] = breaker
+	}
+	return breaker
+}
+
+// isServerFailure reports whether the outcome of a request means that the
+// server is unavailable, as opposed to rejecting a bad request.
+func isServerFailure(status int, err error) bool {
+	if status == 0 {
+		return err != nil
+	}
+	return status >= http.StatusInternalServerError ||
+		status == http.StatusTooManyRequests
+}
+
+func (c *client) publishCircuitTransition(url string,
+	transition *circuitTransition) {
+	if transition == nil {
+		return
+	}
+
+	level := EventLevelInfo
+	if transition.to == CircuitOpen {
+		level = EventLevelWarning
+	}
+
+	c.publishEvent(Event{
+		Name:  EventCircuitBreakerStateChanged,
+		Level: level,
+		Message: fmt.Sprintf("url: %s, from: %s, to: %s", url,
+			transition.from, transition.to),
+		Url: url,
+		Fields: map[string]interface{}{
+			"from": transition.from.String(),
+			"to":   transition.to.String(),
+		},
+	})
+}
+
+func (c *client) updateRetryStats(url string) {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+
+	c.updateStatsLocked(url, time.Now(), func(stats *Stats) {
+		stats.Retries += 1
+	})
 }
 
 func (c *client) processExpiredAds() {
@@ -324,19 +1143,120 @@ func (c *client) processExpiredAds() {
 }
 
 func (c *client) removeExpiredAds() {
-	c.lock.Lock()
-	defer c.lock.Unlock()
+	now := time.Now()
+	deadline := now
+	if c.expireLapsed {
+		deadline = deadline.Add(c.leaseMargin)
+	}
 
-	for adId, ad := range c.inProgressAds {
-		leaseExpirySecond, ok := ad["lease_expiry"]
-		if !ok {
+	lapsed := make([]Ad, 0)
+	for adId, ad := range c.GetInProgressAds() {
+		expiry := leaseExpiry(ad)
+		if expiry == 0 {
+			continue
+		}
+
+		// An ad that is playing or has played can still be confirmed, so
+		// the margin does not apply to it.
+		if expiry > now.Unix() && c.isPlaying(adId) {
 			continue
 		}
 
-		// We are dropping the expired ad here and not expiring,
-		// because ad server expires them automatically after 24hrs.
-		if int64(leaseExpirySecond.(float64)) <= time.Now().Unix() {
-			delete(c.inProgressAds, adId)
+		if expiry <= deadline.Unix() {
+			// The ad may have been confirmed in the meantime.
+			if ad, ok := c.removeFromInProgressList(adId); ok {
+				c.finishPlayback(adId, AdStateExpired)
+				lapsed = append(lapsed, ad)
+			}
+		}
+	}
+
+	// Unless configured otherwise, we are dropping the expired ad here and
+	// not expiring, because ad server expires them automatically after
+	// 24hrs.
+	if !c.expireLapsed {
+		return
+	}
+
+	for _, ad := range lapsed {
+		c.expireAd(ad, EventAdLeaseExpired)
+	}
+}
+
+// isPlaying reports whether the ad is playing or has played and is yet to be
+// confirmed.
+func (c *client) isPlaying(adId string) bool {
+	playback, ok := c.playbackOf(adId)
+	return ok && (playback.state == AdStatePlaying ||
+		playback.state == AdStatePlayed)
+}
+
+func (c *client) expireAd(ad Ad, eventName string) {
+	adId, _ := ad["id"].(string)
+	if !c.recordFinalized(adId) {
+		return
+	}
+
+	c.expireNoWait(context.Background(), ad, func(err error) {
+		if err != nil {
+			c.publishEvent(Event{
+				Name:  eventName,
+				Level: EventLevelWarning,
+				Message: fmt.Sprintf("adId: %s, error: %s", adId,
+					err.Error()),
+				AdId: adId,
+				Err:  err,
+			})
+			return
+		}
+
+		c.publishEvent(Event{
+			Name:    eventName,
+			Level:   EventLevelInfo,
+			Message: fmt.Sprintf("adId: %s", adId),
+			AdId:    adId,
+		})
+	})
+}
+
+// expireNoWait expires an ad that the caller is not waiting on. When proof of
+// play is batched, it does not wait for the batch to be sent and calls done
+// once it has been.
+func (c *client) expireNoWait(ctx context.Context, ad Ad, done func(error)) {
+	batcher, ok := c.pop.(*popBatcher)
+	if !ok {
+		err := c.pop.ExpireContext(ctx, ad)
+		if done != nil {
+			done(err)
 		}
+		return
+	}
+
+	future := batcher.ExpireAsync(ad)
+	if done != nil {
+		go func() {
+			done(future.Wait(context.Background()))
+		}()
+	}
+}
+
+// originalAssetUrl returns the url the ad server returned for the asset,
+// which is replaced by the local path when the asset is cached.
+func originalAssetUrl(ad Ad) string {
+	if url, ok := ad["original_asset_url"].(string); ok {
+		return url
+	}
+
+	url, _ := ad["asset_url"].(string)
+	return url
+}
+
+// leaseExpiry returns the ad's lease expiry as a unix timestamp, or 0 if the
+// ad does not have one.
+func leaseExpiry(ad Ad) int64 {
+	expiry, ok := ad["lease_expiry"].(float64)
+	if !ok {
+		return 0
 	}
+	return int64(expiry)
 }
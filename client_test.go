@@ -1,14 +1,17 @@
 package vistar
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	neturl "net/url"
 	"testing"
 	"time"
 
+	"github.com/cortexsystems/vistar-go-client/vistartest"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -41,9 +44,9 @@ func TestCacheAdsNoCacher(t *testing.T) {
 	}
 	client := NewClient(config)
 
-	client.cacheAds(resp)
+	client.cacheAds(context.Background(), resp)
 
-	assert.Len(t, client.inProgressAds, 0)
+	assert.Len(t, client.GetInProgressAds(), 0)
 	assert.Len(t, resp.Advertisement, 2)
 	assert.Equal(t, resp.Advertisement[0]["asset_url"], "url1")
 	assert.Equal(t, resp.Advertisement[1]["asset_url"], "url2")
@@ -98,7 +101,7 @@ func TestCacheAds(t *testing.T) {
 	cacheEntry := "/cached-url"
 	done := make(chan bool)
 	go func() {
-		client.cacheAds(resp)
+		client.cacheAds(context.Background(), resp)
 		assert.Len(t, resp.Advertisement, 2)
 		assert.Equal(t, resp.Advertisement[0]["asset_url"], "url1")
 		assert.Equal(t, resp.Advertisement[0]["should_expire"], true)
@@ -108,8 +111,8 @@ func TestCacheAds(t *testing.T) {
 		_, ok := resp.Advertisement[1]["should_expire"]
 		assert.False(t, ok)
 
-		assert.Len(t, client.inProgressAds, 1)
-		assert.Equal(t, client.inProgressAds["2"]["asset_url"], "/cached-url")
+		assert.Len(t, client.GetInProgressAds(), 1)
+		assert.Equal(t, client.GetInProgressAds()["2"]["asset_url"], "/cached-url")
 
 		assert.Len(t, eventCalls, 1)
 		assert.Equal(t, eventCalls[0].name, "app-cache-failed")
@@ -147,7 +150,7 @@ func TestTryToExpireAdsAllValid(t *testing.T) {
 	pop := NewTestProofOfPlay()
 	client := &client{pop: pop}
 
-	nresp := client.tryToExpireAds(resp)
+	nresp := client.tryToExpireAds(context.Background(), resp)
 	assert.Len(t, nresp.Advertisement, 2)
 	assert.Equal(t, nresp.Advertisement[0]["id"], "1")
 	assert.Equal(t, nresp.Advertisement[1]["id"], "2")
@@ -168,7 +171,7 @@ func TestTryToExpireAds(t *testing.T) {
 	pop := NewTestProofOfPlay()
 	client := &client{pop: pop}
 
-	nresp := client.tryToExpireAds(resp)
+	nresp := client.tryToExpireAds(context.Background(), resp)
 	assert.Len(t, nresp.Advertisement, 1)
 	assert.Equal(t, nresp.Advertisement[0]["id"], "2")
 
@@ -193,16 +196,16 @@ func TestRemoveExpiredAds(t *testing.T) {
 	inProgressAds[ad2["id"].(string)] = ad2
 
 	client := &client{
-		inProgressAds: inProgressAds,
+		inProgress: &memoryInProgressStore{ads: inProgressAds},
 	}
 
-	assert.Equal(t, len(client.inProgressAds), 2)
+	assert.Equal(t, len(client.GetInProgressAds()), 2)
 
 	client.removeExpiredAds()
 
-	assert.Equal(t, len(client.inProgressAds), 1)
-	assert.NotContains(t, client.inProgressAds, ad1["id"].(string))
-	assert.Contains(t, client.inProgressAds, ad2["id"].(string))
+	assert.Equal(t, len(client.GetInProgressAds()), 1)
+	assert.NotContains(t, client.GetInProgressAds(), ad1["id"].(string))
+	assert.Contains(t, client.GetInProgressAds(), ad2["id"].(string))
 }
 
 func TestUpdateBandwidthStats(t *testing.T) {
@@ -235,6 +238,38 @@ func TestUpdateBandwidthStats(t *testing.T) {
 	assert.Equal(t, stats.Average, float64(1124))
 }
 
+func TestSnapshotAndResetStats(t *testing.T) {
+	client := &client{pop: NewTestProofOfPlay()}
+
+	client.updateBandwidthStats("/test", int64(100), int64(1024))
+	client.updateRequestStats("/test", 10*time.Millisecond, 200, nil)
+
+	snapshot := client.SnapshotStats()
+	assert.Equal(t, snapshot["/test"].Count, int64(1))
+
+	snapshot["/test"].StatusClasses["2xx"] = 10
+	client.updateRequestStats("/test", 30*time.Millisecond, 200, nil)
+	assert.Equal(t, snapshot["/test"].LatencyMax, float64(10))
+	assert.Equal(t, client.GetStats()["/test"].StatusClasses["2xx"],
+		int64(2))
+
+	reset := client.ResetStats()
+	assert.Equal(t, reset["/test"].Count, int64(1))
+	assert.Equal(t, reset["/test"].LatencyMax, float64(30))
+	assert.Equal(t, len(client.SnapshotStats()), 0)
+
+	client.updateBandwidthStats("/test", int64(10), int64(20))
+	assert.Equal(t, client.SnapshotStats()["/test"].Total, int64(30))
+	assert.Equal(t, reset["/test"].Total, int64(1124))
+
+	minute := client.GetWindowStats(StatsWindowMinute)
+	assert.Equal(t, minute["/test"].Count, int64(2))
+	assert.Equal(t, minute["/test"].Total, int64(1154))
+	assert.Equal(t, minute["/test"].StatusClasses["2xx"], int64(2))
+	assert.Equal(t, client.GetWindowStats(StatsWindowDay)["/test"].Count,
+		int64(2))
+}
+
 func TestPostWithMissingRequestData(t *testing.T) {
 	request := &request{}
 	pop := NewTestProofOfPlay()
@@ -242,7 +277,7 @@ func TestPostWithMissingRequestData(t *testing.T) {
 		pop: pop,
 	}
 
-	resp, err := client.post("test.com", request)
+	resp, err := client.post(context.Background(), "test.com", request)
 
 	assert.Empty(t, resp)
 	assert.Equal(t, err, MissingRequestData)
@@ -266,13 +301,16 @@ func TestPostToInvalidRequestUrl(t *testing.T) {
 
 	url := fmt.Sprintf("invalid%s", ts.URL)
 
-	resp, err := client.post(url, request)
+	resp, err := client.post(context.Background(), url, request)
 
 	assert.Empty(t, resp)
 	assert.NotEmpty(t, err)
-	assert.Equal(t, err.Error(),
-		fmt.Sprintf("Post %s: unsupported protocol scheme \"invalidhttp\"",
-			url))
+	expectedErr := &neturl.Error{
+		Op:  "Post",
+		URL: url,
+		Err: errors.New("unsupported protocol scheme \"invalidhttp\""),
+	}
+	assert.Equal(t, err.Error(), expectedErr.Error())
 }
 
 func TestPostServerReturnHttpError(t *testing.T) {
@@ -295,7 +333,7 @@ func TestPostServerReturnHttpError(t *testing.T) {
 		bandwidthStats: make(map[string]Stats),
 	}
 
-	resp, err := client.post(ts.URL, request)
+	resp, err := client.post(context.Background(), ts.URL, request)
 
 	expectedErrorMessage := fmt.Sprintf(
 		"Ad server returned an error. url: %s, code: %d, body: ",
@@ -327,7 +365,7 @@ func TestPostServerReturnedHttpOK(t *testing.T) {
 		bandwidthStats: make(map[string]Stats),
 	}
 
-	resp, err := client.post(ts.URL, request)
+	resp, err := client.post(context.Background(), ts.URL, request)
 
 	assert.NotEmpty(t, resp)
 	assert.Empty(t, err)
@@ -342,7 +380,7 @@ func TestGetAdReturnsErrorWhenServerReturnsError(t *testing.T) {
 	)
 	defer ts.Close()
 
-	data := &Data{}
+	data := newTestData()
 	request := &request{
 		url:  ts.URL,
 		data: data,
@@ -385,7 +423,7 @@ func TestGetAdReturnsAd(t *testing.T) {
 	)
 	defer ts.Close()
 
-	data := &Data{}
+	data := newTestData()
 	request := &request{
 		url:  ts.URL,
 		data: data,
@@ -441,7 +479,7 @@ func TestGetAdReturnsMultipleAds(t *testing.T) {
 	)
 	defer ts.Close()
 
-	data := &Data{}
+	data := newTestData()
 	request := &request{
 		url:  ts.URL,
 		data: data,
@@ -473,6 +511,21 @@ func TestGetAdReturnsMultipleAds(t *testing.T) {
 		})
 }
 
+// newTestData returns request data that passes validation.
+func newTestData() *Data {
+	return &Data{
+		ApiKey:    "api-key",
+		NetworkId: "network",
+		DeviceId:  "device",
+		DisplayAreas: []DisplayArea{{
+			Id:             "a",
+			Width:          1920,
+			Height:         1080,
+			SupportedMedia: []string{"image/jpeg"},
+		}},
+	}
+}
+
 func TestStopClient(t *testing.T) {
 	ad1 := map[string]interface{}{
 		"id":           "1",
@@ -496,7 +549,9 @@ func TestStopClient(t *testing.T) {
 		AssetTTL:   time.Second * 100,
 	}
 	client := NewClientForTesting(config, time.Millisecond*50)
-	client.inProgressAds = inProgressAds
+	for _, ad := range inProgressAds {
+		client.addToInProgressList(ad)
+	}
 
 	ads := client.GetInProgressAds()
 	assert.Equal(t, len(ads), 2)
@@ -535,3 +590,273 @@ func TestStopClient(t *testing.T) {
 	assert.NotContains(t, ads, ad1["id"].(string))
 	assert.Contains(t, ads, ad2["id"].(string))
 }
+
+func TestGetAdContextCancelled(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+		}),
+	)
+	defer ts.Close()
+
+	request := &request{
+		url:  ts.URL,
+		data: newTestData(),
+	}
+
+	client := &client{
+		pop:            NewTestProofOfPlay(),
+		httpClient:     ts.Client(),
+		bandwidthStats: make(map[string]Stats),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	resp, err := client.GetAdContext(ctx, request)
+
+	assert.Nil(t, resp)
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Equal(t, requests, 0)
+}
+
+func TestCacheAdsContextCancelled(t *testing.T) {
+	resp := &AdResponse{
+		Advertisement: []Ad{
+			map[string]interface{}{"id": "1", "asset_url": "url1"},
+		},
+	}
+
+	cacheCalls := 0
+	config := &ClientConfig{
+		ReqTimeout: time.Second,
+		CacheFn: func(url string, ttl time.Duration) (string, error) {
+			cacheCalls++
+			return "/cached-url", nil
+		},
+	}
+	client := NewClient(config)
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	client.cacheAds(ctx, resp)
+
+	assert.Equal(t, cacheCalls, 0)
+	assert.Len(t, client.GetInProgressAds(), 0)
+	assert.Equal(t, resp.Advertisement[0]["should_expire"], true)
+}
+
+func TestConfirmContextPassesContextToPoP(t *testing.T) {
+	type ctxKey struct{}
+	var received context.Context
+	config := &ClientConfig{
+		ReqTimeout: time.Second,
+		PoPContextFn: func(ctx context.Context, method string, url string,
+			data *ProofOfPlayRequest) (*http.Response, error) {
+			received = ctx
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		},
+	}
+	client := NewClient(config)
+	defer client.Close()
+
+	client.addToInProgressList(Ad{
+		"id":                 "1",
+		"proof_of_play_url":  "http://pop-url.com",
+		"original_asset_url": "url1",
+	})
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, "value")
+	url, err := client.ConfirmContext(ctx, "1", int64(100))
+
+	assert.Nil(t, err)
+	assert.Equal(t, url, "url1")
+	assert.Equal(t, received.Value(ctxKey{}), "value")
+}
+
+func TestConfirmWithoutCacherReturnsAssetUrl(t *testing.T) {
+	pop := NewTestProofOfPlay()
+	client := &client{
+		pop:        pop,
+		inProgress: NewMemoryInProgressStore(),
+	}
+
+	client.addToInProgressList(Ad{"id": "1", "asset_url": "url1"})
+	url, err := client.Confirm("1", int64(100))
+
+	assert.Nil(t, err)
+	assert.Equal(t, url, "url1")
+	assert.Len(t, pop.requests, 1)
+}
+
+func TestGetAdExpiresAdsWithoutId(t *testing.T) {
+	adResponse := &AdResponse{
+		[]Ad{
+			{"asset_url": "url1"},
+			{"id": "2", "asset_url": "url2"},
+		},
+	}
+
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			response, _ := json.Marshal(adResponse)
+			w.Write(response)
+		}),
+	)
+	defer ts.Close()
+
+	eventCalls := make([]*eventCall, 0, 0)
+	pop := NewTestProofOfPlay()
+	client := &client{
+		pop:            pop,
+		httpClient:     ts.Client(),
+		inProgress:     NewMemoryInProgressStore(),
+		bandwidthStats: make(map[string]Stats),
+		events: NewEventFuncHandler(func(name string, message string,
+			source string, level string) {
+			eventCalls = append(eventCalls, &eventCall{name: name})
+		}),
+	}
+
+	resp, err := client.GetAd(&request{url: ts.URL, data: newTestData()})
+
+	assert.Nil(t, err)
+	assert.Len(t, resp.Advertisement, 1)
+	assert.Equal(t, resp.Advertisement[0]["id"], "2")
+	assert.Len(t, client.GetInProgressAds(), 1)
+	assert.Len(t, pop.requests, 1)
+	assert.Len(t, eventCalls, 1)
+	assert.Equal(t, eventCalls[0].name, "ad-server-returned-invalid-ad")
+}
+
+func TestRemoveExpiredAdsExpiresLapsedLeases(t *testing.T) {
+	ad1 := map[string]interface{}{
+		"id":           "1",
+		"lease_expiry": float64(time.Now().Unix() + 30),
+	}
+	ad2 := map[string]interface{}{
+		"id":           "2",
+		"lease_expiry": float64(time.Now().Unix() + 1000),
+	}
+
+	inProgressAds := make(map[string]Ad)
+	inProgressAds[ad1["id"].(string)] = ad1
+	inProgressAds[ad2["id"].(string)] = ad2
+
+	eventCalls := make([]*eventCall, 0, 0)
+	pop := NewTestProofOfPlay()
+	client := &client{
+		pop:          pop,
+		inProgress:   &memoryInProgressStore{ads: inProgressAds},
+		expireLapsed: true,
+		leaseMargin:  time.Minute,
+		events: NewEventFuncHandler(func(name string, message string,
+			source string, level string) {
+			eventCalls = append(eventCalls, &eventCall{
+				name: name, message: message, level: level})
+		}),
+	}
+
+	client.removeExpiredAds()
+
+	assert.Len(t, client.GetInProgressAds(), 1)
+	assert.Contains(t, client.GetInProgressAds(), "2")
+	assert.Len(t, pop.requests, 1)
+	assert.Equal(t, pop.requests[0].Ad["id"], "1")
+	assert.False(t, pop.requests[0].Status)
+	assert.Len(t, eventCalls, 1)
+	assert.Equal(t, eventCalls[0].name, "ad-lease-expired")
+	assert.Equal(t, eventCalls[0].message, "adId: 1")
+	assert.Equal(t, eventCalls[0].level, "info")
+}
+
+func TestRemoveExpiredAdsKeepsPlayingAdsDuringMargin(t *testing.T) {
+	now := time.Now().Unix()
+	pop := NewTestProofOfPlay()
+	client := &client{
+		pop:             pop,
+		inProgress:      NewMemoryInProgressStore(),
+		expireLapsed:    true,
+		leaseMargin:     time.Minute,
+		displayTimeSkew: DefaultDisplayTimeSkew,
+	}
+
+	for _, ad := range []Ad{
+		{"id": "playing", "lease_expiry": float64(now + 30)},
+		{"id": "played", "lease_expiry": float64(now + 30)},
+		{"id": "lapsed", "lease_expiry": float64(now - 1)},
+	} {
+		client.addToInProgressList(ad)
+	}
+	assert.Nil(t, client.MarkPlaying("playing"))
+	assert.Nil(t, client.MarkPlaying("played"))
+	assert.Nil(t, client.MarkPlayed("played", 10*time.Second))
+	assert.Nil(t, client.MarkPlaying("lapsed"))
+
+	client.removeExpiredAds()
+
+	assert.Len(t, client.GetInProgressAds(), 2)
+	assert.Len(t, pop.requests, 1)
+	assert.Equal(t, pop.requests[0].Ad["id"], "lapsed")
+
+	_, err := client.Confirm("playing", now)
+	assert.Nil(t, err)
+	_, err = client.Confirm("played", now)
+	assert.Nil(t, err)
+	assert.Len(t, pop.requests, 3)
+	assert.True(t, pop.requests[1].Status)
+	assert.True(t, pop.requests[2].Status)
+}
+
+func TestCloseExpiresInProgressAds(t *testing.T) {
+	expired := make([]string, 0)
+	config := &ClientConfig{
+		ReqTimeout:    time.Second,
+		ExpireOnClose: true,
+		PoPFn: func(method string, url string,
+			data *ProofOfPlayRequest) (*http.Response, error) {
+			expired = append(expired, url)
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		},
+	}
+	client := NewClient(config)
+
+	client.addToInProgressList(Ad{"id": "1", "expiration_url": "expire-1"})
+	client.addToInProgressList(Ad{"id": "2", "expiration_url": "expire-2"})
+
+	client.Close()
+
+	assert.ElementsMatch(t, expired, []string{"expire-1", "expire-2"})
+	assert.Len(t, client.GetInProgressAds(), 0)
+}
+
+func TestCloseExpiresServedAds(t *testing.T) {
+	server := vistartest.NewServer(nil)
+	defer server.Close()
+
+	client := NewClient(&ClientConfig{
+		ReqTimeout:    time.Second,
+		ExpireOnClose: true,
+	})
+
+	data := newTestData()
+	data.DisplayAreas = append(data.DisplayAreas, DisplayArea{
+		Id:             "b",
+		SupportedMedia: []string{"video/mp4"},
+	})
+	resp, err := client.GetAd(NewRequest(server.AdUrl(), "", data, false, 0))
+	assert.Nil(t, err)
+	assert.Len(t, resp.Advertisement, 2)
+
+	_, err = client.Confirm("ad-1", time.Now().Unix())
+	assert.Nil(t, err)
+	client.Close()
+
+	assert.Equal(t, server.Confirmed(), []string{"ad-1"})
+	assert.Equal(t, server.Expired(), []string{"ad-2"})
+	assert.Len(t, server.Pending(), 0)
+	assert.Len(t, server.DoubleFinalized(), 0)
+}
@@ -1,5 +1,7 @@
 package vistar
 
+import "fmt"
+
 type DisplayArea struct {
 	AllowAudio     bool     `json:"allow_audio"`
 	Height         int64    `json:"height"`
@@ -33,6 +35,157 @@ type Data struct {
 	Interval           int64             `json:"interval,omitempty"`
 }
 
+// KnownMediaTypes are the media types that a display area can support.
+var KnownMediaTypes = []string{
+	"image/gif",
+	"image/jpeg",
+	"image/png",
+	"text/html",
+	"video/mp4",
+	"video/quicktime",
+	"video/webm",
+}
+
+// Validate checks that the fields the ad server requires are set and that
+// the others are within range. It returns all the problems it finds as
+// ValidationErrors.
+func (d *Data) Validate() error {
+	var errs ValidationErrors
+	if d.ApiKey == "" {
+		errs.add("api_key", "is required")
+	}
+
+	if d.NetworkId == "" {
+		errs.add("network_id", "is required")
+	}
+
+	if d.DeviceId == "" {
+		errs.add("device_id", "is required")
+	}
+
+	if d.RequiredCompletion < 0 || d.RequiredCompletion > 1 {
+		errs.add("required_completion", "must be between 0 and 1, got %g",
+			d.RequiredCompletion)
+	}
+
+	if d.Latitude < -90 || d.Latitude > 90 {
+		errs.add("latitude", "must be between -90 and 90, got %g",
+			d.Latitude)
+	}
+
+	if d.Longitude < -180 || d.Longitude > 180 {
+		errs.add("longitude", "must be between -180 and 180, got %g",
+			d.Longitude)
+	}
+
+	if d.DisplayTime < 0 {
+		errs.add("display_time", "must not be negative, got %d",
+			d.DisplayTime)
+	}
+
+	if d.NumberOfScreens < 0 {
+		errs.add("number_of_screens", "must not be negative, got %d",
+			d.NumberOfScreens)
+	}
+
+	if d.Duration < 0 {
+		errs.add("duration", "must not be negative, got %d", d.Duration)
+	}
+
+	if d.Interval < 0 {
+		errs.add("interval", "must not be negative, got %d", d.Interval)
+	}
+
+	if len(d.DisplayAreas) == 0 {
+		errs.add("display_area", "is required")
+	}
+
+	ids := make(map[string]bool, len(d.DisplayAreas))
+	for i, area := range d.DisplayAreas {
+		field := fmt.Sprintf("display_area[%d]", i)
+		if area.Id == "" {
+			errs.add(field+".id", "is required")
+		} else if ids[area.Id] {
+			errs.add(field+".id", "duplicate id %s", area.Id)
+		}
+		ids[area.Id] = true
+
+		area.validate(field, &errs)
+	}
+
+	for i, attribute := range d.DeviceAttributes {
+		if attribute.Name == "" {
+			errs.add(fmt.Sprintf("device_attribute[%d].name", i),
+				"is required")
+		}
+	}
+	return errs.errorOrNil()
+}
+
+func (a *DisplayArea) validate(field string, errs *ValidationErrors) {
+	if a.Width < 0 {
+		errs.add(field+".width", "must not be negative, got %d", a.Width)
+	}
+
+	if a.Height < 0 {
+		errs.add(field+".height", "must not be negative, got %d", a.Height)
+	}
+
+	if a.MinDuration < 0 {
+		errs.add(field+".min_duration", "must not be negative, got %d",
+			a.MinDuration)
+	}
+
+	if a.MaxDuration < 0 {
+		errs.add(field+".max_duration", "must not be negative, got %d",
+			a.MaxDuration)
+	}
+
+	if a.MaxDuration > 0 && a.MinDuration > a.MaxDuration {
+		errs.add(field+".min_duration", "%d is greater than max_duration %d",
+			a.MinDuration, a.MaxDuration)
+	}
+
+	if a.StaticDuration < 0 {
+		errs.add(field+".static_duration", "must not be negative, got %d",
+			a.StaticDuration)
+	}
+
+	if len(a.SupportedMedia) == 0 {
+		errs.add(field+".supported_media", "is required")
+	}
+
+	for _, media := range a.SupportedMedia {
+		if !isKnownMediaType(media) {
+			errs.add(field+".supported_media", "unknown media type %s",
+				media)
+		}
+	}
+}
+
+func isKnownMediaType(media string) bool {
+	for _, known := range KnownMediaTypes {
+		if media == known {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitized returns a copy of the data without the api key, so that it can
+// be logged.
+func (d *Data) sanitized() *Data {
+	if d == nil {
+		return nil
+	}
+
+	copy := *d
+	if copy.ApiKey != "" {
+		copy.ApiKey = "REDACTED"
+	}
+	return &copy
+}
+
 type Request interface {
 	Data() *Data
 	ServerUrl() string
@@ -42,13 +195,38 @@ type Request interface {
 	LogEnabled() bool
 }
 
+// FailoverRequest is a Request that can be sent to more than one url. It is
+// kept out of Request so that existing implementations of Request still
+// compile, requests that don't implement it are sent to their single url.
+type FailoverRequest interface {
+	Request
+	ServerUrls() []string
+	AssetEndpointUrls() []string
+}
+
+func serverUrls(r Request) []string {
+	if failover, ok := r.(FailoverRequest); ok {
+		return failover.ServerUrls()
+	}
+	return urlList(nil, r.ServerUrl())
+}
+
+func assetEndpointUrls(r Request) []string {
+	if failover, ok := r.(FailoverRequest); ok {
+		return failover.AssetEndpointUrls()
+	}
+	return urlList(nil, r.AssetEndpointUrl())
+}
+
 type request struct {
 	data                      *Data
 	assetEndpointUrl          string
+	assetEndpointUrls         []string
 	assetEndpointDisplayAreas []DisplayArea
 	logEnabled                bool
 	logLevel                  int64
 	url                       string
+	urls                      []string
 }
 
 func NewRequest(url string, assetEndpointUrl string, data *Data,
@@ -62,6 +240,31 @@ func NewRequest(url string, assetEndpointUrl string, data *Data,
 	}
 }
 
+// NewRequestWithFailover creates a request that is sent to the first
+// healthy url of each list, in order. It returns ErrNoEndpoints if urls is
+// empty, use NewRequest with an empty url for a request that is sent to the
+// client's ServerUrls instead.
+func NewRequestWithFailover(urls []string, assetEndpointUrls []string,
+	data *Data, logEnabled bool, logLevel int64) (*request, error) {
+	if len(urls) == 0 {
+		return nil, ErrNoEndpoints
+	}
+
+	r := &request{
+		urls:              urls,
+		assetEndpointUrls: assetEndpointUrls,
+		data:              data,
+		logEnabled:        logEnabled,
+		logLevel:          logLevel,
+	}
+
+	r.url = urls[0]
+	if len(assetEndpointUrls) > 0 {
+		r.assetEndpointUrl = assetEndpointUrls[0]
+	}
+	return r, nil
+}
+
 func (r request) Data() *Data {
 	return r.data
 }
@@ -78,10 +281,30 @@ func (r request) ServerUrl() string {
 	return r.url
 }
 
+func (r request) ServerUrls() []string {
+	return urlList(r.urls, r.url)
+}
+
 func (r request) AssetEndpointUrl() string {
 	return r.assetEndpointUrl
 }
 
+func (r request) AssetEndpointUrls() []string {
+	return urlList(r.assetEndpointUrls, r.assetEndpointUrl)
+}
+
+// urlList returns urls, or url on its own, or nil if neither is set.
+func urlList(urls []string, url string) []string {
+	if len(urls) > 0 {
+		return urls
+	}
+
+	if url == "" {
+		return nil
+	}
+	return []string{url}
+}
+
 func (r request) AssetEndpointDisplayAreas() []DisplayArea {
 	return r.assetEndpointDisplayAreas
 }
@@ -39,3 +39,80 @@ func TestSetAssetEndpointUrl(t *testing.T) {
 
 	assert.Equal(t, request.AssetEndpointUrl(), "asset-url.com")
 }
+
+func TestNewRequestWithFailover(t *testing.T) {
+	request, err := NewRequestWithFailover(
+		[]string{"primary.com", "fallback.com"},
+		[]string{"asset-primary.com", "asset-fallback.com"},
+		nil, true, int64(0))
+	assert.Nil(t, err)
+
+	assert.Equal(t, request.ServerUrl(), "primary.com")
+	assert.Equal(t, request.ServerUrls(),
+		[]string{"primary.com", "fallback.com"})
+	assert.Equal(t, request.AssetEndpointUrl(), "asset-primary.com")
+	assert.Equal(t, request.AssetEndpointUrls(),
+		[]string{"asset-primary.com", "asset-fallback.com"})
+
+	_, err = NewRequestWithFailover(nil, []string{"asset-primary.com"}, nil,
+		true, int64(0))
+	assert.Equal(t, err, ErrNoEndpoints)
+}
+
+func TestServerUrlsWithSingleUrl(t *testing.T) {
+	request := NewRequest("ad-server-url.com", "asset-url.com", nil, true,
+		int64(0))
+
+	assert.Equal(t, request.ServerUrls(), []string{"ad-server-url.com"})
+	assert.Equal(t, request.AssetEndpointUrls(), []string{"asset-url.com"})
+
+	request = NewRequest("", "", nil, true, int64(0))
+	assert.Nil(t, request.ServerUrls())
+	assert.Nil(t, request.AssetEndpointUrls())
+}
+
+func TestDataValidate(t *testing.T) {
+	assert.Nil(t, newTestData().Validate())
+
+	data := &Data{
+		ApiKey:             "key",
+		RequiredCompletion: 1.5,
+		Latitude:           91,
+		Longitude:          -74,
+		DisplayAreas: []DisplayArea{
+			{Id: "a", Width: -1, Height: 1080,
+				SupportedMedia: []string{"image/jpeg", "image/bmp"}},
+			{Id: "a", MinDuration: 30, MaxDuration: 15},
+		},
+	}
+
+	err := data.Validate()
+	errs, ok := err.(ValidationErrors)
+	assert.True(t, ok)
+
+	fields := make([]string, 0, len(errs))
+	for _, fieldErr := range errs {
+		fields = append(fields, fieldErr.Field)
+	}
+	assert.Equal(t, fields, []string{
+		"network_id",
+		"device_id",
+		"required_completion",
+		"latitude",
+		"display_area[0].width",
+		"display_area[0].supported_media",
+		"display_area[1].id",
+		"display_area[1].min_duration",
+		"display_area[1].supported_media",
+	})
+	assert.Equal(t, errs[5].Message, "unknown media type image/bmp")
+	assert.Equal(t, errs[6].Message, "duplicate id a")
+}
+
+func TestDataValidateRequiresDisplayAreas(t *testing.T) {
+	data := newTestData()
+	data.DisplayAreas = nil
+
+	err := data.Validate()
+	assert.Equal(t, err.Error(), "display_area: is required")
+}
@@ -0,0 +1,98 @@
+package vistar
+
+// DataBuilder builds the Data of a request and validates it, for example:
+//
+//	data, err := NewDataBuilder("api-key", "network", "device").
+//		DisplayArea("main", 1920, 1080, "image/jpeg", "video/mp4").
+//		Location(40.7, -74.0).
+//		Build()
+type DataBuilder struct {
+	data Data
+}
+
+func NewDataBuilder(apiKey string, networkId string,
+	deviceId string) *DataBuilder {
+	return &DataBuilder{data: Data{
+		ApiKey:    apiKey,
+		NetworkId: networkId,
+		DeviceId:  deviceId,
+	}}
+}
+
+func (b *DataBuilder) VenueId(venueId string) *DataBuilder {
+	b.data.VenueId = venueId
+	return b
+}
+
+func (b *DataBuilder) RequiredCompletion(completion float64) *DataBuilder {
+	b.data.RequiredCompletion = completion
+	return b
+}
+
+func (b *DataBuilder) DirectConnection(direct bool) *DataBuilder {
+	b.data.DirectConnection = direct
+	return b
+}
+
+func (b *DataBuilder) Location(latitude float64,
+	longitude float64) *DataBuilder {
+	b.data.Latitude = latitude
+	b.data.Longitude = longitude
+	return b
+}
+
+func (b *DataBuilder) DisplayTime(displayTime int64) *DataBuilder {
+	b.data.DisplayTime = displayTime
+	return b
+}
+
+func (b *DataBuilder) NumberOfScreens(screens int64) *DataBuilder {
+	b.data.NumberOfScreens = screens
+	return b
+}
+
+// Schedule sets the duration and interval of a request for a schedule of
+// ads.
+func (b *DataBuilder) Schedule(duration int64, interval int64) *DataBuilder {
+	b.data.Duration = duration
+	b.data.Interval = interval
+	return b
+}
+
+// DisplayArea adds a display area, use AddDisplayArea to set its other
+// fields.
+func (b *DataBuilder) DisplayArea(id string, width int64, height int64,
+	supportedMedia ...string) *DataBuilder {
+	return b.AddDisplayArea(DisplayArea{
+		Id:             id,
+		Width:          width,
+		Height:         height,
+		SupportedMedia: supportedMedia,
+	})
+}
+
+func (b *DataBuilder) AddDisplayArea(area DisplayArea) *DataBuilder {
+	b.data.DisplayAreas = append(b.data.DisplayAreas, area)
+	return b
+}
+
+func (b *DataBuilder) DeviceAttribute(name string,
+	value string) *DataBuilder {
+	b.data.DeviceAttributes = append(b.data.DeviceAttributes,
+		DeviceAttribute{Name: name, Value: value})
+	return b
+}
+
+// Build returns the data, or the ValidationErrors of all the fields that
+// are missing or out of range.
+func (b *DataBuilder) Build() (*Data, error) {
+	data := b.data
+	data.DisplayAreas = append([]DisplayArea(nil), b.data.DisplayAreas...)
+	data.DeviceAttributes = append([]DeviceAttribute(nil),
+		b.data.DeviceAttributes...)
+
+	if err := data.Validate(); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
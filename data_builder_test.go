@@ -0,0 +1,71 @@
+package vistar
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDataBuilder(t *testing.T) {
+	builder := NewDataBuilder("key", "network", "device").
+		VenueId("venue").
+		RequiredCompletion(0.9).
+		Location(40.7, -74).
+		DisplayArea("main", 1920, 1080, "image/jpeg", "video/mp4").
+		DeviceAttribute("os", "linux")
+
+	data, err := builder.Build()
+	assert.Nil(t, err)
+	assert.Equal(t, data, &Data{
+		ApiKey:             "key",
+		NetworkId:          "network",
+		DeviceId:           "device",
+		VenueId:            "venue",
+		RequiredCompletion: 0.9,
+		Latitude:           40.7,
+		Longitude:          -74,
+		DisplayAreas: []DisplayArea{{
+			Id:             "main",
+			Width:          1920,
+			Height:         1080,
+			SupportedMedia: []string{"image/jpeg", "video/mp4"},
+		}},
+		DeviceAttributes: []DeviceAttribute{{Name: "os", Value: "linux"}},
+	})
+
+	// The data built before isn't changed by the builder.
+	builder.AddDisplayArea(DisplayArea{Id: "side"})
+	assert.Len(t, data.DisplayAreas, 1)
+
+	_, err = builder.Build()
+	assert.Equal(t, err.Error(), "display_area[1].supported_media: is required")
+}
+
+func TestDataBuilderReportsAllErrors(t *testing.T) {
+	_, err := NewDataBuilder("", "", "").Schedule(-1, 60).Build()
+	errs, ok := err.(ValidationErrors)
+	assert.True(t, ok)
+	assert.Len(t, errs, 5)
+}
+
+func TestGetAdRejectsInvalidData(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+		}))
+	defer ts.Close()
+
+	client := NewClient(&ClientConfig{})
+	defer client.Close()
+
+	data := newTestData()
+	data.DeviceId = ""
+	_, err := client.GetAd(NewRequest(ts.URL, "", data, false, 0))
+	_, ok := err.(ValidationErrors)
+	assert.True(t, ok)
+	assert.Equal(t, requests, 0)
+	assert.Len(t, client.endpoints.unhealthyUrls(), 0)
+}
@@ -0,0 +1,280 @@
+package vistar
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const diskCacheTempPrefix = ".tmp-"
+
+// DefaultDiskCacheTimeout is the timeout of the http client used when
+// NewDiskCache is not given one, so that a stalled download does not block
+// the callers waiting on it forever.
+var DefaultDiskCacheTimeout = 10 * time.Minute
+
+// diskCacheFileName matches the names of the files the cache writes, the
+// sha256 of the asset url followed by its extension.
+var diskCacheFileName = regexp.MustCompile(`^[0-9a-f]{64}(\.[^.]*)?$`)
+
+// DiskCache downloads assets to a local directory. Its Cache and
+// CacheContext methods can be used as ClientConfig.CacheFn and
+// ClientConfig.CacheContextFn.
+type DiskCache struct {
+	dir        string
+	maxSize    int64
+	httpClient *http.Client
+	now        func() time.Time
+	lock       sync.Mutex
+	entries    map[string]*list.Element
+	lru        *list.List
+	size       int64
+	inFlight   map[string]*diskCacheCall
+	inUse      func(path string) bool
+}
+
+type diskCacheEntry struct {
+	key       string
+	path      string
+	size      int64
+	fetchedAt time.Time
+}
+
+type diskCacheCall struct {
+	done chan struct{}
+	path string
+	err  error
+}
+
+// NewDiskCache creates a cache in dir that holds at most maxSize bytes,
+// evicting the least recently used assets first. A maxSize of 0 means no
+// limit. Files left in dir by a previous run are reused and its unfinished
+// downloads are removed, other files are left alone. A nil httpClient uses one with DefaultDiskCacheTimeout.
+func NewDiskCache(dir string, maxSize int64, httpClient *http.Client) (
+	*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: DefaultDiskCacheTimeout}
+	}
+
+	d := &DiskCache{
+		dir:        dir,
+		maxSize:    maxSize,
+		httpClient: httpClient,
+		now:        time.Now,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		inFlight:   make(map[string]*diskCacheCall),
+	}
+
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *DiskCache) Cache(assetUrl string, ttl time.Duration) (string, error) {
+	return d.CacheContext(context.Background(), assetUrl, ttl)
+}
+
+// CacheContext returns the local path of assetUrl, downloading it if it is
+// not cached or older than ttl. A ttl of 0 never expires. Concurrent calls
+// for the same url share a single download.
+func (d *DiskCache) CacheContext(ctx context.Context, assetUrl string,
+	ttl time.Duration) (string, error) {
+	key := diskCacheKey(assetUrl)
+
+	d.lock.Lock()
+	if elem, ok := d.entries[key]; ok {
+		entry := elem.Value.(*diskCacheEntry)
+		if ttl <= 0 || d.now().Sub(entry.fetchedAt) < ttl {
+			d.lru.MoveToFront(elem)
+			d.lock.Unlock()
+			return entry.path, nil
+		}
+	}
+
+	call, ok := d.inFlight[key]
+	if !ok {
+		call = &diskCacheCall{done: make(chan struct{})}
+		d.inFlight[key] = call
+		go d.fetch(key, assetUrl, call)
+	}
+	d.lock.Unlock()
+
+	select {
+	case <-call.done:
+		return call.path, call.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// SetInUse sets the function that tells the cache an asset is still needed,
+// such as client.AssetInUse. Assets in use are skipped by the eviction even
+// if the cache grows over maxSize. inUse is called with the cache locked, so
+// it must not call back into the cache.
+func (d *DiskCache) SetInUse(inUse func(path string) bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.inUse = inUse
+}
+
+func (d *DiskCache) Size() int64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.size
+}
+
+// fetch downloads the asset without a caller's context so that a cancelled
+// caller does not fail the download for others waiting on it.
+func (d *DiskCache) fetch(key string, assetUrl string, call *diskCacheCall) {
+	localPath := filepath.Join(d.dir, key+diskCacheExt(assetUrl))
+	size, err := d.download(assetUrl, localPath)
+
+	d.lock.Lock()
+	if err == nil {
+		d.addLocked(&diskCacheEntry{
+			key:       key,
+			path:      localPath,
+			size:      size,
+			fetchedAt: d.now(),
+		})
+	}
+	delete(d.inFlight, key)
+	d.lock.Unlock()
+
+	if err == nil {
+		call.path = localPath
+	}
+	call.err = err
+	close(call.done)
+}
+
+func (d *DiskCache) download(assetUrl string, localPath string) (int64,
+	error) {
+	resp, err := d.httpClient.Get(assetUrl)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK ||
+		resp.StatusCode >= http.StatusMultipleChoices {
+		return 0, fmt.Errorf("Asset download failed. url: %s, code: %d",
+			assetUrl, resp.StatusCode)
+	}
+
+	tmp, err := ioutil.TempFile(d.dir, diskCacheTempPrefix)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	size, err := io.Copy(tmp, resp.Body)
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return size, os.Rename(tmp.Name(), localPath)
+}
+
+func (d *DiskCache) addLocked(entry *diskCacheEntry) {
+	if elem, ok := d.entries[entry.key]; ok {
+		d.size -= elem.Value.(*diskCacheEntry).size
+		d.lru.Remove(elem)
+	}
+
+	d.entries[entry.key] = d.lru.PushFront(entry)
+	d.size += entry.size
+
+	// The entry just added is never evicted, nor are the ones in use.
+	elem := d.lru.Back()
+	for d.maxSize > 0 && d.size > d.maxSize && elem != nil {
+		prev := elem.Prev()
+		evicted := elem.Value.(*diskCacheEntry)
+		if evicted != entry && (d.inUse == nil || !d.inUse(evicted.path)) {
+			d.lru.Remove(elem)
+			delete(d.entries, evicted.key)
+			d.size -= evicted.size
+			os.Remove(evicted.path)
+		}
+		elem = prev
+	}
+}
+
+func (d *DiskCache) load() error {
+	files, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+
+	// Oldest files are added first so they are the first to be evicted.
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+
+		name := f.Name()
+		if strings.HasPrefix(name, diskCacheTempPrefix) {
+			os.Remove(filepath.Join(d.dir, name))
+			continue
+		}
+
+		if !diskCacheFileName.MatchString(name) {
+			continue
+		}
+
+		d.addLocked(&diskCacheEntry{
+			key:       strings.TrimSuffix(name, filepath.Ext(name)),
+			path:      filepath.Join(d.dir, name),
+			size:      f.Size(),
+			fetchedAt: f.ModTime(),
+		})
+	}
+	return nil
+}
+
+func diskCacheKey(assetUrl string) string {
+	sum := sha256.Sum256([]byte(assetUrl))
+	return hex.EncodeToString(sum[:])
+}
+
+func diskCacheExt(assetUrl string) string {
+	u, err := url.Parse(assetUrl)
+	if err != nil {
+		return ""
+	}
+	return path.Ext(u.Path)
+}
@@ -0,0 +1,257 @@
+package vistar
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAssetServer(requests map[string]int,
+	lock *sync.Mutex) *httptest.Server {
+	return httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			requests[r.URL.Path]++
+			lock.Unlock()
+
+			if r.URL.Path == "/missing.mp4" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(strings.Repeat("a", 10)))
+		}),
+	)
+}
+
+func TestDiskCacheDownloadsAsset(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disk-cache")
+	defer os.RemoveAll(dir)
+
+	var lock sync.Mutex
+	requests := make(map[string]int)
+	ts := newTestAssetServer(requests, &lock)
+	defer ts.Close()
+
+	cache, err := NewDiskCache(dir, 0, ts.Client())
+	assert.Nil(t, err)
+
+	local, err := cache.Cache(ts.URL+"/video.mp4?v=1", time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Dir(local), dir)
+	assert.Equal(t, filepath.Ext(local), ".mp4")
+
+	data, _ := ioutil.ReadFile(local)
+	assert.Equal(t, string(data), strings.Repeat("a", 10))
+
+	again, err := cache.Cache(ts.URL+"/video.mp4?v=1", time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, again, local)
+	assert.Equal(t, requests["/video.mp4"], 1)
+	assert.Equal(t, cache.Size(), int64(10))
+}
+
+func TestDiskCacheHonoursTTL(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disk-cache")
+	defer os.RemoveAll(dir)
+
+	var lock sync.Mutex
+	requests := make(map[string]int)
+	ts := newTestAssetServer(requests, &lock)
+	defer ts.Close()
+
+	cache, _ := NewDiskCache(dir, 0, ts.Client())
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	cache.Cache(ts.URL+"/video.mp4", time.Minute)
+	now = now.Add(2 * time.Minute)
+	cache.Cache(ts.URL+"/video.mp4", time.Minute)
+
+	assert.Equal(t, requests["/video.mp4"], 2)
+	assert.Equal(t, cache.Size(), int64(10))
+}
+
+func TestDiskCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disk-cache")
+	defer os.RemoveAll(dir)
+
+	var lock sync.Mutex
+	requests := make(map[string]int)
+	ts := newTestAssetServer(requests, &lock)
+	defer ts.Close()
+
+	cache, _ := NewDiskCache(dir, 25, ts.Client())
+
+	first, _ := cache.Cache(ts.URL+"/1.mp4", 0)
+	second, _ := cache.Cache(ts.URL+"/2.mp4", 0)
+	cache.Cache(ts.URL+"/1.mp4", 0)
+	cache.Cache(ts.URL+"/3.mp4", 0)
+
+	assert.Equal(t, cache.Size(), int64(20))
+	_, err := os.Stat(first)
+	assert.Nil(t, err)
+	_, err = os.Stat(second)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDiskCacheSkipsAssetsInUse(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disk-cache")
+	defer os.RemoveAll(dir)
+
+	var lock sync.Mutex
+	requests := make(map[string]int)
+	ts := newTestAssetServer(requests, &lock)
+	defer ts.Close()
+
+	client := NewClient(&ClientConfig{ReqTimeout: time.Second})
+	defer client.Close()
+
+	cache, _ := NewDiskCache(dir, 25, ts.Client())
+	cache.SetInUse(client.AssetInUse)
+
+	first, _ := cache.Cache(ts.URL+"/1.mp4", 0)
+	second, _ := cache.Cache(ts.URL+"/2.mp4", 0)
+	client.addToInProgressList(Ad{"id": "1", "asset_url": first})
+	cache.Cache(ts.URL+"/3.mp4", 0)
+
+	assert.Equal(t, cache.Size(), int64(20))
+	_, err := os.Stat(first)
+	assert.Nil(t, err)
+	_, err = os.Stat(second)
+	assert.True(t, os.IsNotExist(err))
+
+	// Over the limit rather than deleting an asset that is in use.
+	local, _ := cache.Cache(ts.URL+"/3.mp4", 0)
+	client.addToInProgressList(Ad{"id": "3", "asset_url": local})
+	cache.Cache(ts.URL+"/4.mp4", 0)
+
+	assert.Equal(t, cache.Size(), int64(30))
+	_, err = os.Stat(first)
+	assert.Nil(t, err)
+}
+
+func TestDiskCacheDedupesConcurrentDownloads(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disk-cache")
+	defer os.RemoveAll(dir)
+
+	release := make(chan struct{})
+	var lock sync.Mutex
+	requests := 0
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			requests++
+			lock.Unlock()
+			<-release
+			w.Write([]byte("data"))
+		}),
+	)
+	defer ts.Close()
+
+	cache, _ := NewDiskCache(dir, 0, ts.Client())
+
+	var wg sync.WaitGroup
+	paths := make([]string, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			paths[i], _ = cache.Cache(ts.URL+"/video.mp4", time.Minute)
+		}(i)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, requests, 1)
+	for _, p := range paths {
+		assert.Equal(t, p, paths[0])
+	}
+}
+
+func TestDiskCacheDownloadFailure(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disk-cache")
+	defer os.RemoveAll(dir)
+
+	var lock sync.Mutex
+	requests := make(map[string]int)
+	ts := newTestAssetServer(requests, &lock)
+	defer ts.Close()
+
+	cache, _ := NewDiskCache(dir, 0, ts.Client())
+
+	local, err := cache.Cache(ts.URL+"/missing.mp4", time.Minute)
+
+	assert.Equal(t, local, "")
+	assert.NotNil(t, err)
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 0)
+}
+
+func TestDiskCacheContextCancelled(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disk-cache")
+	defer os.RemoveAll(dir)
+
+	release := make(chan struct{})
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}),
+	)
+	defer ts.Close()
+	defer close(release)
+
+	cache, _ := NewDiskCache(dir, 0, ts.Client())
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		10*time.Millisecond)
+	defer cancel()
+
+	_, err := cache.CacheContext(ctx, ts.URL+"/video.mp4", time.Minute)
+	assert.Equal(t, err, context.DeadlineExceeded)
+}
+
+func TestDiskCacheReloadsExistingFiles(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disk-cache")
+	defer os.RemoveAll(dir)
+
+	var lock sync.Mutex
+	requests := make(map[string]int)
+	ts := newTestAssetServer(requests, &lock)
+	defer ts.Close()
+
+	cache, _ := NewDiskCache(dir, 0, ts.Client())
+	local, _ := cache.Cache(ts.URL+"/video.mp4", time.Minute)
+	ioutil.WriteFile(filepath.Join(dir, diskCacheTempPrefix+"x"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("notes"), 0644)
+
+	cache, _ = NewDiskCache(dir, 0, ts.Client())
+	again, err := cache.Cache(ts.URL+"/video.mp4", time.Minute)
+
+	assert.Nil(t, err)
+	assert.Equal(t, again, local)
+	assert.Equal(t, requests["/video.mp4"], 1)
+	// Files the cache did not write are neither adopted nor removed.
+	assert.Equal(t, cache.Size(), int64(10))
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 2)
+}
+
+func TestDiskCacheDefaultClientHasTimeout(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "disk-cache")
+	defer os.RemoveAll(dir)
+
+	cache, err := NewDiskCache(dir, 0, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, cache.httpClient.Timeout, DefaultDiskCacheTimeout)
+}
@@ -0,0 +1,215 @@
+package vistar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var DefaultHealthCheckInterval = 30 * time.Second
+
+var ErrNoEndpoints = errors.New("request has no endpoint urls")
+
+type ServerError struct {
+	Url        string
+	StatusCode int
+	Body       string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("Ad server returned an error. url: %s, code: %d, "+
+		"body: %s", e.Url, e.StatusCode, e.Body)
+}
+
+// endpointHealth tracks the ad server endpoints that failed, until a health
+// check finds them reachable again.
+type endpointHealth struct {
+	lock      sync.Mutex
+	unhealthy map[string]time.Time
+}
+
+func newEndpointHealth() *endpointHealth {
+	return &endpointHealth{unhealthy: make(map[string]time.Time)}
+}
+
+// order returns the healthy urls first, keeping their relative order, so
+// that the primary is used again as soon as it is healthy. Unhealthy urls
+// are kept at the end as a last resort.
+func (h *endpointHealth) order(urls []string) []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	healthy := make([]string, 0, len(urls))
+	unhealthy := make([]string, 0)
+	for _, url := range urls {
+		if _, ok := h.unhealthy[url]; ok {
+			unhealthy = append(unhealthy, url)
+		} else {
+			healthy = append(healthy, url)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (h *endpointHealth) markUnhealthy(url string) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if _, ok := h.unhealthy[url]; ok {
+		return false
+	}
+	h.unhealthy[url] = time.Now()
+	return true
+}
+
+func (h *endpointHealth) markHealthy(url string) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if _, ok := h.unhealthy[url]; !ok {
+		return false
+	}
+	delete(h.unhealthy, url)
+	return true
+}
+
+func (h *endpointHealth) unhealthyUrls() []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	urls := make([]string, 0, len(h.unhealthy))
+	for url := range h.unhealthy {
+		urls = append(urls, url)
+	}
+	return urls
+}
+
+// isFailoverError reports whether a request that failed with err should be
+// tried against the next endpoint.
+func isFailoverError(err error) bool {
+	if err == MissingRequestData {
+		return false
+	}
+
+	var serverErr *ServerError
+	if errors.As(err, &serverErr) {
+		return serverErr.StatusCode >= http.StatusInternalServerError
+	}
+	return true
+}
+
+// serverUrlsOf returns the ad server urls of the request, or the client's
+// if it has none.
+func (c *client) serverUrlsOf(request Request) []string {
+	if urls := serverUrls(request); len(urls) > 0 {
+		return urls
+	}
+	return c.serverUrls
+}
+
+func (c *client) assetEndpointUrlsOf(request Request) []string {
+	if urls := assetEndpointUrls(request); len(urls) > 0 {
+		return urls
+	}
+	return c.assetUrls
+}
+
+func (c *client) postWithFailover(ctx context.Context, urls []string,
+	request Request) ([]byte, error) {
+	if len(urls) == 0 {
+		return nil, ErrNoEndpoints
+	}
+
+	if c.endpoints == nil || len(urls) < 2 {
+		return c.post(ctx, urls[0], request)
+	}
+
+	var err error
+	ordered := c.endpoints.order(urls)
+	for i, url := range ordered {
+		var body []byte
+		body, err = c.post(ctx, url, request)
+		if err == nil {
+			c.markEndpointHealthy(url)
+			return body, nil
+		}
+
+		if ctx.Err() != nil || !isFailoverError(err) {
+			return nil, err
+		}
+
+		c.markEndpointUnhealthy(url, err)
+		if i < len(ordered)-1 {
+			c.publishEvent(Event{
+				Name:  EventAdServerFailover,
+				Level: EventLevelWarning,
+				Message: fmt.Sprintf("from: %s, to: %s, error: %s", url,
+					ordered[i+1], err.Error()),
+				Url:    url,
+				Err:    err,
+				Fields: map[string]interface{}{"to": ordered[i+1]},
+			})
+		}
+	}
+	return nil, err
+}
+
+func (c *client) markEndpointUnhealthy(url string, err error) {
+	if c.endpoints.markUnhealthy(url) {
+		c.publishEvent(Event{
+			Name:    EventAdServerEndpointUnhealthy,
+			Level:   EventLevelWarning,
+			Message: fmt.Sprintf("url: %s, error: %s", url, err.Error()),
+			Url:     url,
+			Err:     err,
+		})
+	}
+}
+
+func (c *client) markEndpointHealthy(url string) {
+	if c.endpoints.markHealthy(url) {
+		c.publishEvent(Event{
+			Name:    EventAdServerEndpointHealthy,
+			Level:   EventLevelInfo,
+			Message: fmt.Sprintf("url: %s", url),
+			Url:     url,
+		})
+	}
+}
+
+func (c *client) processHealthChecks(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.checkUnhealthyEndpoints()
+		case <-c.closeCh:
+			return
+		}
+	}
+}
+
+func (c *client) checkUnhealthyEndpoints() {
+	for _, url := range c.endpoints.unhealthyUrls() {
+		if c.probeEndpoint(url) {
+			c.markEndpointHealthy(url)
+		}
+	}
+}
+
+// probeEndpoint considers an endpoint healthy if it answers without a server
+// error. Ad endpoints only accept POST, so a 405 still counts as healthy.
+func (c *client) probeEndpoint(url string) bool {
+	resp, err := c.httpClient.Get(url)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode < http.StatusInternalServerError
+}
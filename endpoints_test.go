@@ -0,0 +1,230 @@
+package vistar
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEndpointHealthOrder(t *testing.T) {
+	health := newEndpointHealth()
+	urls := []string{"primary", "secondary", "tertiary"}
+
+	assert.Equal(t, health.order(urls), urls)
+
+	assert.True(t, health.markUnhealthy("primary"))
+	assert.False(t, health.markUnhealthy("primary"))
+	assert.Equal(t, health.order(urls),
+		[]string{"secondary", "tertiary", "primary"})
+	assert.Equal(t, health.unhealthyUrls(), []string{"primary"})
+
+	assert.True(t, health.markHealthy("primary"))
+	assert.False(t, health.markHealthy("primary"))
+	assert.Equal(t, health.order(urls), urls)
+}
+
+func TestIsFailoverError(t *testing.T) {
+	assert.True(t, isFailoverError(errors.New("connection refused")))
+	assert.True(t, isFailoverError(ErrCircuitOpen))
+	assert.True(t, isFailoverError(&ServerError{StatusCode: 503}))
+	assert.False(t, isFailoverError(&ServerError{StatusCode: 400}))
+	assert.False(t, isFailoverError(MissingRequestData))
+}
+
+type testEndpoint struct {
+	lock   sync.Mutex
+	status int
+	calls  int
+	server *httptest.Server
+}
+
+func newTestEndpoint(status int, body string) *testEndpoint {
+	e := &testEndpoint{status: status}
+	e.server = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			e.lock.Lock()
+			defer e.lock.Unlock()
+			if r.Method == http.MethodPost {
+				e.calls++
+			}
+			w.WriteHeader(e.status)
+			w.Write([]byte(body))
+		}),
+	)
+	return e
+}
+
+func (e *testEndpoint) setStatus(status int) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.status = status
+}
+
+func TestGetAdFailsOverAndReturnsToPrimary(t *testing.T) {
+	primary := newTestEndpoint(http.StatusServiceUnavailable,
+		`{"advertisement": [{"id": "1"}]}`)
+	defer primary.server.Close()
+	fallback := newTestEndpoint(http.StatusOK,
+		`{"advertisement": [{"id": "2"}]}`)
+	defer fallback.server.Close()
+
+	events := make([]string, 0)
+	client := &client{
+		pop:            NewTestProofOfPlay(),
+		httpClient:     &http.Client{},
+		inProgress:     NewMemoryInProgressStore(),
+		bandwidthStats: make(map[string]Stats),
+		endpoints:      newEndpointHealth(),
+		events: NewEventFuncHandler(func(name string, message string,
+			source string, level string) {
+			events = append(events, name)
+		}),
+	}
+
+	request, _ := NewRequestWithFailover(
+		[]string{primary.server.URL, fallback.server.URL}, nil, newTestData(),
+		false, 0)
+
+	resp, err := client.GetAd(request)
+	assert.Nil(t, err)
+	assert.Equal(t, resp.Advertisement[0]["id"], "2")
+	assert.Equal(t, events, []string{"ad-server-endpoint-failed",
+		"ad-server-endpoint-unhealthy", "ad-server-failover"})
+
+	// The fallback is used while the primary is unhealthy.
+	resp, err = client.GetAd(request)
+	assert.Nil(t, err)
+	assert.Equal(t, resp.Advertisement[0]["id"], "2")
+	assert.Equal(t, primary.calls, 1)
+
+	client.checkUnhealthyEndpoints()
+	assert.Equal(t, client.endpoints.unhealthyUrls(),
+		[]string{primary.server.URL})
+
+	primary.setStatus(http.StatusOK)
+	client.checkUnhealthyEndpoints()
+	assert.Len(t, client.endpoints.unhealthyUrls(), 0)
+	assert.Equal(t, events[len(events)-1], "ad-server-endpoint-healthy")
+
+	resp, err = client.GetAd(request)
+	assert.Nil(t, err)
+	assert.Equal(t, resp.Advertisement[0]["id"], "1")
+	assert.Equal(t, primary.calls, 2)
+	assert.Equal(t, fallback.calls, 2)
+}
+
+func TestGetAdDoesNotFailOverOnClientError(t *testing.T) {
+	primary := newTestEndpoint(http.StatusBadRequest, "")
+	defer primary.server.Close()
+	fallback := newTestEndpoint(http.StatusOK, `{"advertisement": []}`)
+	defer fallback.server.Close()
+
+	client := &client{
+		pop:            NewTestProofOfPlay(),
+		httpClient:     &http.Client{},
+		bandwidthStats: make(map[string]Stats),
+		endpoints:      newEndpointHealth(),
+	}
+
+	request, _ := NewRequestWithFailover(
+		[]string{primary.server.URL, fallback.server.URL}, nil, newTestData(),
+		false, 0)
+
+	_, err := client.GetAd(request)
+
+	assert.Equal(t, err, &ServerError{
+		Url:        primary.server.URL,
+		StatusCode: http.StatusBadRequest,
+	})
+	assert.Equal(t, fallback.calls, 0)
+}
+
+func TestGetAssetsFailsOver(t *testing.T) {
+	fallback := newTestEndpoint(http.StatusOK,
+		`{"asset": [{"asset_url": "url1"}]}`)
+	defer fallback.server.Close()
+
+	client := &client{
+		pop:            NewTestProofOfPlay(),
+		httpClient:     &http.Client{},
+		bandwidthStats: make(map[string]Stats),
+		endpoints:      newEndpointHealth(),
+	}
+
+	request, _ := NewRequestWithFailover([]string{"ad-server-url"},
+		[]string{"invalid-url", fallback.server.URL}, newTestData(), false, 0)
+
+	resp, err := client.GetAssets(request)
+
+	assert.Nil(t, err)
+	assert.Equal(t, resp.Assets[0]["asset_url"], "url1")
+	assert.Equal(t, client.endpoints.unhealthyUrls(), []string{"invalid-url"})
+}
+
+// singleUrlRequest implements Request but not FailoverRequest, like
+// implementations written before failover was added.
+type singleUrlRequest struct {
+	url  string
+	data *Data
+}
+
+func (r singleUrlRequest) Data() *Data                              { return r.data }
+func (r singleUrlRequest) ServerUrl() string                        { return r.url }
+func (r singleUrlRequest) AssetEndpointUrl() string                 { return r.url }
+func (r singleUrlRequest) AssetEndpointDisplayAreas() []DisplayArea { return nil }
+func (r singleUrlRequest) LogLevel() int64                          { return 0 }
+func (r singleUrlRequest) LogEnabled() bool                         { return false }
+
+func TestGetAdWithoutFailoverRequest(t *testing.T) {
+	endpoint := newTestEndpoint(http.StatusOK, `{"advertisement": []}`)
+	defer endpoint.server.Close()
+
+	client := NewClient(&ClientConfig{})
+	defer client.Close()
+
+	_, err := client.GetAd(singleUrlRequest{
+		url:  endpoint.server.URL,
+		data: newTestData(),
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, endpoint.calls, 1)
+}
+
+func TestGetAdWithoutUrls(t *testing.T) {
+	client := NewClient(&ClientConfig{})
+	defer client.Close()
+
+	_, err := client.GetAd(NewRequest("", "", newTestData(), false, 0))
+	assert.Equal(t, err, ErrNoEndpoints)
+}
+
+func TestGetAdFailsOverClientUrls(t *testing.T) {
+	fallback := newTestEndpoint(http.StatusOK,
+		`{"advertisement": [{"id": "1", "asset_url": "url1"}]}`)
+	defer fallback.server.Close()
+
+	client := NewClient(&ClientConfig{
+		ServerUrls: []string{"invalid-url", fallback.server.URL},
+	})
+	defer client.Close()
+
+	resp, err := client.GetAd(NewRequest("", "", newTestData(), false, 0))
+
+	assert.Nil(t, err)
+	assert.Equal(t, resp.Advertisement[0]["id"], "1")
+	assert.Equal(t, fallback.calls, 1)
+
+	// The urls of a request take precedence over the client's.
+	other := newTestEndpoint(http.StatusOK, `{"advertisement": []}`)
+	defer other.server.Close()
+	_, err = client.GetAd(NewRequest(other.server.URL, "", newTestData(),
+		false, 0))
+	assert.Nil(t, err)
+	assert.Equal(t, other.calls, 1)
+	assert.Equal(t, fallback.calls, 1)
+}
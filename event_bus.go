@@ -0,0 +1,229 @@
+package vistar
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+var DefaultEventBusBufferSize = 1024
+
+// DropPolicy decides which event is dropped when a subscriber's buffer is
+// full.
+type DropPolicy int
+
+const (
+	// DropNewest drops the event being published.
+	DropNewest DropPolicy = iota
+	// DropOldest drops the oldest buffered event to make room.
+	DropOldest
+)
+
+type EventBusConfig struct {
+	// BufferSize is the number of events buffered per subscriber. Defaults
+	// to DefaultEventBusBufferSize.
+	BufferSize int
+	DropPolicy DropPolicy
+}
+
+// EventFilter selects the events delivered to a subscriber. An empty Names
+// matches every event.
+type EventFilter struct {
+	Names    []string
+	MinLevel EventLevel
+}
+
+func (f *EventFilter) match(event Event) bool {
+	if f == nil {
+		return true
+	}
+
+	if event.Level < f.MinLevel {
+		return false
+	}
+
+	if len(f.Names) == 0 {
+		return true
+	}
+
+	for _, name := range f.Names {
+		if name == event.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// EventBus is an EventHandler that delivers events to its subscribers
+// asynchronously. Each subscriber has its own buffer and goroutine, so a slow
+// subscriber only delays its own events and never the publisher. Events that
+// don't fit in a subscriber's buffer are dropped and counted.
+type EventBus struct {
+	// dropped is first so that it is 64-bit aligned for the atomic
+	// operations on 32-bit platforms.
+	dropped       int64
+	bufferSize    int
+	dropPolicy    DropPolicy
+	lock          sync.RWMutex
+	subscriptions map[*Subscription]struct{}
+	closed        bool
+}
+
+type Subscription struct {
+	// dropped is first so that it is 64-bit aligned for the atomic
+	// operations on 32-bit platforms.
+	dropped int64
+	bus     *EventBus
+	handler EventHandler
+	filter  *EventFilter
+	lock    sync.Mutex
+	events  chan Event
+	once    sync.Once
+	doneCh  chan struct{}
+}
+
+func NewEventBus(config *EventBusConfig) *EventBus {
+	b := &EventBus{
+		bufferSize:    DefaultEventBusBufferSize,
+		subscriptions: make(map[*Subscription]struct{}),
+	}
+
+	if config != nil {
+		if config.BufferSize > 0 {
+			b.bufferSize = config.BufferSize
+		}
+		b.dropPolicy = config.DropPolicy
+	}
+	return b
+}
+
+// Subscribe delivers the events matching filter to handler, a nil filter
+// matches every event. Subscribing to a closed bus returns a subscription
+// that receives nothing.
+func (b *EventBus) Subscribe(handler EventHandler,
+	filter *EventFilter) *Subscription {
+	s := &Subscription{
+		bus:     b,
+		handler: handler,
+		filter:  filter,
+		events:  make(chan Event, b.bufferSize),
+		doneCh:  make(chan struct{}),
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed {
+		s.once.Do(func() { close(s.events) })
+		close(s.doneCh)
+		return s
+	}
+
+	b.subscriptions[s] = struct{}{}
+	go s.deliver()
+	return s
+}
+
+// fork returns an empty bus with the same buffer size and drop policy.
+func (b *EventBus) fork() *EventBus {
+	return NewEventBus(&EventBusConfig{
+		BufferSize: b.bufferSize,
+		DropPolicy: b.dropPolicy,
+	})
+}
+
+func (b *EventBus) HandleEvent(event Event) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	for s := range b.subscriptions {
+		if s.filter.match(event) {
+			s.publish(event, b.dropPolicy)
+		}
+	}
+}
+
+// Dropped returns the number of events dropped across all subscribers.
+func (b *EventBus) Dropped() int64 {
+	return atomic.LoadInt64(&b.dropped)
+}
+
+// Close stops accepting events and waits until the buffered events have been
+// delivered.
+func (b *EventBus) Close() error {
+	b.lock.Lock()
+	b.closed = true
+	subscriptions := b.subscriptions
+	b.subscriptions = make(map[*Subscription]struct{})
+	b.lock.Unlock()
+
+	for s := range subscriptions {
+		s.stop()
+	}
+	return nil
+}
+
+// Unsubscribe stops delivering events to the subscriber and waits until the
+// events already buffered have been delivered, so it must not be called from
+// the subscriber's handler.
+func (s *Subscription) Unsubscribe() {
+	s.bus.lock.Lock()
+	_, ok := s.bus.subscriptions[s]
+	delete(s.bus.subscriptions, s)
+	s.bus.lock.Unlock()
+
+	if ok {
+		s.stop()
+	}
+}
+
+// Dropped returns the number of events dropped because the subscriber's
+// buffer was full.
+func (s *Subscription) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// publish is called with the bus lock held for reading, so it can't race
+// with stop closing the channel.
+func (s *Subscription) publish(event Event, policy DropPolicy) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	select {
+	case s.events <- event:
+		return
+	default:
+	}
+
+	if policy == DropOldest {
+		select {
+		case <-s.events:
+			s.drop()
+		default:
+		}
+		// The buffer has room now, either freed above or by the subscriber,
+		// and other publishers are held off by the lock.
+		s.events <- event
+		return
+	}
+	s.drop()
+}
+
+func (s *Subscription) drop() {
+	atomic.AddInt64(&s.dropped, 1)
+	atomic.AddInt64(&s.bus.dropped, 1)
+}
+
+func (s *Subscription) deliver() {
+	defer close(s.doneCh)
+
+	for event := range s.events {
+		s.handler.HandleEvent(event)
+	}
+}
+
+func (s *Subscription) stop() {
+	s.once.Do(func() {
+		close(s.events)
+	})
+	<-s.doneCh
+}
@@ -0,0 +1,190 @@
+package vistar
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type eventRecorder struct {
+	lock   sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) HandleEvent(event Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.events = append(r.events, event)
+}
+
+func (r *eventRecorder) names() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	names := make([]string, 0, len(r.events))
+	for _, event := range r.events {
+		names = append(names, event.Name)
+	}
+	return names
+}
+
+// blockingHandler holds up delivery until release is closed.
+type blockingHandler struct {
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+	eventRecorder
+}
+
+func newBlockingHandler() *blockingHandler {
+	return &blockingHandler{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+}
+
+func (h *blockingHandler) HandleEvent(event Event) {
+	h.once.Do(func() { close(h.started) })
+	<-h.release
+	h.eventRecorder.HandleEvent(event)
+}
+
+func TestEventFilter(t *testing.T) {
+	var filter *EventFilter
+	assert.True(t, filter.match(Event{Name: "a"}))
+
+	filter = &EventFilter{MinLevel: EventLevelWarning}
+	assert.False(t, filter.match(Event{Name: "a", Level: EventLevelInfo}))
+	assert.True(t, filter.match(Event{Name: "a", Level: EventLevelError}))
+
+	filter = &EventFilter{Names: []string{"a", "b"}}
+	assert.True(t, filter.match(Event{Name: "b"}))
+	assert.False(t, filter.match(Event{Name: "c"}))
+}
+
+func TestEventBusDeliversToSubscribers(t *testing.T) {
+	bus := NewEventBus(nil)
+	all := &eventRecorder{}
+	warnings := &eventRecorder{}
+	named := &eventRecorder{}
+	bus.Subscribe(all, nil)
+	bus.Subscribe(warnings, &EventFilter{MinLevel: EventLevelWarning})
+	bus.Subscribe(named, &EventFilter{Names: []string{"b"}})
+
+	bus.HandleEvent(Event{Name: "a", Level: EventLevelInfo})
+	bus.HandleEvent(Event{Name: "b", Level: EventLevelWarning})
+	bus.HandleEvent(Event{Name: "c", Level: EventLevelError})
+	bus.Close()
+
+	assert.Equal(t, all.names(), []string{"a", "b", "c"})
+	assert.Equal(t, warnings.names(), []string{"b", "c"})
+	assert.Equal(t, named.names(), []string{"b"})
+	assert.Equal(t, bus.Dropped(), int64(0))
+
+	// Events published after close are discarded.
+	bus.HandleEvent(Event{Name: "d"})
+	assert.Equal(t, len(all.names()), 3)
+
+	late := &eventRecorder{}
+	bus.Subscribe(late, nil).Unsubscribe()
+	assert.Equal(t, len(late.names()), 0)
+}
+
+func TestEventBusDropNewest(t *testing.T) {
+	bus := NewEventBus(&EventBusConfig{BufferSize: 2})
+	slow := newBlockingHandler()
+	fast := &eventRecorder{}
+	slowSub := bus.Subscribe(slow, nil)
+	fastSub := bus.Subscribe(fast, nil)
+
+	bus.HandleEvent(Event{Name: "a"})
+	<-slow.started
+
+	for _, name := range []string{"b", "c", "d", "e"} {
+		bus.HandleEvent(Event{Name: name})
+	}
+	assert.Equal(t, slowSub.Dropped(), int64(2))
+	assert.Equal(t, bus.Dropped(), fastSub.Dropped()+int64(2))
+
+	close(slow.release)
+	bus.Close()
+	assert.Equal(t, slow.names(), []string{"a", "b", "c"})
+}
+
+func TestEventBusDropOldest(t *testing.T) {
+	bus := NewEventBus(&EventBusConfig{
+		BufferSize: 2,
+		DropPolicy: DropOldest,
+	})
+	slow := newBlockingHandler()
+	sub := bus.Subscribe(slow, nil)
+
+	bus.HandleEvent(Event{Name: "a"})
+	<-slow.started
+
+	for _, name := range []string{"b", "c", "d", "e"} {
+		bus.HandleEvent(Event{Name: name})
+	}
+	assert.Equal(t, sub.Dropped(), int64(2))
+
+	close(slow.release)
+	sub.Unsubscribe()
+	assert.Equal(t, slow.names(), []string{"a", "d", "e"})
+
+	bus.HandleEvent(Event{Name: "f"})
+	bus.Close()
+	assert.Equal(t, len(slow.names()), 3)
+}
+
+func TestClientWithEventBus(t *testing.T) {
+	bus := NewEventBus(nil)
+	recorder := &eventRecorder{}
+	var lock sync.Mutex
+	legacy := make([]string, 0)
+
+	client := NewClient(&ClientConfig{
+		EventBus:     bus,
+		EventHandler: recorder,
+		EventFn: func(name string, message string, source string,
+			level string) {
+			lock.Lock()
+			defer lock.Unlock()
+			legacy = append(legacy, name)
+		},
+	})
+	client.publishStoreError(assert.AnError)
+	client.Close()
+	bus.Close()
+
+	assert.Equal(t, recorder.names(), []string{EventInProgressStoreFailed})
+	assert.Equal(t, legacy, []string{EventInProgressStoreFailed})
+}
+
+func TestClientsSharingEventBus(t *testing.T) {
+	bus := NewEventBus(nil)
+	shared := &eventRecorder{}
+	bus.Subscribe(shared, nil)
+
+	first := &eventRecorder{}
+	second := &eventRecorder{}
+	firstClient := NewClient(&ClientConfig{EventBus: bus, EventHandler: first})
+	secondClient := NewClient(&ClientConfig{
+		EventBus:     bus,
+		EventHandler: second,
+	})
+
+	firstClient.publishEvent(Event{Name: "a"})
+	secondClient.publishEvent(Event{Name: "b"})
+	firstClient.Close()
+	secondClient.Close()
+
+	// Closed clients no longer deliver to their handlers.
+	firstClient.publishEvent(Event{Name: "c"})
+	bus.Close()
+
+	assert.Equal(t, first.names(), []string{"a"})
+	assert.Equal(t, second.names(), []string{"b"})
+	assert.ElementsMatch(t, shared.names(), []string{"a", "b", "c"})
+}
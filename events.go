@@ -0,0 +1,151 @@
+package vistar
+
+import (
+	"fmt"
+	"time"
+)
+
+type EventLevel int
+
+const (
+	EventLevelDebug EventLevel = iota
+	EventLevelInfo
+	EventLevelWarning
+	EventLevelError
+)
+
+func (l EventLevel) String() string {
+	switch l {
+	case EventLevelDebug:
+		return "debug"
+	case EventLevelInfo:
+		return "info"
+	case EventLevelWarning:
+		return "warning"
+	case EventLevelError:
+		return "error"
+	}
+	return fmt.Sprintf("EventLevel(%d)", int(l))
+}
+
+// Names of the events published by the client.
+const (
+	EventAdServerReturnedNoAds        = "ad-server-returned-no-ads"
+	EventAdServerReturnedNoAssets     = "ad-server-returned-no-assets"
+	EventAdServerReturnedInvalidAd    = "ad-server-returned-invalid-ad"
+	EventAdServerReturnedInvalidAsset = "ad-server-returned-invalid-asset"
+	EventAdServerRequestRetry         = "ad-server-request-retry"
+	EventAdServerEndpointFailed       = "ad-server-endpoint-failed"
+	EventAdServerFailover             = "ad-server-failover"
+	EventAdServerEndpointUnhealthy    = "ad-server-endpoint-unhealthy"
+	EventAdServerEndpointHealthy      = "ad-server-endpoint-healthy"
+	EventCircuitBreakerStateChanged   = "circuit-breaker-state-changed"
+	EventAppCacheFailed               = "app-cache-failed"
+	EventAdLeaseExpired               = "ad-lease-expired"
+	EventAdExpiredOnClose             = "ad-expired-on-close"
+	EventAdPoPFailed                  = "ad-pop-failed"
+	EventAdExpireFailed               = "ad-expire-failed"
+	EventAdPoPQueued                  = "ad-pop-queued"
+	EventAdPoPDropped                 = "ad-pop-dropped"
+	EventAdPoPAbandoned               = "ad-pop-abandoned"
+	EventPoPQueueFailed               = "pop-queue-failed"
+	EventPoPQueueWriteFailed          = "pop-queue-write-failed"
+	EventAdPoPBatchFailed             = "ad-pop-batch-failed"
+	EventInProgressStoreFailed        = "in-progress-store-failed"
+	EventAdAlreadyFinalized           = "ad-already-finalized"
+	EventAdPlaybackIncomplete         = "ad-playback-incomplete"
+	EventFinalizedLedgerFailed        = "finalized-ledger-failed"
+
+	// Debug events, published for every request so that they can be
+	// audited. EventAdConfirmed and EventAdExpired are only published once
+	// the server accepted the request, the attempts that failed are
+	// published as EventAdConfirmAttemptFailed and EventAdExpireAttemptFailed.
+	EventAdRequest              = "ad-request"
+	EventAdCached               = "ad-cached"
+	EventAdConfirmed            = "ad-confirmed"
+	EventAdExpired              = "ad-expired"
+	EventAdConfirmAttemptFailed = "ad-confirm-attempt-failed"
+	EventAdExpireAttemptFailed  = "ad-expire-attempt-failed"
+	EventPoPBatchSent           = "pop-batch-sent"
+	EventAdStateChanged         = "ad-state-changed"
+)
+
+type Event struct {
+	Name  string
+	Level EventLevel
+	Time  time.Time
+	// Message describes the event in the format that is passed to an
+	// EventFunc.
+	Message  string
+	AdId     string
+	Url      string
+	Status   int
+	Err      error
+	Duration time.Duration
+	Fields   map[string]interface{}
+}
+
+type EventHandler interface {
+	HandleEvent(Event)
+}
+
+type EventHandlerFunc func(Event)
+
+func (f EventHandlerFunc) HandleEvent(event Event) {
+	f(event)
+}
+
+// NewEventFuncHandler adapts an EventFunc to an EventHandler. The function
+// is called with the event name, message, an empty source and the level.
+// Debug events are not passed on, since an EventFunc never received them.
+func NewEventFuncHandler(fn EventFunc) EventHandler {
+	if fn == nil {
+		return nil
+	}
+
+	return EventHandlerFunc(func(event Event) {
+		if event.Level < EventLevelInfo {
+			return
+		}
+		fn(event.Name, event.Message, "", event.Level.String())
+	})
+}
+
+// eventHandlers passes each event to all of its handlers in turn.
+type eventHandlers []EventHandler
+
+func (h eventHandlers) HandleEvent(event Event) {
+	for _, handler := range h {
+		handler.HandleEvent(event)
+	}
+}
+
+// combineEventHandlers returns nil if there are no handlers, and the handler
+// itself if there is only one.
+func combineEventHandlers(handlers ...EventHandler) EventHandler {
+	combined := make(eventHandlers, 0, len(handlers))
+	for _, handler := range handlers {
+		if handler != nil {
+			combined = append(combined, handler)
+		}
+	}
+
+	switch len(combined) {
+	case 0:
+		return nil
+	case 1:
+		return combined[0]
+	}
+	return combined
+}
+
+func publishEvent(handler EventHandler, event Event) {
+	if handler == nil {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	handler.HandleEvent(event)
+}
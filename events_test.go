@@ -0,0 +1,133 @@
+package vistar
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventLevelString(t *testing.T) {
+	assert.Equal(t, EventLevelDebug.String(), "debug")
+	assert.Equal(t, EventLevelInfo.String(), "info")
+	assert.Equal(t, EventLevelWarning.String(), "warning")
+	assert.Equal(t, EventLevelError.String(), "error")
+	assert.Equal(t, EventLevel(10).String(), "EventLevel(10)")
+}
+
+func TestEventFuncHandler(t *testing.T) {
+	assert.Nil(t, NewEventFuncHandler(nil))
+
+	var calls [][]string
+	handler := NewEventFuncHandler(func(name string, message string,
+		source string, level string) {
+		calls = append(calls, []string{name, message, source, level})
+	})
+
+	handler.HandleEvent(Event{
+		Name:    EventAdServerEndpointFailed,
+		Level:   EventLevelWarning,
+		Message: "url: http://test, code: 500, body: ",
+		Url:     "http://test",
+		Status:  500,
+	})
+	handler.HandleEvent(Event{Name: "debug-event", Level: EventLevelDebug})
+
+	assert.Equal(t, calls, [][]string{{EventAdServerEndpointFailed,
+		"url: http://test, code: 500, body: ", "", "warning"}})
+}
+
+func TestCombineEventHandlers(t *testing.T) {
+	assert.Nil(t, combineEventHandlers(nil, nil))
+
+	var names []string
+	first := EventHandlerFunc(func(event Event) {
+		names = append(names, "first:"+event.Name)
+	})
+	second := EventHandlerFunc(func(event Event) {
+		names = append(names, "second:"+event.Name)
+	})
+
+	combined := combineEventHandlers(first, nil)
+	combined.HandleEvent(Event{Name: "a"})
+	assert.Equal(t, names, []string{"first:a"})
+
+	names = nil
+	publishEvent(combineEventHandlers(first, second), Event{Name: "b"})
+	assert.Equal(t, names, []string{"first:b", "second:b"})
+}
+
+func TestPublishEventSetsTime(t *testing.T) {
+	var received Event
+	handler := EventHandlerFunc(func(event Event) { received = event })
+
+	publishEvent(handler, Event{Name: "a"})
+	assert.False(t, received.Time.IsZero())
+
+	at := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	publishEvent(handler, Event{Name: "a", Time: at})
+	assert.Equal(t, received.Time, at)
+
+	publishEvent(nil, Event{Name: "a"})
+}
+
+func TestClientPublishesTypedEvents(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("failed"))
+		}))
+	defer ts.Close()
+
+	var events []Event
+	var legacy []string
+	client := NewClient(&ClientConfig{
+		EventHandler: EventHandlerFunc(func(event Event) {
+			events = append(events, event)
+		}),
+		EventFn: func(name string, message string, source string,
+			level string) {
+			legacy = append(legacy, name)
+		},
+	})
+	defer client.Close()
+
+	_, err := client.GetAd(&request{url: ts.URL, data: newTestData()})
+	assert.NotNil(t, err)
+
+	assert.Equal(t, len(events), 2)
+	event := events[0]
+	assert.Equal(t, event.Name, EventAdServerEndpointFailed)
+	assert.Equal(t, event.Level, EventLevelWarning)
+	assert.Equal(t, event.Url, ts.URL)
+	assert.Equal(t, event.Status, http.StatusInternalServerError)
+	assert.Equal(t, event.Fields["body"], "failed")
+	assert.False(t, event.Time.IsZero())
+	assert.Equal(t, legacy, []string{EventAdServerEndpointFailed})
+
+	// The request itself is published at debug level, which EventFn does not
+	// receive.
+	assert.Equal(t, events[1].Name, EventAdRequest)
+	assert.Equal(t, events[1].Level, EventLevelDebug)
+	assert.Equal(t, events[1].Err, err)
+}
+
+func TestExpireAdEvent(t *testing.T) {
+	var events []Event
+	pop := NewTestProofOfPlay()
+	client := &client{
+		pop: pop,
+		events: EventHandlerFunc(func(event Event) {
+			events = append(events, event)
+		}),
+	}
+
+	client.expireAd(Ad{"id": "ad-1"}, EventAdLeaseExpired)
+	assert.Equal(t, len(events), 1)
+	assert.Equal(t, events[0].AdId, "ad-1")
+	assert.Equal(t, events[0].Level, EventLevelInfo)
+	assert.Equal(t, events[0].Message, "adId: ad-1")
+	assert.Nil(t, events[0].Err)
+}
@@ -0,0 +1,174 @@
+package vistar
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+var DefaultFinalizedLedgerSize = 10000
+
+var ErrAlreadyFinalized = errors.New("ad already confirmed or expired")
+
+// FinalizedLedger remembers the ids of the ads that were confirmed or
+// expired, so that an ad that shows up again, after a restart or from a
+// second code path, is not reported twice.
+type FinalizedLedger interface {
+	// Add records the ad id. It returns false if it was already recorded.
+	Add(string) (bool, error)
+	Contains(string) (bool, error)
+	Close() error
+}
+
+// memoryFinalizedLedger keeps the last size ad ids, forgetting the oldest
+// first.
+type memoryFinalizedLedger struct {
+	lock  sync.Mutex
+	size  int
+	ids   map[string]struct{}
+	order []string
+}
+
+func NewMemoryFinalizedLedger(size int) *memoryFinalizedLedger {
+	if size <= 0 {
+		size = DefaultFinalizedLedgerSize
+	}
+
+	return &memoryFinalizedLedger{
+		size: size,
+		ids:  make(map[string]struct{}),
+	}
+}
+
+func (l *memoryFinalizedLedger) Add(adId string) (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.addLocked(adId), nil
+}
+
+func (l *memoryFinalizedLedger) Contains(adId string) (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	_, ok := l.ids[adId]
+	return ok, nil
+}
+
+func (l *memoryFinalizedLedger) Close() error {
+	return nil
+}
+
+func (l *memoryFinalizedLedger) addLocked(adId string) bool {
+	if _, ok := l.ids[adId]; ok {
+		return false
+	}
+
+	l.ids[adId] = struct{}{}
+	l.order = append(l.order, adId)
+	if len(l.order) > l.size {
+		delete(l.ids, l.order[0])
+		l.order = l.order[1:]
+	}
+	return true
+}
+
+type fileFinalizedRecord struct {
+	Id string `json:"id"`
+}
+
+// fileFinalizedLedger keeps the ad ids in memory and appends every new one
+// to a file, which is replayed when the ledger is opened again.
+type fileFinalizedLedger struct {
+	lock   sync.Mutex
+	log    *appendLog
+	ledger *memoryFinalizedLedger
+}
+
+func NewFileFinalizedLedger(path string, size int) (*fileFinalizedLedger,
+	error) {
+	l := &fileFinalizedLedger{
+		log:    newAppendLog(path),
+		ledger: NewMemoryFinalizedLedger(size),
+	}
+
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if err := l.compactLocked(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *fileFinalizedLedger) Add(adId string) (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if ok, _ := l.ledger.Contains(adId); ok {
+		return false, nil
+	}
+
+	if err := l.log.append(&fileFinalizedRecord{Id: adId}); err != nil {
+		return false, err
+	}
+
+	l.ledger.Add(adId)
+	return true, l.maybeCompactLocked()
+}
+
+func (l *fileFinalizedLedger) Contains(adId string) (bool, error) {
+	return l.ledger.Contains(adId)
+}
+
+func (l *fileFinalizedLedger) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if err := l.compactLocked(); err != nil {
+		return err
+	}
+	return l.log.close()
+}
+
+// maybeCompactLocked drops the ids that the ledger has forgotten from the
+// file.
+func (l *fileFinalizedLedger) maybeCompactLocked() error {
+	if l.log.records > 2*l.ledger.size {
+		return l.compactLocked()
+	}
+	return nil
+}
+
+func (l *fileFinalizedLedger) load() error {
+	return l.log.load(func(line []byte) error {
+		record := &fileFinalizedRecord{}
+		if err := json.Unmarshal(line, record); err != nil {
+			return err
+		}
+
+		if record.Id != "" {
+			l.ledger.Add(record.Id)
+		}
+		return nil
+	})
+}
+
+func (l *fileFinalizedLedger) compactLocked() error {
+	l.ledger.lock.Lock()
+	order := append([]string(nil), l.ledger.order...)
+	l.ledger.lock.Unlock()
+
+	return l.log.compact(func(encode func(interface{}) error) error {
+		for _, adId := range order {
+			if err := encode(&fileFinalizedRecord{Id: adId}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,152 @@
+package vistar
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryFinalizedLedger(t *testing.T) {
+	ledger := NewMemoryFinalizedLedger(2)
+
+	added, err := ledger.Add("1")
+	assert.Nil(t, err)
+	assert.True(t, added)
+
+	added, _ = ledger.Add("1")
+	assert.False(t, added)
+
+	ledger.Add("2")
+	ledger.Add("3")
+
+	ok, err := ledger.Contains("1")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	ok, _ = ledger.Contains("3")
+	assert.True(t, ok)
+}
+
+func TestFileFinalizedLedgerSurvivesRestart(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "finalized")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "finalized.log")
+
+	ledger, err := NewFileFinalizedLedger(path, 10)
+	assert.Nil(t, err)
+
+	ledger.Add("1")
+	ledger.Add("2")
+
+	// Simulate a crash in the middle of a write.
+	ledger.log.file.Write([]byte(`{"id": "3`))
+
+	ledger, err = NewFileFinalizedLedger(path, 10)
+	assert.Nil(t, err)
+	defer ledger.Close()
+
+	ok, _ := ledger.Contains("2")
+	assert.True(t, ok)
+	ok, _ = ledger.Contains("3")
+	assert.False(t, ok)
+
+	added, err := ledger.Add("1")
+	assert.Nil(t, err)
+	assert.False(t, added)
+
+	data, _ := ioutil.ReadFile(path)
+	assert.Equal(t, string(data), `{"id":"1"}`+"\n"+`{"id":"2"}`+"\n")
+}
+
+func TestFileFinalizedLedgerCompacts(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "finalized")
+	defer os.RemoveAll(dir)
+
+	ledger, _ := NewFileFinalizedLedger(filepath.Join(dir, "finalized.log"),
+		10)
+	defer ledger.Close()
+
+	for i := 0; i < 100; i++ {
+		ledger.Add(string(rune('a' + i)))
+	}
+
+	assert.True(t, ledger.log.records <= 20)
+	ok, _ := ledger.Contains(string(rune('a' + 99)))
+	assert.True(t, ok)
+}
+
+func TestClientRejectsDoubleFinalize(t *testing.T) {
+	pop := NewTestProofOfPlay()
+	var events []Event
+	client := &client{
+		pop:        pop,
+		inProgress: NewMemoryInProgressStore(),
+		finalized:  NewMemoryFinalizedLedger(10),
+		events: EventHandlerFunc(func(event Event) {
+			events = append(events, event)
+		}),
+	}
+
+	client.addToInProgressList(Ad{"id": "1"})
+	client.addToInProgressList(Ad{"id": "2"})
+
+	_, err := client.Confirm("1", 10)
+	assert.Nil(t, err)
+	_, err = client.Confirm("1", 10)
+	assert.Equal(t, err, ErrAlreadyFinalized)
+	assert.Equal(t, client.Expire("1"), ErrAlreadyFinalized)
+
+	assert.Nil(t, client.Expire("2"))
+	_, err = client.Confirm("2", 10)
+	assert.Equal(t, err, ErrAlreadyFinalized)
+
+	assert.Equal(t, client.Expire("3"), AdNotFound)
+
+	// The ad server handing out an ad again does not get it reported twice.
+	client.addToInProgressList(Ad{"id": "1"})
+	_, err = client.Confirm("1", 10)
+	assert.Equal(t, err, ErrAlreadyFinalized)
+
+	assert.Len(t, pop.requests, 2)
+	assert.Len(t, events, 4)
+	assert.Equal(t, events[0].Name, EventAdAlreadyFinalized)
+	assert.Equal(t, events[0].AdId, "1")
+}
+
+func TestClientFinalizedLedgerSurvivesRestart(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "finalized")
+	defer os.RemoveAll(dir)
+	inProgressPath := filepath.Join(dir, "in_progress.log")
+	ledgerPath := filepath.Join(dir, "finalized.log")
+
+	newTestClient := func() (*client, *testProofOfPlay) {
+		store, err := NewFileInProgressStore(inProgressPath)
+		assert.Nil(t, err)
+		ledger, err := NewFileFinalizedLedger(ledgerPath, 10)
+		assert.Nil(t, err)
+
+		pop := NewTestProofOfPlay()
+		return &client{
+			pop:        pop,
+			inProgress: store,
+			finalized:  ledger,
+			closeCh:    make(chan struct{}),
+		}, pop
+	}
+
+	c, _ := newTestClient()
+	c.addToInProgressList(Ad{"id": "1"})
+	_, err := c.Confirm("1", 10)
+	assert.Nil(t, err)
+	c.Close()
+
+	c, pop := newTestClient()
+	defer c.Close()
+
+	_, err = c.Confirm("1", 10)
+	assert.Equal(t, err, ErrAlreadyFinalized)
+	assert.Len(t, pop.requests, 0)
+}
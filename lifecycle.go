@@ -0,0 +1,245 @@
+package vistar
+
+import (
+	"fmt"
+	"time"
+)
+
+type AdState int
+
+const (
+	// AdStateLeased is the state of an ad that was returned by the ad
+	// server.
+	AdStateLeased AdState = iota
+	AdStateCaching
+	// AdStateReady is the state of an ad that can be played, it is also
+	// assumed for in progress ads that this client did not receive, such as
+	// after a restart.
+	AdStateReady
+	AdStatePlaying
+	AdStatePlayed
+	AdStateConfirmed
+	AdStateFailed
+	AdStateExpired
+)
+
+func (s AdState) String() string {
+	switch s {
+	case AdStateLeased:
+		return "leased"
+	case AdStateCaching:
+		return "caching"
+	case AdStateReady:
+		return "ready"
+	case AdStatePlaying:
+		return "playing"
+	case AdStatePlayed:
+		return "played"
+	case AdStateConfirmed:
+		return "confirmed"
+	case AdStateFailed:
+		return "failed"
+	case AdStateExpired:
+		return "expired"
+	}
+	return fmt.Sprintf("AdState(%d)", int(s))
+}
+
+// adTransitions lists the states an ad can move to from each state. An ad
+// can be expired from any state until it is confirmed.
+var adTransitions = map[AdState][]AdState{
+	AdStateLeased: {AdStateCaching, AdStateReady, AdStateFailed,
+		AdStateExpired},
+	AdStateCaching: {AdStateReady, AdStateFailed, AdStateExpired},
+	AdStateReady:   {AdStatePlaying, AdStateConfirmed, AdStateExpired},
+	AdStatePlaying: {AdStatePlayed, AdStateConfirmed, AdStateFailed,
+		AdStateExpired},
+	AdStatePlayed: {AdStateConfirmed, AdStateExpired},
+	AdStateFailed: {AdStateExpired},
+}
+
+func (s AdState) canMoveTo(to AdState) bool {
+	for _, state := range adTransitions[s] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
+type InvalidAdTransitionError struct {
+	AdId string
+	From AdState
+	To   AdState
+}
+
+func (e *InvalidAdTransitionError) Error() string {
+	return fmt.Sprintf("ad %s can't move from %s to %s", e.AdId, e.From,
+		e.To)
+}
+
+// AdStatus is where an in progress ad is in its lifecycle.
+type AdStatus struct {
+	State AdState
+	// Since is when the ad moved to its state.
+	Since time.Time
+	// StartedAt and Played are set by MarkPlaying and MarkPlayed.
+	StartedAt time.Time
+	Played    time.Duration
+}
+
+// MarkPlaying records that the ad started playing. A confirm with a display
+// time of 0 then sends the time it started at, instead of the time of the
+// confirm.
+func (c *client) MarkPlaying(adId string) error {
+	now := time.Now()
+	return c.transitionAd(adId, AdStatePlaying, func(playback *adPlayback) {
+		playback.startedAt = now
+	})
+}
+
+// MarkPlayed records that the ad stopped playing after playedDuration.
+func (c *client) MarkPlayed(adId string, playedDuration time.Duration) error {
+	return c.transitionAd(adId, AdStatePlayed, func(playback *adPlayback) {
+		playback.played = playedDuration
+	})
+}
+
+func (c *client) GetAdStatus(adId string) (AdStatus, bool) {
+	statuses := c.adStatuses()
+	status, ok := statuses[adId]
+	return status, ok
+}
+
+// GetInProgressAdsByState returns the in progress ads that are in one of
+// the states.
+func (c *client) GetInProgressAdsByState(states ...AdState) map[string]Ad {
+	statuses := c.adStatuses()
+	ret := map[string]Ad{}
+	for adId, ad := range c.GetInProgressAds() {
+		for _, state := range states {
+			if statuses[adId].State == state {
+				ret[adId] = ad
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// GetStuckAds returns the status of the in progress ads that have been
+// caching or playing for longer than olderThan.
+func (c *client) GetStuckAds(olderThan time.Duration) map[string]AdStatus {
+	deadline := time.Now().Add(-olderThan)
+	ret := map[string]AdStatus{}
+	for adId, status := range c.adStatuses() {
+		if status.State != AdStateCaching && status.State != AdStatePlaying {
+			continue
+		}
+
+		if status.Since.Before(deadline) {
+			ret[adId] = status
+		}
+	}
+	return ret
+}
+
+// adStatuses returns the status of every in progress ad.
+func (c *client) adStatuses() map[string]AdStatus {
+	ads := c.GetInProgressAds()
+
+	c.playbackLock.Lock()
+	defer c.playbackLock.Unlock()
+
+	ret := make(map[string]AdStatus, len(ads))
+	for adId := range ads {
+		if playback, ok := c.playback[adId]; ok {
+			ret[adId] = playback.status()
+		} else {
+			ret[adId] = AdStatus{State: AdStateReady}
+		}
+	}
+	return ret
+}
+
+// transitionAd moves the ad to a new state and applies update to it. The
+// ad must be in progress.
+func (c *client) transitionAd(adId string, to AdState,
+	update func(*adPlayback)) error {
+	if _, ok := c.GetInProgressAds()[adId]; !ok {
+		if c.isFinalized(adId) {
+			return ErrAlreadyFinalized
+		}
+		return AdNotFound
+	}
+
+	c.playbackLock.Lock()
+	playback := c.playbackLocked(adId)
+	from := playback.state
+	if !from.canMoveTo(to) {
+		c.playbackLock.Unlock()
+		return &InvalidAdTransitionError{AdId: adId, From: from, To: to}
+	}
+
+	playback.state = to
+	playback.since = time.Now()
+	if update != nil {
+		update(playback)
+	}
+	c.playbackLock.Unlock()
+
+	c.publishTransition(adId, from, to)
+	return nil
+}
+
+// setAdState moves the ad to a new state if it is being tracked and the
+// transition is allowed.
+func (c *client) setAdState(adId string, to AdState) {
+	c.playbackLock.Lock()
+	playback, ok := c.playback[adId]
+	if !ok || !playback.state.canMoveTo(to) {
+		c.playbackLock.Unlock()
+		return
+	}
+
+	from := playback.state
+	playback.state = to
+	playback.since = time.Now()
+	c.playbackLock.Unlock()
+
+	c.publishTransition(adId, from, to)
+}
+
+// finishPlayback moves the ad to its final state and stops tracking it.
+func (c *client) finishPlayback(adId string, to AdState) {
+	c.setAdState(adId, to)
+	c.forgetPlayback(adId)
+}
+
+// playbackLocked returns the playback of the ad, and starts tracking it as
+// ready if it isn't tracked yet.
+func (c *client) playbackLocked(adId string) *adPlayback {
+	if c.playback == nil {
+		c.playback = make(map[string]*adPlayback)
+	}
+
+	playback, ok := c.playback[adId]
+	if !ok {
+		playback = &adPlayback{state: AdStateReady, since: time.Now()}
+		c.playback[adId] = playback
+	}
+	return playback
+}
+
+func (c *client) publishTransition(adId string, from AdState, to AdState) {
+	c.publishEvent(Event{
+		Name:    EventAdStateChanged,
+		Level:   EventLevelDebug,
+		Message: fmt.Sprintf("adId: %s, from: %s, to: %s", adId, from, to),
+		AdId:    adId,
+		Fields: map[string]interface{}{
+			"from": from.String(),
+			"to":   to.String(),
+		},
+	})
+}
@@ -0,0 +1,150 @@
+package vistar
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cortexsystems/vistar-go-client/vistartest"
+	"github.com/stretchr/testify/assert"
+)
+
+type transitionRecorder struct {
+	lock        sync.Mutex
+	transitions map[string][]string
+}
+
+func (r *transitionRecorder) HandleEvent(event Event) {
+	if event.Name != EventAdStateChanged {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.transitions == nil {
+		r.transitions = make(map[string][]string)
+	}
+	r.transitions[event.AdId] = append(r.transitions[event.AdId],
+		event.Fields["to"].(string))
+}
+
+func (r *transitionRecorder) of(adId string) []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.transitions[adId]
+}
+
+func TestAdLifecycle(t *testing.T) {
+	server := vistartest.NewServer(&vistartest.ServerConfig{
+		AdsPerDisplayArea: 2,
+	})
+	defer server.Close()
+
+	recorder := &transitionRecorder{}
+	client := NewClient(&ClientConfig{
+		ReqTimeout:   time.Second,
+		EventHandler: recorder,
+		CacheContextFn: func(ctx context.Context, url string,
+			ttl time.Duration) (string, error) {
+			return "/cache/" + url[strings.LastIndex(url, "/")+1:], nil
+		},
+	})
+	defer client.Close()
+
+	_, err := client.GetAd(NewRequest(server.AdUrl(), "", newTestData(), false, 0))
+	assert.Nil(t, err)
+	assert.Equal(t, recorder.of("ad-1"), []string{"caching", "ready"})
+	assert.Len(t, client.GetInProgressAdsByState(AdStateReady), 2)
+
+	err = client.MarkPlayed("ad-1", time.Second)
+	assert.Equal(t, err, &InvalidAdTransitionError{
+		AdId: "ad-1",
+		From: AdStateReady,
+		To:   AdStatePlayed,
+	})
+
+	start := time.Now()
+	assert.Nil(t, client.MarkPlaying("ad-1"))
+	assert.Equal(t, client.GetInProgressAdsByState(AdStatePlaying),
+		map[string]Ad{"ad-1": client.GetInProgressAds()["ad-1"]})
+	assert.Len(t, client.GetStuckAds(time.Hour), 0)
+
+	time.Sleep(10 * time.Millisecond)
+	stuck := client.GetStuckAds(5 * time.Millisecond)
+	assert.Len(t, stuck, 1)
+	assert.Equal(t, stuck["ad-1"].State, AdStatePlaying)
+
+	assert.Nil(t, client.MarkPlayed("ad-1", 15*time.Second))
+	status, ok := client.GetAdStatus("ad-1")
+	assert.True(t, ok)
+	assert.Equal(t, status.State, AdStatePlayed)
+	assert.Equal(t, status.Played, 15*time.Second)
+	assert.InDelta(t, status.StartedAt.UnixNano(), start.UnixNano(),
+		float64(time.Second))
+
+	// A display time of 0 sends the time the ad started playing.
+	_, err = client.Confirm("ad-1", 0)
+	assert.Nil(t, err)
+	record, _ := server.Ad("ad-1")
+	assert.Equal(t, record.DisplayTime, status.StartedAt.Unix())
+	assert.Equal(t, recorder.of("ad-1"),
+		[]string{"caching", "ready", "playing", "played", "confirmed"})
+
+	_, ok = client.GetAdStatus("ad-1")
+	assert.False(t, ok)
+	assert.Equal(t, client.MarkPlaying("ad-1"), ErrAlreadyFinalized)
+	assert.Equal(t, client.MarkPlaying("unknown"), AdNotFound)
+
+	assert.Nil(t, client.Expire("ad-2"))
+	assert.Equal(t, recorder.of("ad-2"),
+		[]string{"caching", "ready", "expired"})
+}
+
+func TestAdLifecycleCacheFailure(t *testing.T) {
+	server := vistartest.NewServer(nil)
+	defer server.Close()
+
+	recorder := &transitionRecorder{}
+	client := NewClient(&ClientConfig{
+		ReqTimeout:   time.Second,
+		EventHandler: recorder,
+		CacheFn: func(url string, ttl time.Duration) (string, error) {
+			return "", errors.New("disk full")
+		},
+	})
+	defer client.Close()
+
+	resp, err := client.GetAd(NewRequest(server.AdUrl(), "", newTestData(), false, 0))
+	assert.Nil(t, err)
+	assert.Len(t, resp.Advertisement, 0)
+	assert.Equal(t, recorder.of("ad-1"),
+		[]string{"caching", "failed", "expired"})
+	assert.Equal(t, server.Expired(), []string{"ad-1"})
+}
+
+func TestAdStatusAfterRestart(t *testing.T) {
+	client := &client{
+		pop:        NewTestProofOfPlay(),
+		inProgress: NewMemoryInProgressStore(),
+	}
+
+	// Ads that this client did not receive are assumed to be ready.
+	client.addToInProgressList(Ad{"id": "1"})
+	status, ok := client.GetAdStatus("1")
+	assert.True(t, ok)
+	assert.Equal(t, status.State, AdStateReady)
+
+	assert.Nil(t, client.MarkPlaying("1"))
+	status, _ = client.GetAdStatus("1")
+	assert.Equal(t, status.State, AdStatePlaying)
+}
+
+func TestAdStateString(t *testing.T) {
+	assert.Equal(t, AdStateCaching.String(), "caching")
+	assert.Equal(t, AdState(42).String(), "AdState(42)")
+}
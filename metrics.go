@@ -0,0 +1,16 @@
+package vistar
+
+import "time"
+
+// Metrics receives the activity of the client and its proof of play calls.
+// The metrics package provides a Prometheus implementation.
+type Metrics interface {
+	// AdRequest is called for every request to the ad server, status is 0
+	// when no response was received.
+	AdRequest(url string, duration time.Duration, status int, err error)
+	AdsReturned(count int)
+	CacheFailure(url string)
+	Bytes(url string, sent int64, received int64)
+	Confirm(status int, err error)
+	Expire(status int, err error)
+}
@@ -0,0 +1,295 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	vistar "github.com/cortexsystems/vistar-go-client"
+)
+
+var DefaultLatencyBuckets = []float64{
+	0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30,
+}
+
+var _ vistar.Metrics = (*Collector)(nil)
+
+// Collector implements vistar.Metrics and serves the collected metrics in
+// the Prometheus text format.
+type Collector struct {
+	lock           sync.Mutex
+	adRequests     *counterVec
+	requestLatency *histogramVec
+	adsReturned    *counterVec
+	emptyResponses *counterVec
+	cacheFailures  *counterVec
+	bytesSent      *counterVec
+	bytesReceived  *counterVec
+	confirms       *counterVec
+	expires        *counterVec
+	popFailures    *counterVec
+}
+
+func NewCollector() *Collector {
+	return &Collector{
+		adRequests: newCounterVec("vistar_ad_requests_total",
+			"Requests made to the ad server.", "url", "code"),
+		requestLatency: newHistogramVec(
+			"vistar_ad_request_duration_seconds",
+			"Latency of requests made to the ad server.",
+			DefaultLatencyBuckets, "url"),
+		adsReturned: newCounterVec("vistar_ads_returned_total",
+			"Ads returned by the ad server."),
+		emptyResponses: newCounterVec("vistar_empty_ad_responses_total",
+			"Ad server responses without any ad."),
+		cacheFailures: newCounterVec("vistar_cache_failures_total",
+			"Assets that could not be cached."),
+		bytesSent: newCounterVec("vistar_bytes_sent_total",
+			"Bytes sent per endpoint.", "url"),
+		bytesReceived: newCounterVec("vistar_bytes_received_total",
+			"Bytes received per endpoint.", "url"),
+		confirms: newCounterVec("vistar_confirms_total",
+			"Proof of play confirmations.", "result"),
+		expires: newCounterVec("vistar_expires_total",
+			"Ad expirations.", "result"),
+		popFailures: newCounterVec("vistar_pop_failures_total",
+			"Failed proof of play and expiration requests.", "type", "code"),
+	}
+}
+
+func (c *Collector) AdRequest(url string, duration time.Duration,
+	status int, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.adRequests.add(1, url, statusLabel(status))
+	c.requestLatency.observe(duration.Seconds(), url)
+}
+
+func (c *Collector) AdsReturned(count int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.adsReturned.add(float64(count))
+	if count == 0 {
+		c.emptyResponses.add(1)
+	}
+}
+
+func (c *Collector) CacheFailure(url string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.cacheFailures.add(1)
+}
+
+func (c *Collector) Bytes(url string, sent int64, received int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.bytesSent.add(float64(sent), url)
+	c.bytesReceived.add(float64(received), url)
+}
+
+func (c *Collector) Confirm(status int, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.recordPoPLocked(c.confirms, "confirm", status, err)
+}
+
+func (c *Collector) Expire(status int, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.recordPoPLocked(c.expires, "expire", status, err)
+}
+
+func (c *Collector) recordPoPLocked(counter *counterVec, popType string,
+	status int, err error) {
+	if err != nil || status >= http.StatusBadRequest {
+		counter.add(1, "failure")
+		c.popFailures.add(1, popType, statusLabel(status))
+		return
+	}
+	counter.add(1, "success")
+}
+
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	c.WriteTo(w)
+}
+
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var b strings.Builder
+	c.adRequests.write(&b)
+	c.requestLatency.write(&b)
+	c.adsReturned.write(&b)
+	c.emptyResponses.write(&b)
+	c.cacheFailures.write(&b)
+	c.bytesSent.write(&b)
+	c.bytesReceived.write(&b)
+	c.confirms.write(&b)
+	c.expires.write(&b)
+	c.popFailures.write(&b)
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func statusLabel(status int) string {
+	if status == 0 {
+		return "error"
+	}
+	return strconv.Itoa(status)
+}
+
+type counterVec struct {
+	name       string
+	help       string
+	labelNames []string
+	values     map[string]float64
+}
+
+func newCounterVec(name string, help string,
+	labelNames ...string) *counterVec {
+	v := &counterVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		values:     make(map[string]float64),
+	}
+
+	// Counters without labels are exported from the start.
+	if len(labelNames) == 0 {
+		v.values[""] = 0
+	}
+	return v
+}
+
+func (v *counterVec) add(value float64, labelValues ...string) {
+	v.values[formatLabels(v.labelNames, labelValues)] += value
+}
+
+func (v *counterVec) write(b *strings.Builder) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", v.name, v.help,
+		v.name)
+	for _, labels := range sortedKeys(v.values) {
+		fmt.Fprintf(b, "%s%s %s\n", v.name, labels,
+			formatValue(v.values[labels]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name       string
+	help       string
+	buckets    []float64
+	labelNames []string
+	values     map[string]*histogram
+	labels     map[string][]string
+}
+
+func newHistogramVec(name string, help string, buckets []float64,
+	labelNames ...string) *histogramVec {
+	return &histogramVec{
+		name:       name,
+		help:       help,
+		buckets:    buckets,
+		labelNames: labelNames,
+		values:     make(map[string]*histogram),
+		labels:     make(map[string][]string),
+	}
+}
+
+func (v *histogramVec) observe(value float64, labelValues ...string) {
+	key := formatLabels(v.labelNames, labelValues)
+	h, ok := v.values[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(v.buckets))}
+		v.values[key] = h
+		v.labels[key] = labelValues
+	}
+
+	for i, bound := range v.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (v *histogramVec) write(b *strings.Builder) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", v.name, v.help,
+		v.name)
+
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	bucketLabels := append(append([]string{}, v.labelNames...), "le")
+	for _, key := range keys {
+		h := v.values[key]
+		labelValues := v.labels[key]
+		for i, bound := range v.buckets {
+			fmt.Fprintf(b, "%s_bucket%s %d\n", v.name,
+				formatLabels(bucketLabels,
+					append(append([]string{}, labelValues...),
+						formatValue(bound))),
+				h.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", v.name,
+			formatLabels(bucketLabels,
+				append(append([]string{}, labelValues...), "+Inf")),
+			h.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", v.name, key, formatValue(h.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", v.name, key, h.count)
+	}
+}
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", name, escapeLabel(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	return strings.Replace(value, `"`, `\"`, -1)
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
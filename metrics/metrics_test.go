@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	vistar "github.com/cortexsystems/vistar-go-client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectorWritesPrometheusFormat(t *testing.T) {
+	c := NewCollector()
+
+	c.AdRequest("http://ads", 30*time.Millisecond, 200, nil)
+	c.AdRequest("http://ads", 2*time.Second, 0, errors.New("timeout"))
+	c.AdsReturned(2)
+	c.AdsReturned(0)
+	c.CacheFailure("http://asset")
+	c.Bytes("http://ads", 100, 1024)
+	c.Confirm(200, nil)
+	c.Confirm(500, nil)
+	c.Expire(0, errors.New("network down"))
+
+	var b strings.Builder
+	c.WriteTo(&b)
+	out := b.String()
+
+	for _, line := range []string{
+		"# TYPE vistar_ad_requests_total counter",
+		`vistar_ad_requests_total{url="http://ads",code="200"} 1`,
+		`vistar_ad_requests_total{url="http://ads",code="error"} 1`,
+		"# TYPE vistar_ad_request_duration_seconds histogram",
+		`vistar_ad_request_duration_seconds_bucket{url="http://ads",le="0.05"} 1`,
+		`vistar_ad_request_duration_seconds_bucket{url="http://ads",le="2.5"} 2`,
+		`vistar_ad_request_duration_seconds_bucket{url="http://ads",le="+Inf"} 2`,
+		`vistar_ad_request_duration_seconds_sum{url="http://ads"} 2.03`,
+		`vistar_ad_request_duration_seconds_count{url="http://ads"} 2`,
+		"vistar_ads_returned_total 2",
+		"vistar_empty_ad_responses_total 1",
+		"vistar_cache_failures_total 1",
+		`vistar_bytes_sent_total{url="http://ads"} 100`,
+		`vistar_bytes_received_total{url="http://ads"} 1024`,
+		`vistar_confirms_total{result="failure"} 1`,
+		`vistar_confirms_total{result="success"} 1`,
+		`vistar_expires_total{result="failure"} 1`,
+		`vistar_pop_failures_total{type="confirm",code="500"} 1`,
+		`vistar_pop_failures_total{type="expire",code="error"} 1`,
+	} {
+		assert.Contains(t, out, line+"\n")
+	}
+}
+
+func TestCollectorEscapesLabels(t *testing.T) {
+	c := NewCollector()
+	c.Bytes("http://ads/\"quoted\"\\", 1, 1)
+
+	var b strings.Builder
+	c.WriteTo(&b)
+
+	assert.Contains(t, b.String(),
+		`vistar_bytes_sent_total{url="http://ads/\"quoted\"\\"} 1`)
+}
+
+func TestCollectorServesClientActivity(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"advertisement": [{"id": "1", ` +
+				`"expiration_url": "expire-url"}]}`))
+		}),
+	)
+	defer ts.Close()
+
+	c := NewCollector()
+	client := vistar.NewClient(&vistar.ClientConfig{
+		ReqTimeout: time.Second,
+		Metrics:    c,
+		PoPFn: func(method string, url string,
+			data *vistar.ProofOfPlayRequest) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		},
+	})
+	defer client.Close()
+
+	data, _ := vistar.NewDataBuilder("api-key", "network", "device").
+		DisplayArea("a", 1920, 1080, "image/jpeg").
+		Build()
+	_, err := client.GetAd(vistar.NewRequest(ts.URL, "", data, false, 0))
+	assert.Nil(t, err)
+	client.Expire("1")
+
+	handler := httptest.NewServer(c)
+	defer handler.Close()
+
+	resp, err := http.Get(handler.URL)
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assert.Equal(t, resp.Header.Get("Content-Type"),
+		"text/plain; version=0.0.4")
+	assert.Contains(t, string(body),
+		`vistar_ad_requests_total{url="`+ts.URL+`",code="200"} 1`)
+	assert.Contains(t, string(body), "vistar_ads_returned_total 1\n")
+	assert.Contains(t, string(body), `vistar_expires_total{result="success"} 1`)
+}
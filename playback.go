@@ -0,0 +1,226 @@
+package vistar
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DefaultDisplayTimeSkew is how far a display time may be before the ad was
+// received or after the present, to allow for clock adjustments.
+var DefaultDisplayTimeSkew = time.Minute
+
+// IncompletePlaybackError is returned by ConfirmPlayed when the ad played
+// for less than its required completion, and was expired instead of
+// confirmed.
+type IncompletePlaybackError struct {
+	AdId               string
+	Played             time.Duration
+	Length             time.Duration
+	RequiredCompletion float64
+}
+
+func (e *IncompletePlaybackError) Error() string {
+	return fmt.Sprintf("ad %s played for %s of %s, %g required", e.AdId,
+		e.Played, e.Length, e.RequiredCompletion)
+}
+
+// adPlayback is what the client knows about an in progress ad besides what
+// the ad server returned.
+type adPlayback struct {
+	leasedAt           time.Time
+	requiredCompletion float64
+	state              AdState
+	since              time.Time
+	startedAt          time.Time
+	played             time.Duration
+}
+
+func (p *adPlayback) status() AdStatus {
+	return AdStatus{
+		State:     p.state,
+		Since:     p.since,
+		StartedAt: p.startedAt,
+		Played:    p.played,
+	}
+}
+
+func (c *client) ConfirmPlayed(adId string, displayTime int64,
+	played time.Duration) (string, error) {
+	return c.ConfirmPlayedContext(context.Background(), adId, displayTime,
+		played)
+}
+
+// ConfirmPlayedContext confirms the ad if it played for at least the
+// required completion of the request it was returned for, and expires it
+// otherwise. The check is skipped if the ad does not have a length.
+func (c *client) ConfirmPlayedContext(ctx context.Context, adId string,
+	displayTime int64, played time.Duration) (string, error) {
+	displayTime = c.resolveDisplayTime(adId, displayTime)
+	errs := c.validateConfirm(adId, displayTime)
+	if played < 0 {
+		errs.add("played", "must not be negative")
+	}
+
+	if err := errs.errorOrNil(); err != nil {
+		return "", err
+	}
+
+	playback, _ := c.playbackOf(adId)
+	ad, err := c.finalize(adId)
+	if err != nil {
+		return "", err
+	}
+
+	incomplete := c.checkCompletion(adId, ad, playback, played)
+	if incomplete == nil {
+		c.finishPlayback(adId, AdStateConfirmed)
+		err = c.pop.ConfirmContext(ctx, ad, displayTime)
+		return originalAssetUrl(ad), err
+	}
+
+	if err := c.pop.ExpireContext(ctx, ad); err != nil {
+		return originalAssetUrl(ad), err
+	}
+	return originalAssetUrl(ad), incomplete
+}
+
+// checkCompletion returns an *IncompletePlaybackError if the ad played for
+// less than its required completion, after moving it to expired.
+func (c *client) checkCompletion(adId string, ad Ad, playback adPlayback,
+	played time.Duration) error {
+	length := adLength(ad)
+	required := time.Duration(playback.requiredCompletion * float64(length))
+	if played >= required {
+		return nil
+	}
+
+	c.finishPlayback(adId, AdStateExpired)
+	c.publishEvent(Event{
+		Name:  EventAdPlaybackIncomplete,
+		Level: EventLevelInfo,
+		Message: fmt.Sprintf("adId: %s, played: %s, required: %s", adId,
+			played, required),
+		AdId:     adId,
+		Duration: played,
+		Fields: map[string]interface{}{
+			"length":              length.Seconds(),
+			"required_completion": playback.requiredCompletion,
+		},
+	})
+
+	return &IncompletePlaybackError{
+		AdId:               adId,
+		Played:             played,
+		Length:             length,
+		RequiredCompletion: playback.requiredCompletion,
+	}
+}
+
+// resolveDisplayTime replaces a display time of 0 with the time the ad was
+// marked as playing, or with the present if it wasn't, whether or not the
+// ad was received by this client.
+func (c *client) resolveDisplayTime(adId string, displayTime int64) int64 {
+	if displayTime != 0 {
+		return displayTime
+	}
+
+	if playback, ok := c.playbackOf(adId); ok && !playback.startedAt.IsZero() {
+		return playback.startedAt.Unix()
+	}
+	return time.Now().Unix()
+}
+
+// validateConfirm checks that the display time is within the lease of the
+// ad. An ad that is not in progress is left to finalize to report.
+func (c *client) validateConfirm(adId string,
+	displayTime int64) ValidationErrors {
+	errs := ValidationErrors{}
+	ad, ok := c.GetInProgressAds()[adId]
+	if !ok {
+		return errs
+	}
+
+	if displayTime < 0 {
+		errs.add("display_time", "must not be negative")
+		return errs
+	}
+
+	if expiry := leaseExpiry(ad); expiry != 0 && displayTime > expiry {
+		errs.add("display_time", "%d is after the lease expiry %d",
+			displayTime, expiry)
+	}
+
+	playback, ok := c.playbackOf(adId)
+	if ok && displayTime < playback.leasedAt.Add(-c.displayTimeSkew).Unix() {
+		errs.add("display_time", "%d is before the ad was received at %d",
+			displayTime, playback.leasedAt.Unix())
+	}
+
+	if displayTime > time.Now().Add(c.displayTimeSkew).Unix() {
+		errs.add("display_time", "%d is in the future", displayTime)
+	}
+	return errs
+}
+
+// trackPlayback records when the ads were received and the completion the
+// request required of them.
+func (c *client) trackPlayback(resp *AdResponse, leasedAt time.Time,
+	data *Data) {
+	c.playbackLock.Lock()
+	defer c.playbackLock.Unlock()
+
+	if c.playback == nil {
+		c.playback = make(map[string]*adPlayback)
+	}
+
+	for _, ad := range resp.Advertisement {
+		adId, ok := ad["id"].(string)
+		if !ok {
+			continue
+		}
+
+		playback := &adPlayback{
+			leasedAt: leasedAt,
+			state:    AdStateLeased,
+			since:    leasedAt,
+		}
+		if data != nil {
+			playback.requiredCompletion = data.RequiredCompletion
+		}
+		c.playback[adId] = playback
+	}
+}
+
+// playbackOf returns a copy of the ad's playback, or its zero value if the
+// ad was not received by this client, such as after a restart.
+func (c *client) playbackOf(adId string) (adPlayback, bool) {
+	c.playbackLock.Lock()
+	defer c.playbackLock.Unlock()
+
+	playback, ok := c.playback[adId]
+	if !ok {
+		return adPlayback{}, false
+	}
+	return *playback, true
+}
+
+func (c *client) forgetPlayback(adId string) {
+	c.playbackLock.Lock()
+	defer c.playbackLock.Unlock()
+
+	delete(c.playback, adId)
+}
+
+// adLength returns the length of the ad, or 0 if the ad server did not
+// return it.
+func adLength(ad Ad) time.Duration {
+	if ms, ok := ad["length_in_milliseconds"].(float64); ok && ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+
+	if seconds, ok := ad["length_in_seconds"].(float64); ok && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	return 0
+}
@@ -0,0 +1,183 @@
+package vistar
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cortexsystems/vistar-go-client/vistartest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfirmValidatesDisplayTime(t *testing.T) {
+	server := vistartest.NewServer(&vistartest.ServerConfig{
+		AdsPerDisplayArea: 2,
+		LeaseDuration:     time.Hour,
+	})
+	defer server.Close()
+
+	client := NewClient(&ClientConfig{ReqTimeout: time.Second})
+	defer client.Close()
+
+	_, err := client.GetAd(NewRequest(server.AdUrl(), "", newTestData(), false, 0))
+	assert.Nil(t, err)
+
+	now := time.Now()
+	for _, displayTime := range []int64{
+		-1,
+		now.Add(-time.Hour).Unix(),
+		now.Add(30 * time.Minute).Unix(),
+		now.Add(2 * time.Hour).Unix(),
+	} {
+		_, err = client.Confirm("ad-1", displayTime)
+		errs, ok := err.(ValidationErrors)
+		assert.True(t, ok, "display time %d", displayTime)
+		assert.Equal(t, errs[0].Field, "display_time")
+	}
+
+	_, err = client.ConfirmAsync("ad-1", -1)
+	assert.NotNil(t, err)
+	assert.Contains(t, client.GetInProgressAds(), "ad-1")
+
+	_, err = client.Confirm("ad-1", now.Unix())
+	assert.Nil(t, err)
+	assert.Equal(t, server.Confirmed(), []string{"ad-1"})
+}
+
+func TestConfirmPlayedExpiresIncompletePlayback(t *testing.T) {
+	server := vistartest.NewServer(&vistartest.ServerConfig{
+		AdsPerDisplayArea: 3,
+		LengthInSeconds:   10,
+	})
+	defer server.Close()
+
+	var events []Event
+	client := NewClient(&ClientConfig{
+		ReqTimeout: time.Second,
+		EventHandler: EventHandlerFunc(func(event Event) {
+			if event.Level > EventLevelDebug {
+				events = append(events, event)
+			}
+		}),
+	})
+	defer client.Close()
+
+	data := newTestData()
+	data.RequiredCompletion = 0.8
+	_, err := client.GetAd(NewRequest(server.AdUrl(), "", data, false, 0))
+	assert.Nil(t, err)
+
+	now := time.Now().Unix()
+	_, err = client.ConfirmPlayed("ad-1", now, 8*time.Second)
+	assert.Nil(t, err)
+
+	_, err = client.ConfirmPlayed("ad-2", now, 5*time.Second)
+	assert.Equal(t, err, &IncompletePlaybackError{
+		AdId:               "ad-2",
+		Played:             5 * time.Second,
+		Length:             10 * time.Second,
+		RequiredCompletion: 0.8,
+	})
+
+	_, err = client.ConfirmPlayed("ad-3", now, -time.Second)
+	errs, ok := err.(ValidationErrors)
+	assert.True(t, ok)
+	assert.Equal(t, errs[0].Field, "played")
+
+	assert.Equal(t, server.Confirmed(), []string{"ad-1"})
+	assert.Equal(t, server.Expired(), []string{"ad-2"})
+	assert.Equal(t, server.Pending(), []string{"ad-3"})
+
+	assert.Len(t, events, 1)
+	assert.Equal(t, events[0].Name, EventAdPlaybackIncomplete)
+	assert.Equal(t, events[0].AdId, "ad-2")
+}
+
+func TestConfirmChecksCompletionOfPlayedAds(t *testing.T) {
+	server := vistartest.NewServer(&vistartest.ServerConfig{
+		AdsPerDisplayArea: 2,
+		LengthInSeconds:   15,
+	})
+	defer server.Close()
+
+	client := NewClient(&ClientConfig{ReqTimeout: time.Second})
+	defer client.Close()
+
+	data := newTestData()
+	data.RequiredCompletion = 1
+	_, err := client.GetAd(NewRequest(server.AdUrl(), "", data, false, 0))
+	assert.Nil(t, err)
+
+	for _, adId := range []string{"ad-1", "ad-2"} {
+		assert.Nil(t, client.MarkPlaying(adId))
+		assert.Nil(t, client.MarkPlayed(adId, time.Second))
+	}
+
+	_, err = client.Confirm("ad-1", 0)
+	assert.Equal(t, err, &IncompletePlaybackError{
+		AdId:               "ad-1",
+		Played:             time.Second,
+		Length:             15 * time.Second,
+		RequiredCompletion: 1,
+	})
+
+	future, err := client.ConfirmAsync("ad-2", 0)
+	assert.Nil(t, err)
+	_, ok := future.Wait(context.Background()).(*IncompletePlaybackError)
+	assert.True(t, ok)
+
+	assert.Empty(t, server.Confirmed())
+	assert.Equal(t, server.Expired(), []string{"ad-1", "ad-2"})
+}
+
+func TestConfirmPlayedWithoutPlaybackInfo(t *testing.T) {
+	pop := NewTestProofOfPlay()
+	client := &client{
+		pop:        pop,
+		inProgress: NewMemoryInProgressStore(),
+	}
+
+	// An ad that was not received by this client, such as after a restart,
+	// is confirmed without a completion check.
+	client.addToInProgressList(Ad{"id": "1", "length_in_seconds": 15.0})
+	_, err := client.ConfirmPlayed("1", 100, time.Second)
+	assert.Nil(t, err)
+	assert.Len(t, pop.requests, 1)
+	assert.True(t, pop.requests[0].Status)
+}
+
+func TestConfirmDefaultsDisplayTimeToNow(t *testing.T) {
+	pop := NewTestProofOfPlay()
+	client := &client{
+		pop:             pop,
+		inProgress:      NewMemoryInProgressStore(),
+		displayTimeSkew: DefaultDisplayTimeSkew,
+	}
+
+	// A display time of 0 is sent as the time of the confirm, both for an ad
+	// received by this client and for one that was not.
+	client.addToInProgressList(Ad{"id": "1"})
+	client.trackPlayback(&AdResponse{Advertisement: []Ad{{"id": "1"}}},
+		time.Now(), nil)
+	client.addToInProgressList(Ad{"id": "2"})
+
+	before := time.Now().Unix()
+	_, err := client.Confirm("1", 0)
+	assert.Nil(t, err)
+	_, err = client.Confirm("2", 0)
+	assert.Nil(t, err)
+
+	assert.Len(t, pop.requests, 2)
+	for _, req := range pop.requests {
+		assert.True(t, req.DisplayTime >= before)
+		assert.True(t, req.DisplayTime <= time.Now().Unix())
+	}
+}
+
+func TestAdLength(t *testing.T) {
+	assert.Equal(t, adLength(Ad{"length_in_milliseconds": 7500.0}),
+		7500*time.Millisecond)
+	assert.Equal(t, adLength(Ad{"length_in_seconds": 1.5}),
+		1500*time.Millisecond)
+	assert.Equal(t, adLength(Ad{}), time.Duration(0))
+}
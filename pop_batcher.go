@@ -0,0 +1,303 @@
+package vistar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var DefaultPoPBatchSize = 50
+var DefaultPoPBatchMaxDelay = time.Second
+var DefaultPoPBatchConcurrency = 4
+
+var ErrPoPBatcherClosed = errors.New("Proof of play batcher is closed")
+
+type PoPBatchConfig struct {
+	// MaxBatchSize flushes the batch once it holds this many requests.
+	// Defaults to DefaultPoPBatchSize.
+	MaxBatchSize int
+	// MaxDelay flushes the batch at most this long after its first request.
+	// Defaults to DefaultPoPBatchMaxDelay.
+	MaxDelay time.Duration
+	// Concurrency is the number of requests sent at the same time, across
+	// batches. Defaults to DefaultPoPBatchConcurrency.
+	Concurrency int
+}
+
+// PoPFuture is the outcome of a confirm or expire that is sent later.
+type PoPFuture struct {
+	done chan struct{}
+	err  error
+}
+
+func newPoPFuture() *PoPFuture {
+	return &PoPFuture{done: make(chan struct{})}
+}
+
+func resolvedPoPFuture(err error) *PoPFuture {
+	f := newPoPFuture()
+	f.resolve(err)
+	return f
+}
+
+func (f *PoPFuture) resolve(err error) {
+	f.err = err
+	close(f.done)
+}
+
+// Done is closed once the request has been sent.
+func (f *PoPFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the request has been sent and returns its error, or
+// returns the context's error if it is done first.
+func (f *PoPFuture) Wait(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type popBatchItem struct {
+	key         string
+	ad          Ad
+	confirm     bool
+	displayTime int64
+	coalesced   int
+	future      *PoPFuture
+}
+
+// popBatcher is a ProofOfPlay that collects confirms and expires into
+// batches and sends each batch with bounded concurrency. A confirm or expire
+// of an ad that is already waiting in the batch is coalesced with it and
+// shares its outcome.
+type popBatcher struct {
+	pop          ProofOfPlay
+	events       EventHandler
+	maxBatchSize int
+	maxDelay     time.Duration
+	sem          chan struct{}
+	lock         sync.Mutex
+	pending      []*popBatchItem
+	byKey        map[string]*popBatchItem
+	timer        *time.Timer
+	closed       bool
+	wg           sync.WaitGroup
+}
+
+func NewPoPBatcher(pop ProofOfPlay, events EventHandler,
+	config *PoPBatchConfig) *popBatcher {
+	b := &popBatcher{
+		pop:          pop,
+		events:       events,
+		maxBatchSize: config.MaxBatchSize,
+		maxDelay:     config.MaxDelay,
+		byKey:        make(map[string]*popBatchItem),
+	}
+
+	if b.maxBatchSize <= 0 {
+		b.maxBatchSize = DefaultPoPBatchSize
+	}
+
+	if b.maxDelay <= 0 {
+		b.maxDelay = DefaultPoPBatchMaxDelay
+	}
+
+	concurrency := config.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultPoPBatchConcurrency
+	}
+	b.sem = make(chan struct{}, concurrency)
+	return b
+}
+
+func (b *popBatcher) Expire(ad Ad) error {
+	return b.ExpireContext(context.Background(), ad)
+}
+
+// ExpireContext waits until the batch holding the request has been sent,
+// ctx only bounds the wait.
+func (b *popBatcher) ExpireContext(ctx context.Context, ad Ad) error {
+	return b.ExpireAsync(ad).Wait(ctx)
+}
+
+func (b *popBatcher) Confirm(ad Ad, displayTime int64) error {
+	return b.ConfirmContext(context.Background(), ad, displayTime)
+}
+
+// ConfirmContext waits until the batch holding the request has been sent,
+// ctx only bounds the wait.
+func (b *popBatcher) ConfirmContext(ctx context.Context, ad Ad,
+	displayTime int64) error {
+	return b.ConfirmAsync(ad, displayTime).Wait(ctx)
+}
+
+func (b *popBatcher) ExpireAsync(ad Ad) *PoPFuture {
+	return b.enqueue(&popBatchItem{ad: ad})
+}
+
+func (b *popBatcher) ConfirmAsync(ad Ad, displayTime int64) *PoPFuture {
+	return b.enqueue(&popBatchItem{
+		ad:          ad,
+		confirm:     true,
+		displayTime: displayTime,
+	})
+}
+
+// Flush sends the current batch without waiting for it to fill up.
+func (b *popBatcher) Flush() {
+	b.lock.Lock()
+	batch := b.takeLocked()
+	b.lock.Unlock()
+
+	b.dispatch(batch)
+}
+
+// Close sends the current batch, waits until every batch has been sent, and
+// closes the wrapped ProofOfPlay if it is an io.Closer.
+func (b *popBatcher) Close() error {
+	b.lock.Lock()
+	b.closed = true
+	batch := b.takeLocked()
+	b.lock.Unlock()
+
+	b.dispatch(batch)
+	b.wg.Wait()
+
+	if closer, ok := b.pop.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (b *popBatcher) enqueue(item *popBatchItem) *PoPFuture {
+	kind := "expire"
+	if item.confirm {
+		kind = "confirm"
+	}
+
+	if adId, ok := item.ad["id"].(string); ok {
+		item.key = kind + ":" + adId
+	}
+
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return resolvedPoPFuture(ErrPoPBatcherClosed)
+	}
+
+	if existing, ok := b.byKey[item.key]; ok && item.key != "" {
+		existing.coalesced++
+		b.lock.Unlock()
+		return existing.future
+	}
+
+	item.future = newPoPFuture()
+	b.pending = append(b.pending, item)
+	if item.key != "" {
+		b.byKey[item.key] = item
+	}
+
+	var batch []*popBatchItem
+	if len(b.pending) >= b.maxBatchSize {
+		batch = b.takeLocked()
+	} else if b.timer == nil {
+		b.timer = time.AfterFunc(b.maxDelay, b.Flush)
+	}
+	b.lock.Unlock()
+
+	b.dispatch(batch)
+	return item.future
+}
+
+func (b *popBatcher) takeLocked() []*popBatchItem {
+	batch := b.pending
+	b.pending = nil
+	b.byKey = make(map[string]*popBatchItem)
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	return batch
+}
+
+func (b *popBatcher) dispatch(batch []*popBatchItem) {
+	if len(batch) == 0 {
+		return
+	}
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		b.send(batch)
+	}()
+}
+
+// send sends the requests of the batch without a caller's context, since
+// the callers may have stopped waiting for them.
+func (b *popBatcher) send(batch []*popBatchItem) {
+	start := time.Now()
+	var wg sync.WaitGroup
+	var failed int64
+	coalesced := 0
+	for _, item := range batch {
+		coalesced += item.coalesced
+
+		b.sem <- struct{}{}
+		wg.Add(1)
+		go func(item *popBatchItem) {
+			defer wg.Done()
+			defer func() { <-b.sem }()
+
+			err := b.sendItem(item)
+			if err != nil {
+				atomic.AddInt64(&failed, 1)
+			}
+			item.future.resolve(err)
+		}(item)
+	}
+	wg.Wait()
+
+	publishEvent(b.events, Event{
+		Name:  EventPoPBatchSent,
+		Level: EventLevelDebug,
+		Message: fmt.Sprintf("requests: %d, failed: %d, coalesced: %d",
+			len(batch), failed, coalesced),
+		Duration: time.Since(start),
+		Fields: map[string]interface{}{
+			"requests":  len(batch),
+			"failed":    failed,
+			"coalesced": coalesced,
+		},
+	})
+}
+
+func (b *popBatcher) sendItem(item *popBatchItem) error {
+	ctx := context.Background()
+	var err error
+	if item.confirm {
+		err = b.pop.ConfirmContext(ctx, item.ad, item.displayTime)
+	} else {
+		err = b.pop.ExpireContext(ctx, item.ad)
+	}
+
+	if err != nil {
+		adId, _ := item.ad["id"].(string)
+		publishEvent(b.events, Event{
+			Name:    EventAdPoPBatchFailed,
+			Level:   EventLevelWarning,
+			Message: fmt.Sprintf("adId: %s, error: %s", adId, err.Error()),
+			AdId:    adId,
+			Err:     err,
+			Fields:  map[string]interface{}{"confirm": item.confirm},
+		})
+	}
+	return err
+}
@@ -0,0 +1,275 @@
+package vistar
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cortexsystems/vistar-go-client/vistartest"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingProofOfPlay records the requests it receives and holds them until
+// release is closed.
+type blockingProofOfPlay struct {
+	lock        sync.Mutex
+	requests    []*PoPRequest
+	inFlight    int
+	maxInFlight int
+	release     chan struct{}
+	err         error
+}
+
+func newBlockingProofOfPlay() *blockingProofOfPlay {
+	return &blockingProofOfPlay{release: make(chan struct{})}
+}
+
+func (p *blockingProofOfPlay) send(popReq *PoPRequest) error {
+	p.lock.Lock()
+	p.requests = append(p.requests, popReq)
+	p.inFlight++
+	if p.inFlight > p.maxInFlight {
+		p.maxInFlight = p.inFlight
+	}
+	p.lock.Unlock()
+
+	<-p.release
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.inFlight--
+	return p.err
+}
+
+func (p *blockingProofOfPlay) Expire(ad Ad) error {
+	return p.ExpireContext(context.Background(), ad)
+}
+
+func (p *blockingProofOfPlay) ExpireContext(ctx context.Context,
+	ad Ad) error {
+	return p.send(&PoPRequest{Ad: ad})
+}
+
+func (p *blockingProofOfPlay) Confirm(ad Ad, displayTime int64) error {
+	return p.ConfirmContext(context.Background(), ad, displayTime)
+}
+
+func (p *blockingProofOfPlay) ConfirmContext(ctx context.Context, ad Ad,
+	displayTime int64) error {
+	return p.send(&PoPRequest{Ad: ad, Status: true, DisplayTime: displayTime})
+}
+
+func (p *blockingProofOfPlay) count() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return len(p.requests)
+}
+
+func TestPoPBatcherFlushesFullBatch(t *testing.T) {
+	pop := newBlockingProofOfPlay()
+	close(pop.release)
+	batcher := NewPoPBatcher(pop, nil, &PoPBatchConfig{
+		MaxBatchSize: 3,
+		MaxDelay:     time.Hour,
+	})
+	defer batcher.Close()
+
+	first := batcher.ConfirmAsync(Ad{"id": "1"}, 10)
+	second := batcher.ExpireAsync(Ad{"id": "2"})
+	select {
+	case <-first.Done():
+		t.Fatal("batch sent before it was full")
+	case <-time.After(20 * time.Millisecond):
+	}
+	assert.Equal(t, pop.count(), 0)
+
+	third := batcher.ConfirmAsync(Ad{"id": "3"}, 10)
+	ctx := context.Background()
+	assert.Nil(t, first.Wait(ctx))
+	assert.Nil(t, second.Wait(ctx))
+	assert.Nil(t, third.Wait(ctx))
+	assert.Equal(t, pop.count(), 3)
+}
+
+func TestPoPBatcherFlushesAfterMaxDelay(t *testing.T) {
+	pop := newBlockingProofOfPlay()
+	close(pop.release)
+	batcher := NewPoPBatcher(pop, nil, &PoPBatchConfig{
+		MaxDelay: 20 * time.Millisecond,
+	})
+	defer batcher.Close()
+
+	start := time.Now()
+	assert.Nil(t, batcher.Confirm(Ad{"id": "1"}, 10))
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+	assert.Equal(t, pop.count(), 1)
+}
+
+func TestPoPBatcherCoalescesRequests(t *testing.T) {
+	pop := newBlockingProofOfPlay()
+	close(pop.release)
+
+	var events []Event
+	var lock sync.Mutex
+	batcher := NewPoPBatcher(pop, EventHandlerFunc(func(event Event) {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, event)
+	}), &PoPBatchConfig{MaxDelay: time.Hour})
+
+	first := batcher.ConfirmAsync(Ad{"id": "1"}, 10)
+	second := batcher.ConfirmAsync(Ad{"id": "1"}, 10)
+	expire := batcher.ExpireAsync(Ad{"id": "1"})
+	assert.True(t, first == second)
+	assert.False(t, first == expire)
+
+	batcher.Flush()
+	assert.Nil(t, first.Wait(context.Background()))
+	assert.Nil(t, batcher.Close())
+	assert.Equal(t, pop.count(), 2)
+
+	assert.Len(t, events, 1)
+	assert.Equal(t, events[0].Name, EventPoPBatchSent)
+	assert.Equal(t, events[0].Fields["requests"], 2)
+	assert.Equal(t, events[0].Fields["coalesced"], 1)
+}
+
+func TestPoPBatcherBoundsConcurrency(t *testing.T) {
+	pop := newBlockingProofOfPlay()
+	batcher := NewPoPBatcher(pop, nil, &PoPBatchConfig{
+		MaxBatchSize: 2,
+		Concurrency:  3,
+	})
+
+	futures := make([]*PoPFuture, 0)
+	for _, id := range []string{"1", "2", "3", "4", "5", "6"} {
+		futures = append(futures, batcher.ConfirmAsync(Ad{"id": id}, 10))
+	}
+
+	waitFor(t, func() bool { return pop.count() == 3 })
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, pop.count(), 3)
+
+	close(pop.release)
+	for _, future := range futures {
+		assert.Nil(t, future.Wait(context.Background()))
+	}
+	assert.Nil(t, batcher.Close())
+	assert.Equal(t, pop.maxInFlight, 3)
+}
+
+func TestPoPBatcherReportsFailures(t *testing.T) {
+	pop := newBlockingProofOfPlay()
+	pop.err = errors.New("connection refused")
+	close(pop.release)
+
+	var events []Event
+	var lock sync.Mutex
+	batcher := NewPoPBatcher(pop, EventHandlerFunc(func(event Event) {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, event)
+	}), &PoPBatchConfig{})
+
+	future := batcher.ExpireAsync(Ad{"id": "1"})
+	assert.Nil(t, batcher.Close())
+	assert.Equal(t, future.Wait(context.Background()), pop.err)
+
+	assert.Len(t, events, 2)
+	assert.Equal(t, events[0].Name, EventAdPoPBatchFailed)
+	assert.Equal(t, events[0].AdId, "1")
+	assert.Equal(t, events[1].Fields["failed"], int64(1))
+
+	err := batcher.Confirm(Ad{"id": "2"}, 10)
+	assert.Equal(t, err, ErrPoPBatcherClosed)
+}
+
+func TestPoPFutureWaitContext(t *testing.T) {
+	future := newPoPFuture()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, future.Wait(ctx), context.Canceled)
+
+	future.resolve(nil)
+	assert.Nil(t, future.Wait(context.Background()))
+}
+
+func TestClientBatchesProofOfPlay(t *testing.T) {
+	server := vistartest.NewServer(&vistartest.ServerConfig{
+		AdsPerDisplayArea: 3,
+	})
+	defer server.Close()
+
+	client := NewClient(&ClientConfig{
+		ReqTimeout: time.Second,
+		PoPBatch:   &PoPBatchConfig{MaxDelay: time.Hour},
+	})
+
+	_, err := client.GetAd(NewRequest(server.AdUrl(), "", newTestData(), false, 0))
+	assert.Nil(t, err)
+
+	confirm, err := client.ConfirmAsync("ad-1", time.Now().Unix())
+	assert.Nil(t, err)
+	expire, err := client.ExpireAsync("ad-2")
+	assert.Nil(t, err)
+	_, err = client.ConfirmAsync("ad-1", time.Now().Unix())
+	assert.Equal(t, err, ErrAlreadyFinalized)
+
+	assert.Len(t, server.Confirmed(), 0)
+	client.Close()
+
+	assert.Nil(t, confirm.Wait(context.Background()))
+	assert.Nil(t, expire.Wait(context.Background()))
+	assert.Equal(t, server.Confirmed(), []string{"ad-1"})
+	assert.Equal(t, server.Expired(), []string{"ad-2"})
+}
+
+func TestClientDoesNotWaitForBatchedExpires(t *testing.T) {
+	server := vistartest.NewServer(&vistartest.ServerConfig{
+		AdsPerDisplayArea: 5,
+	})
+	defer server.Close()
+
+	client := NewClient(&ClientConfig{
+		ReqTimeout: time.Second,
+		PoPBatch:   &PoPBatchConfig{MaxDelay: 500 * time.Millisecond},
+		CacheFn: func(url string, ttl time.Duration) (string, error) {
+			return "", errors.New("disk full")
+		},
+	})
+
+	start := time.Now()
+	resp, err := client.GetAd(NewRequest(server.AdUrl(), "", newTestData(),
+		false, 0))
+	assert.Nil(t, err)
+	assert.Len(t, resp.Advertisement, 0)
+	assert.True(t, time.Since(start) < 250*time.Millisecond)
+
+	client.Close()
+	assert.Len(t, server.Expired(), 5)
+}
+
+func TestExpireOnCloseDoesNotWaitPerAd(t *testing.T) {
+	server := vistartest.NewServer(&vistartest.ServerConfig{
+		AdsPerDisplayArea: 5,
+	})
+	defer server.Close()
+
+	client := NewClient(&ClientConfig{
+		ReqTimeout:    time.Second,
+		ExpireOnClose: true,
+		PoPBatch:      &PoPBatchConfig{MaxDelay: 500 * time.Millisecond},
+	})
+
+	_, err := client.GetAd(NewRequest(server.AdUrl(), "", newTestData(),
+		false, 0))
+	assert.Nil(t, err)
+
+	start := time.Now()
+	client.Close()
+	assert.True(t, time.Since(start) < 250*time.Millisecond)
+	assert.Len(t, server.Expired(), 5)
+}
@@ -0,0 +1,385 @@
+package vistar
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var PoPQueueFileName = "pop_queue.log"
+var DefaultPoPQueueBaseDelay = 5 * time.Second
+var DefaultPoPQueueMaxDelay = 10 * time.Minute
+
+type PoPQueueConfig struct {
+	Dir       string
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+type popQueueRecord struct {
+	Id          int64       `json:"id"`
+	Done        bool        `json:"done,omitempty"`
+	Request     *PoPRequest `json:"request,omitempty"`
+	LeaseExpiry int64       `json:"lease_expiry,omitempty"`
+}
+
+type popQueueEntry struct {
+	record      *popQueueRecord
+	attempts    int
+	nextAttempt time.Time
+	inFlight    bool
+}
+
+// popQueue is a ProofOfPlay that records every confirm and expire in an
+// append-only file before sending it, and keeps retrying failed requests
+// until they succeed or the ad's lease expires.
+type popQueue struct {
+	pop       *proofOfPlay
+	log       *appendLog
+	baseDelay time.Duration
+	maxDelay  time.Duration
+	now       func() time.Time
+	lock      sync.Mutex
+	nextId    int64
+	pending   map[int64]*popQueueEntry
+	closeOnce sync.Once
+	closeErr  error
+	closeCh   chan struct{}
+	doneCh    chan struct{}
+}
+
+func NewPoPQueue(pop *proofOfPlay, config *PoPQueueConfig) (*popQueue,
+	error) {
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(config.Dir, PoPQueueFileName)
+	q := &popQueue{
+		pop:       pop,
+		log:       newAppendLog(path),
+		baseDelay: config.BaseDelay,
+		maxDelay:  config.MaxDelay,
+		now:       time.Now,
+		pending:   make(map[int64]*popQueueEntry),
+		closeCh:   make(chan struct{}),
+		doneCh:    make(chan struct{}),
+	}
+
+	if q.baseDelay <= 0 {
+		q.baseDelay = DefaultPoPQueueBaseDelay
+	}
+
+	if q.maxDelay <= 0 {
+		q.maxDelay = DefaultPoPQueueMaxDelay
+	}
+
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+
+	go q.processRetries()
+	return q, nil
+}
+
+func (q *popQueue) Expire(ad Ad) error {
+	return q.ExpireContext(context.Background(), ad)
+}
+
+func (q *popQueue) ExpireContext(ctx context.Context, ad Ad) error {
+	popReq, err := q.pop.expireRequest(ad)
+	if err != nil {
+		return err
+	}
+
+	return q.enqueue(ctx, popReq, leaseExpiry(ad))
+}
+
+func (q *popQueue) Confirm(ad Ad, displayTime int64) error {
+	return q.ConfirmContext(context.Background(), ad, displayTime)
+}
+
+func (q *popQueue) ConfirmContext(ctx context.Context, ad Ad,
+	displayTime int64) error {
+	popReq, err := q.pop.confirmRequest(ad, displayTime)
+	if err != nil {
+		return err
+	}
+
+	return q.enqueue(ctx, popReq, leaseExpiry(ad))
+}
+
+// Close can be called more than once, later calls return the error of the
+// first.
+func (q *popQueue) Close() error {
+	q.closeOnce.Do(func() {
+		q.closeErr = q.close()
+	})
+	return q.closeErr
+}
+
+func (q *popQueue) close() error {
+	close(q.closeCh)
+	<-q.doneCh
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if err := q.compactLocked(); err != nil {
+		return err
+	}
+	return q.log.close()
+}
+
+func (q *popQueue) Pending() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return len(q.pending)
+}
+
+// enqueue persists the request and makes the first attempt right away. Once
+// the request is on disk, a failed attempt is not reported to the caller
+// because delivery is retried in the background.
+func (q *popQueue) enqueue(ctx context.Context, popReq *PoPRequest,
+	leaseExpiry int64) error {
+	q.lock.Lock()
+	record := &popQueueRecord{
+		Id:          q.nextId,
+		Request:     popReq,
+		LeaseExpiry: leaseExpiry,
+	}
+	q.nextId++
+
+	if err := q.log.append(record); err != nil {
+		q.lock.Unlock()
+		return err
+	}
+
+	entry := &popQueueEntry{record: record, inFlight: true}
+	q.pending[record.Id] = entry
+	q.lock.Unlock()
+
+	return q.attempt(ctx, entry)
+}
+
+// attempt sends the request once. It returns an error only if the server
+// rejected the request permanently, in which case it is dropped.
+func (q *popQueue) attempt(ctx context.Context, entry *popQueueEntry) error {
+	status, header, err := q.pop.send(ctx, entry.record.Request)
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	entry.inFlight = false
+	if isPermanentRejection(status) {
+		q.pop.publishEvent(Event{
+			Name:  EventAdPoPDropped,
+			Level: EventLevelWarning,
+			Message: fmt.Sprintf("adId: %s, code: %d",
+				entry.record.Request.AdId, status),
+			AdId:   entry.record.Request.AdId,
+			Url:    entry.record.Request.Url,
+			Status: status,
+			Err:    err,
+		})
+		q.markDoneLocked(entry)
+		if err == nil {
+			err = &PoPError{Status: status, Message: "Request rejected"}
+		}
+		return err
+	}
+
+	if err == nil && status < http.StatusBadRequest {
+		q.markDoneLocked(entry)
+		return nil
+	}
+
+	entry.attempts++
+	entry.nextAttempt = q.now().Add(q.delay(entry.attempts, header))
+	q.pop.publishEvent(Event{
+		Name:  EventAdPoPQueued,
+		Level: EventLevelInfo,
+		Message: fmt.Sprintf("adId: %s, attempts: %d, next attempt: %s",
+			entry.record.Request.AdId, entry.attempts,
+			entry.nextAttempt.Format(time.RFC3339)),
+		AdId:   entry.record.Request.AdId,
+		Url:    entry.record.Request.Url,
+		Status: status,
+		Err:    err,
+		Fields: map[string]interface{}{
+			"attempts":     entry.attempts,
+			"next_attempt": entry.nextAttempt,
+		},
+	})
+	return nil
+}
+
+// isPermanentRejection reports whether the server rejected the request for
+// good. Request Timeout and Too Many Requests are retried like server
+// errors.
+func isPermanentRejection(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return status >= http.StatusBadRequest &&
+		status < http.StatusInternalServerError
+}
+
+// delay returns how long to wait before the next attempt. A Retry-After
+// header takes precedence over the backoff, but is still capped at maxDelay.
+func (q *popQueue) delay(attempts int, header http.Header) time.Duration {
+	if after, ok := retryAfter(header, q.now()); ok {
+		if after > q.maxDelay {
+			return q.maxDelay
+		}
+		return after
+	}
+	return q.backoff(attempts)
+}
+
+func (q *popQueue) backoff(attempts int) time.Duration {
+	delay := q.baseDelay
+	for i := 1; i < attempts && delay < q.maxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > q.maxDelay {
+		delay = q.maxDelay
+	}
+	return delay
+}
+
+func (q *popQueue) processRetries() {
+	defer close(q.doneCh)
+
+	ticker := time.NewTicker(q.baseDelay)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			q.retryPending()
+		case <-q.closeCh:
+			return
+		}
+	}
+}
+
+func (q *popQueue) retryPending() {
+	now := q.now()
+
+	q.lock.Lock()
+	due := make([]*popQueueEntry, 0)
+	for _, entry := range q.pending {
+		if entry.inFlight || entry.nextAttempt.After(now) {
+			continue
+		}
+
+		expiry := entry.record.LeaseExpiry
+		if expiry > 0 && expiry <= now.Unix() {
+			q.pop.publishEvent(Event{
+				Name:  EventAdPoPAbandoned,
+				Level: EventLevelWarning,
+				Message: fmt.Sprintf("adId: %s, attempts: %d, lease expired",
+					entry.record.Request.AdId, entry.attempts),
+				AdId:   entry.record.Request.AdId,
+				Url:    entry.record.Request.Url,
+				Fields: map[string]interface{}{"attempts": entry.attempts},
+			})
+			q.markDoneLocked(entry)
+			continue
+		}
+
+		entry.inFlight = true
+		due = append(due, entry)
+	}
+	q.lock.Unlock()
+
+	for _, entry := range due {
+		q.attempt(context.Background(), entry)
+	}
+}
+
+func (q *popQueue) markDoneLocked(entry *popQueueEntry) {
+	delete(q.pending, entry.record.Id)
+
+	err := q.log.append(&popQueueRecord{Id: entry.record.Id, Done: true})
+	if err != nil {
+		q.pop.publishEvent(Event{
+			Name:    EventPoPQueueWriteFailed,
+			Level:   EventLevelWarning,
+			Message: err.Error(),
+			AdId:    entry.record.Request.AdId,
+			Err:     err,
+		})
+		return
+	}
+
+	if err := q.maybeCompactLocked(); err != nil {
+		q.pop.publishEvent(Event{
+			Name:    EventPoPQueueWriteFailed,
+			Level:   EventLevelWarning,
+			Message: err.Error(),
+			Err:     err,
+		})
+	}
+}
+
+// maybeCompactLocked keeps the file from growing forever on a long running
+// player, every request adds two records to it.
+func (q *popQueue) maybeCompactLocked() error {
+	if q.log.records > 2*len(q.pending)+1000 {
+		return q.compactLocked()
+	}
+	return nil
+}
+
+func (q *popQueue) load() error {
+	return q.log.load(func(line []byte) error {
+		record := &popQueueRecord{}
+		if err := json.Unmarshal(line, record); err != nil {
+			return err
+		}
+
+		if record.Id >= q.nextId {
+			q.nextId = record.Id + 1
+		}
+
+		if record.Done {
+			delete(q.pending, record.Id)
+		} else if record.Request != nil {
+			q.pending[record.Id] = &popQueueEntry{record: record}
+		}
+		return nil
+	})
+}
+
+func (q *popQueue) compact() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.compactLocked()
+}
+
+// compactLocked rewrites the file with only the pending records.
+func (q *popQueue) compactLocked() error {
+	return q.log.compact(func(encode func(interface{}) error) error {
+		for _, entry := range q.pending {
+			if err := encode(entry.record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,258 @@
+package vistar
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPoPQueue(t *testing.T, dir string,
+	popFn PoPFunc) *popQueue {
+	q, err := NewPoPQueue(NewProofOfPlay(nil, popFn), &PoPQueueConfig{
+		Dir:       dir,
+		BaseDelay: time.Hour,
+		MaxDelay:  4 * time.Hour,
+	})
+	assert.Nil(t, err)
+	return q
+}
+
+func TestPoPQueueConfirmSuccess(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pop-queue")
+	defer os.RemoveAll(dir)
+
+	calls := 0
+	q := newTestPoPQueue(t, dir, func(method string, url string,
+		data *ProofOfPlayRequest) (*http.Response, error) {
+		calls++
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+	defer q.Close()
+
+	err := q.Confirm(Ad{"id": "1", "proof_of_play_url": "pop-url"}, 100)
+
+	assert.Nil(t, err)
+	assert.Equal(t, calls, 1)
+	assert.Equal(t, q.Pending(), 0)
+}
+
+func TestPoPQueueCompacts(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pop-queue")
+	defer os.RemoveAll(dir)
+
+	q := newTestPoPQueue(t, dir, func(method string, url string,
+		data *ProofOfPlayRequest) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+	defer q.Close()
+
+	for i := 0; i < 1100; i++ {
+		q.Confirm(Ad{"id": "1", "proof_of_play_url": "pop-url"}, 100)
+	}
+
+	assert.True(t, q.log.records < 1100)
+}
+
+func TestPoPQueueRetriesUntilSuccess(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pop-queue")
+	defer os.RemoveAll(dir)
+
+	calls := 0
+	q := newTestPoPQueue(t, dir, func(method string, url string,
+		data *ProofOfPlayRequest) (*http.Response, error) {
+		calls++
+		if calls < 3 {
+			return nil, errors.New("network down")
+		}
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+	defer q.Close()
+
+	now := time.Now()
+	q.now = func() time.Time { return now }
+
+	err := q.Confirm(Ad{"id": "1", "proof_of_play_url": "pop-url"}, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, q.Pending(), 1)
+
+	// Not due yet.
+	q.retryPending()
+	assert.Equal(t, calls, 1)
+
+	now = now.Add(time.Hour)
+	q.retryPending()
+	assert.Equal(t, calls, 2)
+	assert.Equal(t, q.Pending(), 1)
+
+	// Backoff doubled to two hours.
+	now = now.Add(time.Hour)
+	q.retryPending()
+	assert.Equal(t, calls, 2)
+
+	now = now.Add(time.Hour)
+	q.retryPending()
+	assert.Equal(t, calls, 3)
+	assert.Equal(t, q.Pending(), 0)
+}
+
+func TestPoPQueueDropsRejectedRequest(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pop-queue")
+	defer os.RemoveAll(dir)
+
+	q := newTestPoPQueue(t, dir, func(method string, url string,
+		data *ProofOfPlayRequest) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusBadRequest,
+			Body:       ioutil.NopCloser(bytes.NewBufferString("")),
+		}, nil
+	})
+	defer q.Close()
+
+	err := q.Expire(Ad{"id": "1", "expiration_url": "expire-url"})
+
+	assert.Equal(t, err, &PoPError{
+		Status: http.StatusBadRequest, Message: "Request rejected"})
+	assert.Equal(t, q.Pending(), 0)
+}
+
+func TestPoPQueueRetriesTransientRejections(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pop-queue")
+	defer os.RemoveAll(dir)
+
+	status := http.StatusTooManyRequests
+	q := newTestPoPQueue(t, dir, func(method string, url string,
+		data *ProofOfPlayRequest) (*http.Response, error) {
+		header := http.Header{}
+		if status == http.StatusTooManyRequests {
+			header.Set("Retry-After", "120")
+		}
+		return &http.Response{
+			StatusCode: status,
+			Header:     header,
+			Body:       ioutil.NopCloser(bytes.NewBufferString("")),
+		}, nil
+	})
+	defer q.Close()
+
+	now := time.Now()
+	q.now = func() time.Time { return now }
+
+	err := q.Confirm(Ad{"id": "1", "proof_of_play_url": "pop-url"}, 100)
+	assert.Nil(t, err)
+
+	status = http.StatusRequestTimeout
+	err = q.Confirm(Ad{"id": "2", "proof_of_play_url": "pop-url"}, 100)
+	assert.Nil(t, err)
+
+	assert.Equal(t, q.Pending(), 2)
+	assert.Equal(t, q.pending[0].nextAttempt, now.Add(2*time.Minute))
+	assert.Equal(t, q.pending[1].nextAttempt, now.Add(time.Hour))
+}
+
+func TestPoPQueueAbandonsAfterLeaseExpiry(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pop-queue")
+	defer os.RemoveAll(dir)
+
+	calls := 0
+	q := newTestPoPQueue(t, dir, func(method string, url string,
+		data *ProofOfPlayRequest) (*http.Response, error) {
+		calls++
+		return &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Body:       ioutil.NopCloser(bytes.NewBufferString("")),
+		}, nil
+	})
+	defer q.Close()
+
+	now := time.Now()
+	q.now = func() time.Time { return now }
+
+	q.Confirm(Ad{
+		"id":                "1",
+		"proof_of_play_url": "pop-url",
+		"lease_expiry":      float64(now.Unix() + 60),
+	}, 100)
+	assert.Equal(t, q.Pending(), 1)
+
+	now = now.Add(time.Hour)
+	q.retryPending()
+
+	assert.Equal(t, calls, 1)
+	assert.Equal(t, q.Pending(), 0)
+}
+
+func TestPoPQueueSurvivesRestart(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pop-queue")
+	defer os.RemoveAll(dir)
+
+	q := newTestPoPQueue(t, dir, func(method string, url string,
+		data *ProofOfPlayRequest) (*http.Response, error) {
+		return nil, errors.New("network down")
+	})
+
+	q.Confirm(Ad{"id": "1", "proof_of_play_url": "pop-url"}, 100)
+	q.Expire(Ad{"id": "2", "expiration_url": "expire-url"})
+	assert.Nil(t, q.Close())
+
+	requests := make([]*ProofOfPlayRequest, 0)
+	urls := make([]string, 0)
+	q = newTestPoPQueue(t, dir, func(method string, url string,
+		data *ProofOfPlayRequest) (*http.Response, error) {
+		urls = append(urls, url)
+		requests = append(requests, data)
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+	defer q.Close()
+
+	assert.Equal(t, q.Pending(), 2)
+
+	q.retryPending()
+
+	assert.Equal(t, q.Pending(), 0)
+	assert.ElementsMatch(t, urls, []string{"pop-url", "expire-url"})
+	for i, url := range urls {
+		if url == "pop-url" {
+			assert.Equal(t, requests[i].DisplayTime, int64(100))
+		}
+	}
+}
+
+func TestClientUsesPoPQueue(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pop-queue")
+	defer os.RemoveAll(dir)
+
+	client := NewClient(&ClientConfig{
+		ReqTimeout: time.Second,
+		PoPFn: func(method string, url string,
+			data *ProofOfPlayRequest) (*http.Response, error) {
+			return nil, errors.New("network down")
+		},
+		PoPQueue: &PoPQueueConfig{Dir: dir, BaseDelay: time.Hour},
+	})
+
+	queue, ok := client.pop.(*popQueue)
+	assert.True(t, ok)
+
+	client.addToInProgressList(Ad{
+		"id":                 "1",
+		"proof_of_play_url":  "pop-url",
+		"original_asset_url": "url1",
+	})
+	_, err := client.Confirm("1", 100)
+
+	assert.Nil(t, err)
+	assert.Equal(t, queue.Pending(), 1)
+
+	client.Close()
+	client.Close()
+	assert.Nil(t, queue.Close())
+
+	data, _ := ioutil.ReadFile(queue.log.path)
+	assert.Contains(t, string(data), "pop-url")
+}
@@ -0,0 +1,214 @@
+package vistar
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+var DefaultPrefetchSize = 1
+var DefaultPrefetchRefillInterval = 5 * time.Second
+
+type PrefetcherConfig struct {
+	// Size is the number of ads kept ready per display area. Defaults to
+	// DefaultPrefetchSize.
+	Size           int
+	RefillInterval time.Duration
+	// LeaseMargin drops buffered ads whose lease expires within this
+	// duration, so that they are not played too late to be confirmed.
+	LeaseMargin time.Duration
+}
+
+// prefetcher keeps a buffer of ads per display area of the request, so that
+// an ad is available as soon as a slot starts.
+type prefetcher struct {
+	client   Client
+	request  Request
+	config   *PrefetcherConfig
+	now      func() time.Time
+	lock     sync.Mutex
+	buffers  map[string][]Ad
+	refillCh chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	doneCh   chan struct{}
+}
+
+// NewPrefetcher starts refilling right away. A nil config uses the
+// defaults.
+func NewPrefetcher(client Client, request Request,
+	config *PrefetcherConfig) *prefetcher {
+	filled := PrefetcherConfig{}
+	if config != nil {
+		filled = *config
+	}
+
+	if filled.Size <= 0 {
+		filled.Size = DefaultPrefetchSize
+	}
+
+	if filled.RefillInterval <= 0 {
+		filled.RefillInterval = DefaultPrefetchRefillInterval
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &prefetcher{
+		client:   client,
+		request:  request,
+		config:   &filled,
+		now:      time.Now,
+		buffers:  make(map[string][]Ad),
+		refillCh: make(chan struct{}, 1),
+		ctx:      ctx,
+		cancel:   cancel,
+		doneCh:   make(chan struct{}),
+	}
+
+	go p.processRefills()
+	return p
+}
+
+// Next returns the oldest ready ad for the display area, and schedules a
+// refill of the buffer.
+func (p *prefetcher) Next(displayAreaId string) (Ad, bool) {
+	p.dropExpiring()
+
+	p.lock.Lock()
+	buffer := p.buffers[displayAreaId]
+	var ad Ad
+	if len(buffer) > 0 {
+		ad = buffer[0]
+		p.buffers[displayAreaId] = buffer[1:]
+	}
+	p.lock.Unlock()
+
+	select {
+	case p.refillCh <- struct{}{}:
+	default:
+	}
+	return ad, ad != nil
+}
+
+func (p *prefetcher) Len(displayAreaId string) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return len(p.buffers[displayAreaId])
+}
+
+// Close stops refilling and expires the ads that were never handed out.
+func (p *prefetcher) Close() {
+	p.cancel()
+	<-p.doneCh
+
+	p.lock.Lock()
+	buffers := p.buffers
+	p.buffers = make(map[string][]Ad)
+	p.lock.Unlock()
+
+	for _, buffer := range buffers {
+		for _, ad := range buffer {
+			p.expire(ad)
+		}
+	}
+}
+
+func (p *prefetcher) processRefills() {
+	defer close(p.doneCh)
+
+	ticker := time.NewTicker(p.config.RefillInterval)
+	defer ticker.Stop()
+
+	p.refill()
+	for {
+		select {
+		case <-ticker.C:
+			p.refill()
+		case <-p.refillCh:
+			p.refill()
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// refill requests ads for every display area whose buffer is not full. Each
+// display area gets at most one request per call so that an ad server
+// returning no ads is not called in a loop.
+func (p *prefetcher) refill() {
+	p.dropExpiring()
+
+	data := p.request.Data()
+	if data == nil {
+		return
+	}
+
+	for _, area := range data.DisplayAreas {
+		if p.ctx.Err() != nil || p.Len(area.Id) >= p.config.Size {
+			continue
+		}
+
+		resp, err := p.client.GetAdContext(p.ctx,
+			displayAreaRequest(p.request, area))
+		if err != nil {
+			continue
+		}
+
+		p.lock.Lock()
+		for _, ad := range resp.Advertisement {
+			areaId, ok := ad["display_area_id"].(string)
+			if !ok {
+				areaId = area.Id
+			}
+			p.buffers[areaId] = append(p.buffers[areaId], ad)
+		}
+		p.lock.Unlock()
+	}
+}
+
+func (p *prefetcher) dropExpiring() {
+	deadline := p.now().Add(p.config.LeaseMargin).Unix()
+
+	p.lock.Lock()
+	dropped := make([]Ad, 0)
+	for areaId, buffer := range p.buffers {
+		kept := buffer[:0]
+		for _, ad := range buffer {
+			expiry := leaseExpiry(ad)
+			if expiry != 0 && expiry <= deadline {
+				dropped = append(dropped, ad)
+				continue
+			}
+			kept = append(kept, ad)
+		}
+		p.buffers[areaId] = kept
+	}
+	p.lock.Unlock()
+
+	for _, ad := range dropped {
+		p.expire(ad)
+	}
+}
+
+func (p *prefetcher) expire(ad Ad) {
+	if adId, ok := ad["id"].(string); ok {
+		p.client.Expire(adId)
+	}
+}
+
+// displayAreaRequest returns a copy of the request that only asks for ads
+// for the given display area.
+func displayAreaRequest(r Request, area DisplayArea) Request {
+	data := *r.Data()
+	data.DisplayAreas = []DisplayArea{area}
+
+	return &request{
+		data:              &data,
+		url:               r.ServerUrl(),
+		urls:              serverUrls(r),
+		assetEndpointUrl:  r.AssetEndpointUrl(),
+		assetEndpointUrls: assetEndpointUrls(r),
+		logEnabled:        r.LogEnabled(),
+		logLevel:          r.LogLevel(),
+	}
+}
@@ -0,0 +1,167 @@
+package vistar
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type prefetchTestServer struct {
+	lock        sync.Mutex
+	nextId      int
+	leaseExpiry int64
+	server      *httptest.Server
+}
+
+func newPrefetchTestServer(leaseExpiry int64) *prefetchTestServer {
+	s := &prefetchTestServer{leaseExpiry: leaseExpiry}
+	s.server = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			data := &Data{}
+			json.NewDecoder(r.Body).Decode(data)
+
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			s.nextId++
+			ad := Ad{
+				"id":              fmt.Sprintf("%d", s.nextId),
+				"display_area_id": data.DisplayAreas[0].Id,
+				"expiration_url":  "expire-url",
+				"lease_expiry":    s.leaseExpiry,
+			}
+			response, _ := json.Marshal(&AdResponse{Advertisement: []Ad{ad}})
+			w.Write(response)
+		}),
+	)
+	return s
+}
+
+func newPrefetchTestClient() *client {
+	return NewClient(&ClientConfig{
+		ReqTimeout: time.Second,
+		PoPFn: func(method string, url string,
+			data *ProofOfPlayRequest) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		},
+	})
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPrefetcherKeepsBufferFull(t *testing.T) {
+	s := newPrefetchTestServer(time.Now().Unix() + 3600)
+	defer s.server.Close()
+
+	client := newPrefetchTestClient()
+	defer client.Close()
+
+	data := newTestData()
+	data.DisplayAreas = append(data.DisplayAreas, DisplayArea{
+		Id:             "b",
+		SupportedMedia: []string{"image/jpeg"},
+	})
+	request := NewRequest(s.server.URL, "", data, false, 0)
+
+	p := NewPrefetcher(client, request, &PrefetcherConfig{
+		Size:           2,
+		RefillInterval: time.Millisecond,
+	})
+
+	waitFor(t, func() bool { return p.Len("a") == 2 && p.Len("b") == 2 })
+
+	ad, ok := p.Next("a")
+	assert.True(t, ok)
+	assert.Equal(t, ad["display_area_id"], "a")
+	assert.Contains(t, client.GetInProgressAds(), ad["id"])
+
+	waitFor(t, func() bool { return p.Len("a") == 2 })
+
+	_, ok = p.Next("unknown")
+	assert.False(t, ok)
+
+	p.Close()
+	assert.Equal(t, p.Len("a"), 0)
+	assert.Len(t, client.GetInProgressAds(), 1)
+}
+
+func TestPrefetcherDropsAdsNearLeaseExpiry(t *testing.T) {
+	s := newPrefetchTestServer(time.Now().Unix() + 60)
+	defer s.server.Close()
+
+	client := newPrefetchTestClient()
+	defer client.Close()
+
+	request := NewRequest(s.server.URL, "", newTestData(), false, 0)
+
+	p := NewPrefetcher(client, request, &PrefetcherConfig{
+		Size:           1,
+		RefillInterval: time.Hour,
+		LeaseMargin:    10 * time.Second,
+	})
+	defer p.Close()
+
+	waitFor(t, func() bool { return p.Len("a") == 1 })
+
+	p.now = func() time.Time { return time.Now().Add(55 * time.Second) }
+
+	p.dropExpiring()
+
+	assert.Equal(t, p.Len("a"), 0)
+	assert.Len(t, client.GetInProgressAds(), 0)
+}
+
+func TestPrefetcherDefaultConfig(t *testing.T) {
+	s := newPrefetchTestServer(time.Now().Unix() + 3600)
+	defer s.server.Close()
+
+	client := newPrefetchTestClient()
+	defer client.Close()
+
+	request := NewRequest(s.server.URL, "", newTestData(), false, 0)
+
+	for _, config := range []*PrefetcherConfig{nil, {}} {
+		p := NewPrefetcher(client, request, config)
+		assert.Equal(t, p.config.Size, DefaultPrefetchSize)
+		assert.Equal(t, p.config.RefillInterval,
+			DefaultPrefetchRefillInterval)
+
+		waitFor(t, func() bool { return p.Len("a") == 1 })
+		_, ok := p.Next("a")
+		assert.True(t, ok)
+		p.Close()
+	}
+}
+
+func TestDisplayAreaRequest(t *testing.T) {
+	data := &Data{
+		ApiKey:       "key",
+		DisplayAreas: []DisplayArea{{Id: "a"}, {Id: "b"}},
+	}
+	original, err := NewRequestWithFailover([]string{"primary", "fallback"},
+		[]string{"asset"}, data, true, 2)
+	assert.Nil(t, err)
+
+	r := displayAreaRequest(original, data.DisplayAreas[1])
+
+	assert.Equal(t, r.Data().ApiKey, "key")
+	assert.Equal(t, r.Data().DisplayAreas, []DisplayArea{{Id: "b"}})
+	assert.Len(t, data.DisplayAreas, 2)
+	assert.Equal(t, serverUrls(r), []string{"primary", "fallback"})
+	assert.Equal(t, r.AssetEndpointUrl(), "asset")
+	assert.True(t, r.LogEnabled())
+	assert.Equal(t, r.LogLevel(), int64(2))
+}
@@ -1,9 +1,15 @@
 package vistar
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"time"
 )
 
 type ProofOfPlayRequest struct {
@@ -12,7 +18,9 @@ type ProofOfPlayRequest struct {
 
 type ProofOfPlay interface {
 	Expire(Ad) error
+	ExpireContext(context.Context, Ad) error
 	Confirm(Ad, int64) error
+	ConfirmContext(context.Context, Ad, int64) error
 }
 
 type PoPRequest struct {
@@ -33,23 +41,135 @@ func (e *PoPError) Error() string {
 }
 
 type proofOfPlay struct {
-	eventFn EventFunc
-	popFunc PoPFunc
+	events  EventHandler
+	popFunc PoPContextFunc
+	metrics Metrics
+	statsFn func(string, time.Duration, int, error)
 }
 
 func NewProofOfPlay(eventFn EventFunc, popFunc PoPFunc) *proofOfPlay {
+	return NewProofOfPlayContext(eventFn, contextPoPFunc(popFunc))
+}
+
+// NewProofOfPlayContext sends the requests with popFunc, or with
+// NewHTTPPoPFunc(nil) if it is nil.
+func NewProofOfPlayContext(eventFn EventFunc,
+	popFunc PoPContextFunc) *proofOfPlay {
+	if popFunc == nil {
+		popFunc = NewHTTPPoPFunc(nil)
+	}
+
 	pop := &proofOfPlay{
-		eventFn: eventFn,
+		events:  NewEventFuncHandler(eventFn),
 		popFunc: popFunc,
 	}
 
 	return pop
 }
 
+// NewHTTPPoPFunc returns a PoPContextFunc that POSTs the ProofOfPlayRequest
+// as JSON for confirms and GETs the url for expires, using httpClient or
+// http.DefaultClient if it is nil. The response body is read and closed
+// before returning, and a status code outside of 2xx is returned as a
+// *PoPError along with the response.
+func NewHTTPPoPFunc(httpClient *http.Client) PoPContextFunc {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return func(ctx context.Context, method string, url string,
+		data *ProofOfPlayRequest) (*http.Response, error) {
+		var body io.Reader
+		if data != nil {
+			encoded, err := json.Marshal(data)
+			if err != nil {
+				return nil, err
+			}
+			body = bytes.NewReader(encoded)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, url, body)
+		if err != nil {
+			return nil, err
+		}
+
+		if data != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		respBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+		if err != nil {
+			return resp, err
+		}
+
+		if resp.StatusCode < http.StatusOK ||
+			resp.StatusCode >= http.StatusMultipleChoices {
+			message := string(respBody)
+			if message == "" {
+				message = http.StatusText(resp.StatusCode)
+			}
+			return resp, &PoPError{Status: resp.StatusCode, Message: message}
+		}
+		return resp, nil
+	}
+}
+
+// contextPoPFunc adapts a PoPFunc so that it is skipped once the context is
+// done. The wrapped function itself cannot be interrupted.
+func contextPoPFunc(fn PoPFunc) PoPContextFunc {
+	if fn == nil {
+		return nil
+	}
+
+	return func(ctx context.Context, method string, url string,
+		data *ProofOfPlayRequest) (*http.Response, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return fn(method, url, data)
+	}
+}
+
 func (p *proofOfPlay) Expire(ad Ad) error {
+	return p.ExpireContext(context.Background(), ad)
+}
+
+func (p *proofOfPlay) ExpireContext(ctx context.Context, ad Ad) error {
+	popReq, err := p.expireRequest(ad)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = p.send(ctx, popReq)
+	return err
+}
+
+func (p *proofOfPlay) Confirm(ad Ad, displayTime int64) error {
+	return p.ConfirmContext(context.Background(), ad, displayTime)
+}
+
+func (p *proofOfPlay) ConfirmContext(ctx context.Context, ad Ad,
+	displayTime int64) error {
+	popReq, err := p.confirmRequest(ad, displayTime)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = p.send(ctx, popReq)
+	return err
+}
+
+func (p *proofOfPlay) expireRequest(ad Ad) (*PoPRequest, error) {
 	expUrl, ok := ad["expiration_url"].(string)
 	if !ok {
-		return &PoPError{
+		return nil, &PoPError{
 			Status:  http.StatusBadRequest,
 			Message: "Invalid expire url",
 		}
@@ -57,24 +177,25 @@ func (p *proofOfPlay) Expire(ad Ad) error {
 
 	adId, ok := ad["id"].(string)
 	if !ok {
-		return &PoPError{
+		return nil, &PoPError{
 			Status:  http.StatusBadRequest,
 			Message: "Invalid ad id",
 		}
 	}
 
-	return p.expire(&PoPRequest{
+	return &PoPRequest{
 		Ad:     ad,
 		AdId:   adId,
 		Status: false,
 		Url:    expUrl,
-	})
+	}, nil
 }
 
-func (p *proofOfPlay) Confirm(ad Ad, displayTime int64) error {
+func (p *proofOfPlay) confirmRequest(ad Ad, displayTime int64) (
+	*PoPRequest, error) {
 	confirmUrl, ok := ad["proof_of_play_url"].(string)
 	if !ok {
-		return &PoPError{
+		return nil, &PoPError{
 			Status:  http.StatusBadRequest,
 			Message: "Invalid proof of play URL",
 		}
@@ -82,56 +203,139 @@ func (p *proofOfPlay) Confirm(ad Ad, displayTime int64) error {
 
 	adId, ok := ad["id"].(string)
 	if !ok {
-		return &PoPError{
+		return nil, &PoPError{
 			Status:  http.StatusBadRequest,
 			Message: "Invalid ad id",
 		}
 	}
 
-	return p.confirm(&PoPRequest{
+	return &PoPRequest{
 		Ad:          ad,
 		AdId:        adId,
 		Status:      true,
 		DisplayTime: displayTime,
 		Url:         confirmUrl,
-	})
+	}, nil
 }
 
-func (p *proofOfPlay) publishEvent(name string, message string, level string) {
-	if p.eventFn == nil {
-		return
+func (p *proofOfPlay) publishEvent(event Event) {
+	publishEvent(p.events, event)
+}
+
+// send performs a confirm (Status is true) or an expire request and returns
+// the status code and headers of the response, or 0 and nil if there was
+// none.
+func (p *proofOfPlay) send(ctx context.Context, popReq *PoPRequest) (
+	int, http.Header, error) {
+	method, eventName := http.MethodGet, EventAdExpireFailed
+	var data *ProofOfPlayRequest
+	if popReq.Status {
+		method, eventName = http.MethodPost, EventAdPoPFailed
+		data = &ProofOfPlayRequest{DisplayTime: popReq.DisplayTime}
 	}
 
-	p.eventFn(name, message, "", level)
-}
+	// The stats key is passed on so that requests made through the client's
+	// transport have their bandwidth recorded with the other pop stats.
+	start := time.Now()
+	resp, err := p.popFunc(withStatsKey(ctx, popStatsKey(popReq)), method,
+		popReq.Url, data)
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	p.recordMetrics(popReq, status, err)
+	p.publishSent(popReq, status, err, time.Since(start))
 
-func (p *proofOfPlay) confirm(popReq *PoPRequest) error {
-	data := &ProofOfPlayRequest{DisplayTime: popReq.DisplayTime}
+	if p.statsFn != nil {
+		p.statsFn(popStatsKey(popReq), time.Since(start), status, err)
+	}
 
-	resp, err := p.popFunc(http.MethodPost, popReq.Url, data)
-	if resp != nil && resp.StatusCode >= http.StatusBadRequest {
+	if resp == nil {
+		return 0, nil, err
+	}
+
+	if resp.Body != nil {
+		defer resp.Body.Close()
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
 		body, readErr := ioutil.ReadAll(resp.Body)
 		if readErr == nil {
-			p.publishEvent("ad-pop-failed", fmt.Sprintf("adId: %s, error: %s",
-				popReq.AdId, body), "warning")
+			p.publishEvent(Event{
+				Name:     eventName,
+				Level:    EventLevelWarning,
+				Message:  fmt.Sprintf("adId: %s, error: %s", popReq.AdId, body),
+				AdId:     popReq.AdId,
+				Url:      popReq.Url,
+				Status:   resp.StatusCode,
+				Duration: time.Since(start),
+				Fields:   map[string]interface{}{"body": string(body)},
+			})
 		}
 	}
 
-	return err
+	return resp.StatusCode, resp.Header, err
 }
 
-func (p *proofOfPlay) expire(popReq *PoPRequest) error {
-	resp, err := p.popFunc(http.MethodGet, popReq.Url, nil)
-	if resp != nil && resp.StatusCode >= http.StatusBadRequest {
-		body, readErr := ioutil.ReadAll(resp.Body)
-		if readErr == nil {
-			p.publishEvent("ad-expire-failed",
-				fmt.Sprintf("adId: %s, error: %s", popReq.AdId, body),
-				"warning")
+// publishSent publishes EventAdConfirmed or EventAdExpired if the server
+// accepted the request, and the matching attempt failed event otherwise.
+func (p *proofOfPlay) publishSent(popReq *PoPRequest, status int, err error,
+	duration time.Duration) {
+	accepted := err == nil && status >= http.StatusOK &&
+		status < http.StatusBadRequest
+	event := Event{
+		Name:     EventAdExpired,
+		Level:    EventLevelDebug,
+		Message:  fmt.Sprintf("adId: %s, code: %d", popReq.AdId, status),
+		AdId:     popReq.AdId,
+		Url:      popReq.Url,
+		Status:   status,
+		Err:      err,
+		Duration: duration,
+	}
+
+	if !accepted {
+		event.Name = EventAdExpireAttemptFailed
+	}
+
+	if popReq.Status {
+		event.Name = EventAdConfirmed
+		if !accepted {
+			event.Name = EventAdConfirmAttemptFailed
+		}
+		event.Fields = map[string]interface{}{
+			"display_time": popReq.DisplayTime,
 		}
 	}
+	p.publishEvent(event)
+}
 
-	return err
+// popStatsKey groups the stats of proof of play requests by host, since
+// every ad has its own urls.
+func popStatsKey(popReq *PoPRequest) string {
+	kind := "expiration"
+	if popReq.Status {
+		kind = "proof_of_play"
+	}
+
+	u, err := url.Parse(popReq.Url)
+	if err != nil {
+		return kind
+	}
+	return fmt.Sprintf("%s:%s://%s", kind, u.Scheme, u.Host)
+}
+
+func (p *proofOfPlay) recordMetrics(popReq *PoPRequest, status int,
+	err error) {
+	if p.metrics == nil {
+		return
+	}
+
+	if popReq.Status {
+		p.metrics.Confirm(status, err)
+	} else {
+		p.metrics.Expire(status, err)
+	}
 }
 
 type testProofOfPlay struct {
@@ -145,6 +349,11 @@ func NewTestProofOfPlay() *testProofOfPlay {
 }
 
 func (t *testProofOfPlay) Confirm(ad Ad, displayTime int64) error {
+	return t.ConfirmContext(context.Background(), ad, displayTime)
+}
+
+func (t *testProofOfPlay) ConfirmContext(ctx context.Context, ad Ad,
+	displayTime int64) error {
 	t.requests = append(
 		t.requests,
 		&PoPRequest{Ad: ad, Status: true, DisplayTime: displayTime})
@@ -152,6 +361,10 @@ func (t *testProofOfPlay) Confirm(ad Ad, displayTime int64) error {
 }
 
 func (t *testProofOfPlay) Expire(ad Ad) error {
+	return t.ExpireContext(context.Background(), ad)
+}
+
+func (t *testProofOfPlay) ExpireContext(ctx context.Context, ad Ad) error {
 	t.requests = append(t.requests, &PoPRequest{Ad: ad, Status: false})
 	return nil
 }
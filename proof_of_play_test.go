@@ -2,10 +2,15 @@ package vistar
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -144,3 +149,192 @@ func TestExpireFail(t *testing.T) {
 	assert.Equal(t, event.source, "")
 	assert.Equal(t, event.message, "adId: ad-id, error: Bad request")
 }
+
+func TestSentEventsOnlyReportAcceptedRequests(t *testing.T) {
+	ad := Ad{
+		"id":                "ad-id",
+		"proof_of_play_url": "http://pop-url.com",
+		"expiration_url":    "http://expire-url.com",
+	}
+
+	status := http.StatusOK
+	p := NewProofOfPlay(nil, func(method string, url string,
+		data *ProofOfPlayRequest) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: status,
+			Body:       ioutil.NopCloser(bytes.NewBufferString("")),
+		}, nil
+	})
+
+	var names []string
+	p.events = EventHandlerFunc(func(event Event) {
+		if event.Level == EventLevelDebug {
+			names = append(names, event.Name)
+		}
+	})
+
+	p.Confirm(ad, 100)
+	p.Expire(ad)
+	status = http.StatusServiceUnavailable
+	p.Confirm(ad, 100)
+	p.Expire(ad)
+
+	assert.Equal(t, names, []string{
+		EventAdConfirmed,
+		EventAdExpired,
+		EventAdConfirmAttemptFailed,
+		EventAdExpireAttemptFailed,
+	})
+}
+
+func TestConfirmContextCancelled(t *testing.T) {
+	ad := Ad{
+		"id":                "ad-id",
+		"proof_of_play_url": "http://pop-url.com",
+	}
+
+	popCalls := 0
+	mockPopFunc := func(method string, url string,
+		data *ProofOfPlayRequest) (*http.Response, error) {
+		popCalls++
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}
+
+	p := NewProofOfPlay(nil, mockPopFunc)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := p.ConfirmContext(ctx, ad, int64(100))
+
+	assert.Equal(t, err, context.Canceled)
+	assert.Equal(t, popCalls, 0)
+}
+
+func TestSendRecordsStatsPerHost(t *testing.T) {
+	mockPopFunc := func(method string, url string,
+		data *ProofOfPlayRequest) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}
+
+	keys := make([]string, 0)
+	p := NewProofOfPlay(nil, mockPopFunc)
+	p.statsFn = func(key string, latency time.Duration, status int,
+		err error) {
+		keys = append(keys, key)
+	}
+
+	p.Confirm(Ad{
+		"id":                "ad-id",
+		"proof_of_play_url": "https://pop.com/pop/ad-id?token=1",
+	}, int64(100))
+	p.Expire(Ad{
+		"id":             "ad-id",
+		"expiration_url": "https://pop.com/expire/ad-id",
+	})
+
+	assert.Equal(t, keys, []string{
+		"proof_of_play:https://pop.com",
+		"expiration:https://pop.com",
+	})
+}
+
+type closeTrackingBody struct {
+	io.Reader
+	closed bool
+}
+
+func (b *closeTrackingBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestSendClosesResponseBody(t *testing.T) {
+	body := &closeTrackingBody{Reader: bytes.NewBufferString("Bad request")}
+	mockPopFunc := func(method string, url string,
+		data *ProofOfPlayRequest) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusBadRequest, Body: body},
+			nil
+	}
+
+	p := NewProofOfPlay(nil, mockPopFunc)
+	p.Confirm(Ad{"id": "ad-id", "proof_of_play_url": "http://pop-url.com"},
+		int64(100))
+	assert.True(t, body.closed)
+}
+
+func TestHTTPPoPFunc(t *testing.T) {
+	requests := make([]string, 0)
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			requests = append(requests, fmt.Sprintf("%s %s %s %s", r.Method,
+				r.URL.Path, r.Header.Get("Content-Type"), body))
+			switch r.URL.Path {
+			case "/rejected":
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("lease expired"))
+			case "/failed":
+				w.WriteHeader(http.StatusBadGateway)
+			}
+		}))
+	defer ts.Close()
+
+	popFunc := NewHTTPPoPFunc(ts.Client())
+	ctx := context.Background()
+
+	resp, err := popFunc(ctx, http.MethodPost, ts.URL+"/pop",
+		&ProofOfPlayRequest{DisplayTime: 100})
+	assert.Nil(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+	resp, err = popFunc(ctx, http.MethodGet, ts.URL+"/expire", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+	assert.Equal(t, requests, []string{
+		`POST /pop application/json {"display_time":100}`,
+		"GET /expire  ",
+	})
+
+	resp, err = popFunc(ctx, http.MethodGet, ts.URL+"/rejected", nil)
+	assert.Equal(t, err, &PoPError{
+		Status:  http.StatusBadRequest,
+		Message: "lease expired",
+	})
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, string(body), "lease expired")
+
+	_, err = popFunc(ctx, http.MethodGet, ts.URL+"/failed", nil)
+	assert.Equal(t, err, &PoPError{
+		Status:  http.StatusBadGateway,
+		Message: "Bad Gateway",
+	})
+
+	_, err = popFunc(ctx, http.MethodGet, "http://127.0.0.1:1/", nil)
+	assert.NotNil(t, err)
+}
+
+func TestClientSendsPoPWithItsHTTPClient(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}))
+	defer ts.Close()
+
+	client := NewClient(&ClientConfig{ReqTimeout: time.Second})
+	defer client.Close()
+
+	client.addToInProgressList(Ad{
+		"id":                "ad-id",
+		"proof_of_play_url": ts.URL + "/pop/ad-id",
+	})
+	_, err := client.Confirm("ad-id", 100)
+	assert.Nil(t, err)
+
+	stats := client.GetStats()["proof_of_play:"+ts.URL]
+	assert.Equal(t, stats.Count, int64(1))
+	assert.True(t, stats.BytesSent > 0)
+	assert.True(t, stats.BytesReceived > int64(len("ok")))
+	assert.Equal(t, stats.StatusClasses, map[string]int64{"2xx": 1})
+}
@@ -0,0 +1,107 @@
+package vistar
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var DefaultRetryableStatusCodes = []int{
+	http.StatusTooManyRequests,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+type RetryPolicy struct {
+	// MaxAttempts includes the first attempt, values below 2 disable
+	// retries.
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// Jitter is the fraction of each delay, between 0 and 1, that is
+	// randomized.
+	Jitter               float64
+	RetryableStatusCodes []int
+	RetryNetworkErrors   bool
+}
+
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:          3,
+		BaseDelay:            200 * time.Millisecond,
+		MaxDelay:             2 * time.Second,
+		Jitter:               0.5,
+		RetryableStatusCodes: DefaultRetryableStatusCodes,
+		RetryNetworkErrors:   true,
+	}
+}
+
+func (p *RetryPolicy) attempts() int {
+	if p == nil || p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// shouldRetry reports whether an attempt that ended with the given status
+// code, or with err when there was no response, can be retried.
+func (p *RetryPolicy) shouldRetry(status int, err error) bool {
+	if status == 0 {
+		return err != nil && p.RetryNetworkErrors
+	}
+
+	for _, code := range p.RetryableStatusCodes {
+		if code == status {
+			return true
+		}
+	}
+	return false
+}
+
+// delay returns how long to wait after the given attempt. A Retry-After
+// header takes precedence over the backoff, but is still capped at MaxDelay.
+func (p *RetryPolicy) delay(attempt int, header http.Header) time.Duration {
+	if after, ok := retryAfter(header, time.Now()); ok {
+		if p.MaxDelay > 0 && after > p.MaxDelay {
+			return p.MaxDelay
+		}
+		return after
+	}
+
+	delay := p.BaseDelay
+	for i := 1; i < attempt && (p.MaxDelay <= 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	if p.Jitter > 0 {
+		delay -= time.Duration(p.Jitter * rand.Float64() * float64(delay))
+	}
+	return delay
+}
+
+func retryAfter(header http.Header, now time.Time) (time.Duration, bool) {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	at, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+
+	if at.Before(now) {
+		return 0, true
+	}
+	return at.Sub(now), true
+}
@@ -0,0 +1,205 @@
+package vistar
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := &RetryPolicy{
+		BaseDelay: 100 * time.Millisecond,
+		MaxDelay:  time.Second,
+	}
+
+	assert.Equal(t, policy.delay(1, http.Header{}), 100*time.Millisecond)
+	assert.Equal(t, policy.delay(2, http.Header{}), 200*time.Millisecond)
+	assert.Equal(t, policy.delay(4, http.Header{}), 800*time.Millisecond)
+	assert.Equal(t, policy.delay(5, http.Header{}), time.Second)
+	assert.Equal(t, policy.delay(50, http.Header{}), time.Second)
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		delay := policy.delay(1, http.Header{})
+		assert.True(t, delay > 50*time.Millisecond)
+		assert.True(t, delay <= 100*time.Millisecond)
+	}
+}
+
+func TestRetryPolicyDelayHonoursRetryAfter(t *testing.T) {
+	policy := &RetryPolicy{
+		BaseDelay: 100 * time.Millisecond,
+		MaxDelay:  5 * time.Second,
+	}
+
+	header := http.Header{}
+	header.Set("Retry-After", "2")
+	assert.Equal(t, policy.delay(1, header), 2*time.Second)
+
+	header.Set("Retry-After", "120")
+	assert.Equal(t, policy.delay(1, header), 5*time.Second)
+
+	header.Set("Retry-After", "invalid")
+	assert.Equal(t, policy.delay(1, header), 100*time.Millisecond)
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	_, ok := retryAfter(http.Header{}, now)
+	assert.False(t, ok)
+
+	header := http.Header{}
+	header.Set("Retry-After", now.Add(30*time.Second).Format(http.TimeFormat))
+	delay, ok := retryAfter(header, now)
+	assert.True(t, ok)
+	assert.Equal(t, delay, 30*time.Second)
+
+	header.Set("Retry-After", now.Add(-time.Minute).Format(http.TimeFormat))
+	delay, ok = retryAfter(header, now)
+	assert.True(t, ok)
+	assert.Equal(t, delay, time.Duration(0))
+}
+
+func TestRetryPolicyShouldRetry(t *testing.T) {
+	policy := DefaultRetryPolicy()
+
+	assert.True(t, policy.shouldRetry(http.StatusServiceUnavailable, nil))
+	assert.False(t, policy.shouldRetry(http.StatusBadRequest, nil))
+	assert.True(t, policy.shouldRetry(0, errors.New("connection refused")))
+
+	policy.RetryNetworkErrors = false
+	assert.False(t, policy.shouldRetry(0, errors.New("connection refused")))
+}
+
+func newRetryTestClient(ts *httptest.Server, policy *RetryPolicy,
+	events *[]string) *client {
+	c := &client{
+		pop:            NewTestProofOfPlay(),
+		httpClient:     ts.Client(),
+		retryPolicy:    policy,
+		bandwidthStats: make(map[string]Stats),
+		events: NewEventFuncHandler(func(name string, message string,
+			source string, level string) {
+			*events = append(*events, name)
+		}),
+	}
+	c.httpClient.Transport = newCountingTransport(c.httpClient.Transport,
+		c.updateTransferStats)
+	return c
+}
+
+func TestPostRetriesRetryableErrors(t *testing.T) {
+	var lock sync.Mutex
+	calls := 0
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			calls++
+			if calls < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("Success!"))
+		}),
+	)
+	defer ts.Close()
+
+	events := make([]string, 0)
+	client := newRetryTestClient(ts, &RetryPolicy{
+		MaxAttempts:          3,
+		BaseDelay:            time.Millisecond,
+		RetryableStatusCodes: DefaultRetryableStatusCodes,
+	}, &events)
+
+	resp, err := client.post(context.Background(), ts.URL,
+		&request{data: &Data{}})
+
+	assert.Nil(t, err)
+	assert.Equal(t, string(resp), "Success!")
+	assert.Equal(t, calls, 3)
+	assert.Equal(t, client.GetStats()[ts.URL].Retries, int64(2))
+	assert.Equal(t, client.GetStats()[ts.URL].Count, int64(3))
+	assert.Equal(t, events, []string{
+		"ad-server-endpoint-failed", "ad-server-request-retry",
+		"ad-server-endpoint-failed", "ad-server-request-retry",
+	})
+}
+
+func TestPostGivesUpAfterMaxAttempts(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}),
+	)
+	defer ts.Close()
+
+	events := make([]string, 0)
+	client := newRetryTestClient(ts, &RetryPolicy{
+		MaxAttempts:          2,
+		BaseDelay:            time.Millisecond,
+		RetryableStatusCodes: DefaultRetryableStatusCodes,
+	}, &events)
+
+	resp, err := client.post(context.Background(), ts.URL,
+		&request{data: &Data{}})
+
+	assert.Nil(t, resp)
+	assert.NotNil(t, err)
+	assert.Equal(t, calls, 2)
+	assert.Equal(t, client.GetStats()[ts.URL].Retries, int64(1))
+}
+
+func TestPostDoesNotRetryNonRetryableErrors(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(http.StatusBadRequest)
+		}),
+	)
+	defer ts.Close()
+
+	events := make([]string, 0)
+	client := newRetryTestClient(ts, DefaultRetryPolicy(), &events)
+
+	_, err := client.post(context.Background(), ts.URL,
+		&request{data: &Data{}})
+
+	assert.NotNil(t, err)
+	assert.Equal(t, calls, 1)
+	assert.Equal(t, client.GetStats()[ts.URL].Retries, int64(0))
+}
+
+func TestPostStopsRetryingWhenContextIsDone(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}),
+	)
+	defer ts.Close()
+
+	events := make([]string, 0)
+	client := newRetryTestClient(ts, &RetryPolicy{
+		MaxAttempts:          5,
+		BaseDelay:            time.Hour,
+		RetryableStatusCodes: DefaultRetryableStatusCodes,
+	}, &events)
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		20*time.Millisecond)
+	defer cancel()
+
+	_, err := client.post(ctx, ts.URL, &request{data: &Data{}})
+
+	assert.Equal(t, err, context.DeadlineExceeded)
+}
@@ -1,50 +1,318 @@
 package vistar
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
-	"net/http/httputil"
-	"strings"
+	"time"
 )
 
+// Latency histogram buckets grow by 10%, so percentiles are accurate to
+// within 10%, from 0.1ms up to several minutes.
+const (
+	latencyBucketBase   = 0.1
+	latencyBucketGrowth = 1.1
+	latencyBuckets      = 160
+)
+
+// StatsWindow selects one of the rolling windows that stats are kept for.
+type StatsWindow int
+
+const (
+	StatsWindowMinute StatsWindow = iota
+	StatsWindowHour
+	StatsWindowDay
+)
+
+var statsWindowSizes = []time.Duration{time.Minute, time.Hour, 24 * time.Hour}
+
+// Each window is split into buckets so that old stats leave the window a
+// bucket at a time rather than all at once.
+const statsWindowBuckets = 60
+
+func (w StatsWindow) String() string {
+	switch w {
+	case StatsWindowMinute:
+		return "1m"
+	case StatsWindowHour:
+		return "1h"
+	case StatsWindowDay:
+		return "24h"
+	}
+	return fmt.Sprintf("StatsWindow(%d)", int(w))
+}
+
 type Stats struct {
 	Average       float64 `json:"average_per_request"`
 	BytesReceived int64   `json:"bytes_received"`
-	BytesSent     int64   `json:"bytes_sent"`
-	Count         int64   `json:"count"`
-	Total         int64   `json:"total_bytes"`
+	// BytesReceivedDecompressed is BytesReceived with compressed response
+	// bodies counted at their decompressed size.
+	BytesReceivedDecompressed int64            `json:"bytes_received_decompressed"`
+	BytesSent                 int64            `json:"bytes_sent"`
+	Count                     int64            `json:"count"`
+	Retries                   int64            `json:"retries"`
+	Total                     int64            `json:"total_bytes"`
+	LatencyMin                float64          `json:"latency_min_ms"`
+	LatencyMax                float64          `json:"latency_max_ms"`
+	LatencyMean               float64          `json:"latency_mean_ms"`
+	LatencyP50                float64          `json:"latency_p50_ms"`
+	LatencyP95                float64          `json:"latency_p95_ms"`
+	LatencyP99                float64          `json:"latency_p99_ms"`
+	StatusClasses             map[string]int64 `json:"status_classes,omitempty"`
+	NetworkErrors             int64            `json:"network_errors"`
+	LastError                 string           `json:"last_error,omitempty"`
+	LastErrorAt               time.Time        `json:"last_error_at"`
+
+	latency *latencyHistogram
 }
 
-func getResponseLength(resp *http.Response) int64 {
-	if resp == nil {
-		return 0
+type latencyHistogram struct {
+	counts []int64
+	count  int64
+	sum    float64
+	min    float64
+	max    float64
+}
+
+func updateStats(stats *Stats, bytesSent int64, bytesReceived int64) {
+	stats.BytesSent += bytesSent
+	stats.BytesReceived += bytesReceived
+	stats.Count += 1
+	stats.Total = stats.BytesSent + stats.BytesReceived
+	stats.Average = float64(stats.Total) / float64(stats.Count)
+}
+
+// updateRequestStats records the outcome of a request, status is 0 when no
+// response was received.
+func updateRequestStats(stats *Stats, latency time.Duration, status int,
+	err error, now time.Time) {
+	if stats.latency == nil {
+		stats.latency = newLatencyHistogram()
 	}
-	dump, err := httputil.DumpResponse(resp, true)
-	if err != nil {
-		return 0
+
+	stats.latency.observe(float64(latency) / float64(time.Millisecond))
+	stats.updateLatency()
+
+	if status != 0 {
+		if stats.StatusClasses == nil {
+			stats.StatusClasses = make(map[string]int64)
+		}
+		stats.StatusClasses[fmt.Sprintf("%dxx", status/100)] += 1
+	}
+
+	if status == 0 && err != nil && !errors.Is(err, context.Canceled) {
+		stats.NetworkErrors += 1
 	}
 
-	return int64(len(dump))
+	if err != nil || status >= http.StatusBadRequest {
+		stats.LastErrorAt = now
+		if err != nil {
+			stats.LastError = err.Error()
+		} else {
+			stats.LastError = http.StatusText(status)
+		}
+	}
 }
 
-func getRequestLength(req *http.Request) int64 {
-	if req == nil {
-		return 0
+func (s *Stats) updateLatency() {
+	h := s.latency
+	if h == nil || h.count == 0 {
+		return
 	}
 
-	headerLength := 0
+	s.LatencyMin = h.min
+	s.LatencyMax = h.max
+	s.LatencyMean = h.sum / float64(h.count)
+	s.LatencyP50 = h.percentile(0.50)
+	s.LatencyP95 = h.percentile(0.95)
+	s.LatencyP99 = h.percentile(0.99)
+}
 
-	for k, v := range req.Header {
-		headerLength += len(k)
-		headerLength += len(strings.Join(v[:], ","))
+// copyStats returns a copy of stats that shares no memory with it.
+func copyStats(stats Stats) Stats {
+	if stats.StatusClasses != nil {
+		classes := make(map[string]int64, len(stats.StatusClasses))
+		for class, count := range stats.StatusClasses {
+			classes[class] = count
+		}
+		stats.StatusClasses = classes
 	}
 
-	return req.ContentLength + int64(headerLength)
+	if stats.latency != nil {
+		stats.latency = stats.latency.clone()
+	}
+	return stats
 }
 
-func updateStats(stats *Stats, bytesSent int64, bytesReceived int64) {
-	stats.BytesSent += bytesSent
-	stats.BytesReceived += bytesReceived
-	stats.Count += 1
-	stats.Total = stats.BytesSent + stats.BytesReceived
-	stats.Average = float64(stats.Total) / float64(stats.Count)
+// mergeStats adds the counters of src to dst.
+func mergeStats(dst *Stats, src *Stats) {
+	dst.BytesSent += src.BytesSent
+	dst.BytesReceived += src.BytesReceived
+	dst.BytesReceivedDecompressed += src.BytesReceivedDecompressed
+	dst.Count += src.Count
+	dst.Retries += src.Retries
+	dst.NetworkErrors += src.NetworkErrors
+	dst.Total = dst.BytesSent + dst.BytesReceived
+	if dst.Count > 0 {
+		dst.Average = float64(dst.Total) / float64(dst.Count)
+	}
+
+	for class, count := range src.StatusClasses {
+		if dst.StatusClasses == nil {
+			dst.StatusClasses = make(map[string]int64)
+		}
+		dst.StatusClasses[class] += count
+	}
+
+	if src.LastErrorAt.After(dst.LastErrorAt) {
+		dst.LastError = src.LastError
+		dst.LastErrorAt = src.LastErrorAt
+	}
+
+	if src.latency != nil {
+		if dst.latency == nil {
+			dst.latency = newLatencyHistogram()
+		}
+		dst.latency.merge(src.latency)
+		dst.updateLatency()
+	}
+}
+
+// statsRing holds the stats of the last size, per url.
+type statsRing struct {
+	size    time.Duration
+	buckets [statsWindowBuckets]statsBucket
+}
+
+type statsBucket struct {
+	start time.Time
+	stats map[string]*Stats
+}
+
+func newStatsRings() []*statsRing {
+	rings := make([]*statsRing, 0, len(statsWindowSizes))
+	for _, size := range statsWindowSizes {
+		rings = append(rings, &statsRing{size: size})
+	}
+	return rings
+}
+
+func (r *statsRing) width() time.Duration {
+	return r.size / statsWindowBuckets
+}
+
+// stats returns the stats of url in the bucket that now falls in, reusing
+// the bucket once the ring has gone around.
+func (r *statsRing) stats(url string, now time.Time) *Stats {
+	start := now.Truncate(r.width())
+	i := (start.UnixNano() / int64(r.width())) % statsWindowBuckets
+	bucket := &r.buckets[i]
+	if !bucket.start.Equal(start) || bucket.stats == nil {
+		bucket.start = start
+		bucket.stats = make(map[string]*Stats)
+	}
+
+	stats, ok := bucket.stats[url]
+	if !ok {
+		stats = &Stats{}
+		bucket.stats[url] = stats
+	}
+	return stats
+}
+
+func (r *statsRing) snapshot(now time.Time) map[string]Stats {
+	oldest := now.Truncate(r.width()).Add(
+		-(statsWindowBuckets - 1) * r.width())
+
+	ret := map[string]Stats{}
+	for i := range r.buckets {
+		bucket := &r.buckets[i]
+		if bucket.start.Before(oldest) || bucket.start.After(now) {
+			continue
+		}
+
+		for url, stats := range bucket.stats {
+			total := ret[url]
+			mergeStats(&total, stats)
+			ret[url] = total
+		}
+	}
+	return ret
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{counts: make([]int64, latencyBuckets)}
+}
+
+func (h *latencyHistogram) observe(ms float64) {
+	if h.count == 0 || ms < h.min {
+		h.min = ms
+	}
+
+	if ms > h.max {
+		h.max = ms
+	}
+
+	h.count++
+	h.sum += ms
+	h.counts[latencyBucket(ms)]++
+}
+
+func (h *latencyHistogram) merge(other *latencyHistogram) {
+	if other.count == 0 {
+		return
+	}
+
+	if h.count == 0 || other.min < h.min {
+		h.min = other.min
+	}
+
+	if other.max > h.max {
+		h.max = other.max
+	}
+
+	h.count += other.count
+	h.sum += other.sum
+	for i, count := range other.counts {
+		h.counts[i] += count
+	}
+}
+
+func (h *latencyHistogram) clone() *latencyHistogram {
+	clone := *h
+	clone.counts = append([]int64(nil), h.counts...)
+	return &clone
+}
+
+// percentile returns the upper bound of the bucket holding the percentile,
+// clamped to the observed range.
+func (h *latencyHistogram) percentile(p float64) float64 {
+	rank := int64(math.Ceil(p * float64(h.count)))
+	var seen int64
+	for i, count := range h.counts {
+		seen += count
+		if seen >= rank && count > 0 {
+			return math.Max(h.min, math.Min(h.max, latencyBucketBound(i)))
+		}
+	}
+	return h.max
+}
+
+func latencyBucket(ms float64) int {
+	if ms <= latencyBucketBase {
+		return 0
+	}
+
+	i := int(math.Ceil(math.Log(ms/latencyBucketBase) /
+		math.Log(latencyBucketGrowth)))
+	if i >= latencyBuckets {
+		return latencyBuckets - 1
+	}
+	return i
+}
+
+func latencyBucketBound(i int) float64 {
+	return latencyBucketBase * math.Pow(latencyBucketGrowth, float64(i))
 }
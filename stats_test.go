@@ -1,51 +1,14 @@
 package vistar
 
 import (
-	"bytes"
-	"io"
-	"net/http"
-	"net/http/httptest"
+	"context"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
-func TestGetRequestLength(t *testing.T) {
-	data := []byte("this is test")
-
-	req := httptest.NewRequest(
-		"GET", "http://example.com/foo", bytes.NewBuffer(data))
-
-	assert.Equal(t, getRequestLength(req), int64(len(data)))
-
-	req.Header.Set("Content-Type", "application/json")
-
-	// Header length is 28 and content length is 12 hence total is 40
-	assert.Equal(t, getRequestLength(req), int64(40))
-
-}
-
-func TestGetResponseLength(t *testing.T) {
-	assert.Equal(t, getResponseLength(nil), int64(0))
-
-	handler := func(w http.ResponseWriter, r *http.Request) {
-		io.WriteString(w, "<html><body>Hello World!</body></html>")
-	}
-
-	req := httptest.NewRequest("GET", "http://example.com/foo", nil)
-	w := httptest.NewRecorder()
-	handler(w, req)
-
-	resp := w.Result()
-
-	// Response length is 116 and it looks like following:
-	// HTTP/1.1 200 OK
-	// Connection: close
-	// Content-Type: text/html; charset=utf-8
-	// <html><body>Hello World!</body></html>
-	assert.Equal(t, getResponseLength(resp), int64(116))
-}
-
 func TestUpdateStats(t *testing.T) {
 	stats := Stats{}
 
@@ -63,3 +26,115 @@ func TestUpdateStats(t *testing.T) {
 	assert.Equal(t, stats.Total, int64(3222))
 	assert.Equal(t, stats.Average, float64(1611))
 }
+
+func TestUpdateRequestStats(t *testing.T) {
+	stats := Stats{}
+	now := time.Now()
+
+	updateRequestStats(&stats, 10*time.Millisecond, 200, nil, now)
+	updateRequestStats(&stats, 30*time.Millisecond, 204, nil, now)
+	assert.Equal(t, stats.LatencyMin, float64(10))
+	assert.Equal(t, stats.LatencyMax, float64(30))
+	assert.Equal(t, stats.LatencyMean, float64(20))
+	assert.Equal(t, stats.StatusClasses, map[string]int64{"2xx": 2})
+	assert.Equal(t, stats.LastError, "")
+	assert.True(t, stats.LastErrorAt.IsZero())
+
+	later := now.Add(time.Minute)
+	updateRequestStats(&stats, 5*time.Millisecond, 503, nil, later)
+	assert.Equal(t, stats.LatencyMin, float64(5))
+	assert.Equal(t, stats.StatusClasses, map[string]int64{"2xx": 2, "5xx": 1})
+	assert.Equal(t, stats.LastError, "Service Unavailable")
+	assert.Equal(t, stats.LastErrorAt, later)
+
+	updateRequestStats(&stats, time.Second, 0,
+		errors.New("connection refused"), later)
+	assert.Equal(t, stats.NetworkErrors, int64(1))
+	assert.Equal(t, stats.LastError, "connection refused")
+
+	updateRequestStats(&stats, time.Second, 0, context.Canceled, later)
+	assert.Equal(t, stats.NetworkErrors, int64(1))
+}
+
+func TestLatencyPercentiles(t *testing.T) {
+	stats := Stats{}
+	for i := 1; i <= 100; i++ {
+		updateRequestStats(&stats, time.Duration(i)*time.Millisecond, 200,
+			nil, time.Now())
+	}
+
+	assert.InEpsilon(t, stats.LatencyP50, 50, 0.1)
+	assert.InEpsilon(t, stats.LatencyP95, 95, 0.1)
+	assert.InEpsilon(t, stats.LatencyP99, 99, 0.1)
+	assert.InEpsilon(t, stats.LatencyMean, 50.5, 0.001)
+	assert.True(t, stats.LatencyP99 <= stats.LatencyMax)
+}
+
+func TestLatencyBucket(t *testing.T) {
+	assert.Equal(t, latencyBucket(0), 0)
+	assert.Equal(t, latencyBucket(0.1), 0)
+	assert.Equal(t, latencyBucket(1e12), latencyBuckets-1)
+
+	for _, ms := range []float64{0.5, 1, 42, 1000, 60000} {
+		i := latencyBucket(ms)
+		assert.True(t, latencyBucketBound(i) >= ms)
+		assert.True(t, latencyBucketBound(i-1) < ms)
+	}
+}
+
+func TestStatsRing(t *testing.T) {
+	ring := &statsRing{size: time.Minute}
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	updateStats(ring.stats("/test", now), 100, 200)
+	updateStats(ring.stats("/test", now.Add(30*time.Second)), 10, 20)
+	updateRequestStats(ring.stats("/test", now.Add(30*time.Second)),
+		10*time.Millisecond, 500, nil, now.Add(30*time.Second))
+
+	stats := ring.snapshot(now.Add(30 * time.Second))
+	assert.Equal(t, stats["/test"].Count, int64(2))
+	assert.Equal(t, stats["/test"].Total, int64(330))
+	assert.Equal(t, stats["/test"].Average, float64(165))
+	assert.Equal(t, stats["/test"].StatusClasses, map[string]int64{"5xx": 1})
+	assert.Equal(t, stats["/test"].LatencyP50, float64(10))
+
+	// The first bucket has left the window.
+	stats = ring.snapshot(now.Add(time.Minute))
+	assert.Equal(t, stats["/test"].Count, int64(1))
+	assert.Equal(t, stats["/test"].Total, int64(30))
+
+	// The bucket of the first update is reused a minute later.
+	updateStats(ring.stats("/test", now.Add(time.Minute)), 1, 1)
+	stats = ring.snapshot(now.Add(time.Minute))
+	assert.Equal(t, stats["/test"].Count, int64(2))
+	assert.Equal(t, stats["/test"].Total, int64(32))
+
+	assert.Equal(t, len(ring.snapshot(now.Add(time.Hour))), 0)
+}
+
+func TestMergeStats(t *testing.T) {
+	now := time.Now()
+	a := Stats{}
+	updateStats(&a, 100, 200)
+	updateRequestStats(&a, 10*time.Millisecond, 0, errors.New("old"), now)
+
+	b := Stats{}
+	updateStats(&b, 50, 50)
+	updateRequestStats(&b, 30*time.Millisecond, 503, nil, now.Add(time.Second))
+
+	merged := copyStats(a)
+	mergeStats(&merged, &b)
+	assert.Equal(t, merged.Count, int64(2))
+	assert.Equal(t, merged.Total, int64(400))
+	assert.Equal(t, merged.NetworkErrors, int64(1))
+	assert.Equal(t, merged.LatencyMin, float64(10))
+	assert.Equal(t, merged.LatencyMax, float64(30))
+	assert.Equal(t, merged.LatencyMean, float64(20))
+	assert.Equal(t, merged.LastError, "Service Unavailable")
+	assert.Equal(t, merged.StatusClasses, map[string]int64{"5xx": 1})
+
+	// The copy does not share memory with the original.
+	assert.Equal(t, a.LatencyMax, float64(10))
+	assert.Nil(t, a.StatusClasses)
+	assert.Equal(t, a.latency.count, int64(1))
+}
@@ -0,0 +1,191 @@
+package vistar
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+var ErrMissingAdId = errors.New("ad has no string id")
+
+// InProgressStore holds the ads that were returned by the ad server and are
+// yet to be confirmed or expired.
+type InProgressStore interface {
+	Put(Ad) error
+	Remove(string) (Ad, bool, error)
+	List() (map[string]Ad, error)
+	Close() error
+}
+
+type memoryInProgressStore struct {
+	lock sync.RWMutex
+	ads  map[string]Ad
+}
+
+func NewMemoryInProgressStore() *memoryInProgressStore {
+	return &memoryInProgressStore{ads: make(map[string]Ad)}
+}
+
+func (s *memoryInProgressStore) Put(ad Ad) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	adId, ok := ad["id"].(string)
+	if !ok {
+		return ErrMissingAdId
+	}
+
+	s.ads[adId] = ad
+	return nil
+}
+
+func (s *memoryInProgressStore) Remove(adId string) (Ad, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ad, ok := s.ads[adId]
+	delete(s.ads, adId)
+	return ad, ok, nil
+}
+
+func (s *memoryInProgressStore) List() (map[string]Ad, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	ret := map[string]Ad{}
+	for k, v := range s.ads {
+		ret[k] = v
+	}
+	return ret, nil
+}
+
+func (s *memoryInProgressStore) Close() error {
+	return nil
+}
+
+type fileInProgressRecord struct {
+	Id      string `json:"id"`
+	Ad      Ad     `json:"ad,omitempty"`
+	Removed bool   `json:"removed,omitempty"`
+}
+
+// fileInProgressStore keeps the ads in memory and logs every change to a
+// file, which is replayed when the store is opened again.
+type fileInProgressStore struct {
+	lock sync.Mutex
+	log  *appendLog
+	ads  map[string]Ad
+}
+
+func NewFileInProgressStore(path string) (*fileInProgressStore, error) {
+	s := &fileInProgressStore{
+		log: newAppendLog(path),
+		ads: make(map[string]Ad),
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.compactLocked(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileInProgressStore) Put(ad Ad) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	adId, ok := ad["id"].(string)
+	if !ok {
+		return ErrMissingAdId
+	}
+
+	err := s.log.append(&fileInProgressRecord{Id: adId, Ad: ad})
+	if err != nil {
+		return err
+	}
+
+	s.ads[adId] = ad
+	return s.maybeCompactLocked()
+}
+
+func (s *fileInProgressStore) Remove(adId string) (Ad, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ad, ok := s.ads[adId]
+	if !ok {
+		return nil, false, nil
+	}
+
+	err := s.log.append(&fileInProgressRecord{Id: adId, Removed: true})
+	if err != nil {
+		return nil, false, err
+	}
+
+	delete(s.ads, adId)
+	return ad, true, s.maybeCompactLocked()
+}
+
+func (s *fileInProgressStore) List() (map[string]Ad, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ret := map[string]Ad{}
+	for k, v := range s.ads {
+		ret[k] = v
+	}
+	return ret, nil
+}
+
+func (s *fileInProgressStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.compactLocked(); err != nil {
+		return err
+	}
+	return s.log.close()
+}
+
+// maybeCompactLocked keeps the log from growing forever on a long running
+// player.
+func (s *fileInProgressStore) maybeCompactLocked() error {
+	if s.log.records > 2*len(s.ads)+1000 {
+		return s.compactLocked()
+	}
+	return nil
+}
+
+func (s *fileInProgressStore) load() error {
+	return s.log.load(func(line []byte) error {
+		record := &fileInProgressRecord{}
+		if err := json.Unmarshal(line, record); err != nil {
+			return err
+		}
+
+		if record.Removed {
+			delete(s.ads, record.Id)
+		} else if record.Ad != nil {
+			s.ads[record.Id] = record.Ad
+		}
+		return nil
+	})
+}
+
+func (s *fileInProgressStore) compactLocked() error {
+	return s.log.compact(func(encode func(interface{}) error) error {
+		for adId, ad := range s.ads {
+			err := encode(&fileInProgressRecord{Id: adId, Ad: ad})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,138 @@
+package vistar
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryInProgressStore(t *testing.T) {
+	store := NewMemoryInProgressStore()
+
+	assert.Nil(t, store.Put(Ad{"id": "1"}))
+	assert.Nil(t, store.Put(Ad{"id": "2"}))
+
+	ads, err := store.List()
+	assert.Nil(t, err)
+	assert.Len(t, ads, 2)
+
+	ad, ok, err := store.Remove("1")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, ad, Ad{"id": "1"})
+
+	_, ok, _ = store.Remove("1")
+	assert.False(t, ok)
+
+	ads, _ = store.List()
+	assert.Equal(t, ads, map[string]Ad{"2": {"id": "2"}})
+}
+
+func TestInProgressStoresRejectAdsWithoutId(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "in-progress")
+	defer os.RemoveAll(dir)
+
+	fileStore, err := NewFileInProgressStore(
+		filepath.Join(dir, "in_progress.log"))
+	assert.Nil(t, err)
+	defer fileStore.Close()
+
+	for _, store := range []InProgressStore{
+		NewMemoryInProgressStore(),
+		fileStore,
+	} {
+		assert.Equal(t, store.Put(Ad{}), ErrMissingAdId)
+		assert.Equal(t, store.Put(Ad{"id": 1.0}), ErrMissingAdId)
+
+		ads, _ := store.List()
+		assert.Len(t, ads, 0)
+	}
+}
+
+func TestFileInProgressStoreSurvivesRestart(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "in-progress")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "in_progress.log")
+
+	store, err := NewFileInProgressStore(path)
+	assert.Nil(t, err)
+
+	store.Put(Ad{"id": "1", "lease_expiry": float64(12345)})
+	store.Put(Ad{"id": "2", "proof_of_play_url": "pop-url"})
+	store.Remove("1")
+
+	// Simulate a crash in the middle of a write.
+	store.log.file.Write([]byte(`{"id": "3", "ad": {"id"`))
+
+	store, err = NewFileInProgressStore(path)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	ads, _ := store.List()
+	assert.Equal(t, ads, map[string]Ad{
+		"2": {"id": "2", "proof_of_play_url": "pop-url"},
+	})
+
+	data, _ := ioutil.ReadFile(path)
+	assert.Equal(t, string(data),
+		`{"id":"2","ad":{"id":"2","proof_of_play_url":"pop-url"}}`+"\n")
+}
+
+func TestFileInProgressStoreCompacts(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "in-progress")
+	defer os.RemoveAll(dir)
+
+	store, _ := NewFileInProgressStore(filepath.Join(dir, "in_progress.log"))
+	defer store.Close()
+
+	for i := 0; i < 1100; i++ {
+		store.Put(Ad{"id": "1"})
+		store.Remove("1")
+	}
+
+	assert.True(t, store.log.records < 1100)
+}
+
+func TestClientReloadsInProgressAds(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "in-progress")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "in_progress.log")
+
+	store, _ := NewFileInProgressStore(path)
+	client := NewClient(&ClientConfig{
+		ReqTimeout:      time.Second,
+		InProgressStore: store,
+	})
+	client.addToInProgressList(Ad{
+		"id":                 "1",
+		"proof_of_play_url":  "pop-url",
+		"original_asset_url": "url1",
+	})
+	client.Close()
+
+	confirmed := make([]string, 0)
+	store, _ = NewFileInProgressStore(path)
+	client = NewClient(&ClientConfig{
+		ReqTimeout:      time.Second,
+		InProgressStore: store,
+		PoPFn: func(method string, url string,
+			data *ProofOfPlayRequest) (*http.Response, error) {
+			confirmed = append(confirmed, url)
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		},
+	})
+	defer client.Close()
+
+	assert.Contains(t, client.GetInProgressAds(), "1")
+
+	url, err := client.Confirm("1", 100)
+	assert.Nil(t, err)
+	assert.Equal(t, url, "url1")
+	assert.Equal(t, confirmed, []string{"pop-url"})
+	assert.Len(t, client.GetInProgressAds(), 0)
+}
@@ -0,0 +1,191 @@
+package vistar
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+type statsKeyContextKey struct{}
+
+// withStatsKey sets the key that the bandwidth of requests made with ctx is
+// recorded under, instead of their url.
+func withStatsKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, statsKeyContextKey{}, key)
+}
+
+type transferFunc func(key string, sent int64, received int64,
+	decompressed int64)
+
+// countingTransport measures the bytes each request and response take on
+// the wire, including the request and status lines and the headers, without
+// buffering the bodies. It asks for gzip and decompresses the response
+// itself so that the compressed size can be measured.
+type countingTransport struct {
+	base   http.RoundTripper
+	record transferFunc
+}
+
+func newCountingTransport(base http.RoundTripper,
+	record transferFunc) *countingTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &countingTransport{base: base, record: record}
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response,
+	error) {
+	key, ok := req.Context().Value(statsKeyContextKey{}).(string)
+	if !ok {
+		key = req.URL.String()
+	}
+
+	requestGzip := req.Header.Get("Accept-Encoding") == "" &&
+		req.Method != http.MethodHead
+	if requestGzip {
+		req = req.Clone(req.Context())
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+
+	requestBody := &countingReader{}
+	if req.Body != nil && req.Body != http.NoBody {
+		req = req.Clone(req.Context())
+		requestBody.reader = req.Body
+		req.Body = requestBody
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		t.record(key, requestHeaderLength(req)+requestBody.count(), 0, 0)
+		return nil, err
+	}
+
+	rawBody := &countingReader{reader: resp.Body}
+	body := &countingBody{
+		raw:    rawBody,
+		closer: resp.Body,
+		done: func(received int64, decompressed int64) {
+			headerLength := responseHeaderLength(resp)
+			t.record(key, requestHeaderLength(req)+requestBody.count(),
+				headerLength+received, headerLength+decompressed)
+		},
+	}
+	body.decompressed = &countingReader{reader: rawBody}
+
+	if requestGzip && resp.Header.Get("Content-Encoding") == "gzip" {
+		body.decompressed.reader = &lazyGzipReader{reader: rawBody}
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		resp.Uncompressed = true
+	}
+
+	resp.Body = body
+	return resp, nil
+}
+
+func requestHeaderLength(req *http.Request) int64 {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	length := len(fmt.Sprintf("%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method,
+		req.URL.RequestURI(), host))
+	if req.Header.Get("User-Agent") == "" {
+		length += len("User-Agent: Go-http-client/1.1\r\n")
+	}
+
+	if req.ContentLength > 0 && req.Header.Get("Content-Length") == "" {
+		length += len(fmt.Sprintf("Content-Length: %d\r\n",
+			req.ContentLength))
+	}
+	return int64(length) + headerLength(req.Header)
+}
+
+func responseHeaderLength(resp *http.Response) int64 {
+	length := len(fmt.Sprintf("%s %s\r\n", resp.Proto, resp.Status))
+	return int64(length) + headerLength(resp.Header)
+}
+
+// headerLength returns the length of the header lines, including the blank
+// line that ends them.
+func headerLength(header http.Header) int64 {
+	length := len("\r\n")
+	for k, v := range header {
+		for _, value := range v {
+			length += len(k) + len(": ") + len(value) + len("\r\n")
+		}
+	}
+	return int64(length)
+}
+
+type countingReader struct {
+	lock   sync.Mutex
+	reader io.Reader
+	n      int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.lock.Lock()
+	r.n += int64(n)
+	r.lock.Unlock()
+	return n, err
+}
+
+func (r *countingReader) Close() error {
+	if closer, ok := r.reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (r *countingReader) count() int64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.n
+}
+
+// lazyGzipReader creates the gzip reader on the first read, since creating
+// it reads the gzip header.
+type lazyGzipReader struct {
+	reader io.Reader
+	gzip   *gzip.Reader
+}
+
+func (r *lazyGzipReader) Read(p []byte) (int, error) {
+	if r.gzip == nil {
+		var err error
+		r.gzip, err = gzip.NewReader(r.reader)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return r.gzip.Read(p)
+}
+
+type countingBody struct {
+	raw          *countingReader
+	decompressed *countingReader
+	closer       io.Closer
+	done         func(int64, int64)
+	once         sync.Once
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	return b.decompressed.Read(p)
+}
+
+func (b *countingBody) Close() error {
+	err := b.closer.Close()
+	b.once.Do(func() {
+		b.done(b.raw.count(), b.decompressed.count())
+	})
+	return err
+}
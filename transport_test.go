@@ -0,0 +1,162 @@
+package vistar
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type transfer struct {
+	key          string
+	sent         int64
+	received     int64
+	decompressed int64
+}
+
+func newTransferRecorder(transfers *[]transfer) transferFunc {
+	return func(key string, sent int64, received int64, decompressed int64) {
+		*transfers = append(*transfers,
+			transfer{key, sent, received, decompressed})
+	}
+}
+
+// serveRaw answers a single request with response and returns the number of
+// bytes the request took on the wire.
+func serveRaw(t *testing.T, listener net.Listener, response string) int64 {
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	counter := &countingReader{reader: conn}
+	req, err := http.ReadRequest(bufio.NewReader(counter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(req.Body)
+
+	io.WriteString(conn, response)
+	return counter.count()
+}
+
+func TestCountingTransportWireBytes(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	response := "HTTP/1.1 200 OK\r\n" +
+		"Content-Length: 11\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Hello World"
+	sentCh := make(chan int64, 1)
+	go func() { sentCh <- serveRaw(t, listener, response) }()
+
+	var transfers []transfer
+	httpClient := &http.Client{
+		Transport: newCountingTransport(nil,
+			newTransferRecorder(&transfers)),
+	}
+
+	url := "http://" + listener.Addr().String() + "/ads?x=1"
+	req, _ := http.NewRequest("POST", url,
+		bytes.NewBufferString(`{"id":"ad"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpClient.Do(req)
+	assert.Nil(t, err)
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, string(body), "Hello World")
+
+	assert.Equal(t, len(transfers), 1)
+	assert.Equal(t, transfers[0].key, url)
+	assert.Equal(t, transfers[0].sent, <-sentCh)
+	assert.Equal(t, transfers[0].received, int64(len(response)))
+	assert.Equal(t, transfers[0].decompressed, int64(len(response)))
+
+	resp.Body.Close()
+	assert.Equal(t, len(transfers), 1)
+}
+
+func TestCountingTransportGzip(t *testing.T) {
+	content := strings.Repeat("Hello World ", 100)
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, r.Header.Get("Accept-Encoding"), "gzip")
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			io.WriteString(gz, content)
+			gz.Close()
+		}))
+	defer ts.Close()
+
+	var transfers []transfer
+	httpClient := &http.Client{
+		Transport: newCountingTransport(nil,
+			newTransferRecorder(&transfers)),
+	}
+
+	resp, err := httpClient.Get(ts.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, resp.Header.Get("Content-Encoding"), "")
+	assert.True(t, resp.Uncompressed)
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, string(body), content)
+
+	assert.Equal(t, len(transfers), 1)
+	received := transfers[0].received
+	decompressed := transfers[0].decompressed
+	assert.True(t, received < decompressed)
+	assert.Equal(t, decompressed-received,
+		int64(len(content))-(received-responseHeaderLength(resp)))
+}
+
+func TestCountingTransportStatsKey(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "ok")
+		}))
+	defer ts.Close()
+
+	var transfers []transfer
+	httpClient := &http.Client{
+		Transport: newCountingTransport(nil,
+			newTransferRecorder(&transfers)),
+	}
+
+	ctx := withStatsKey(context.Background(), "proof_of_play:test")
+	req, _ := http.NewRequestWithContext(ctx, "GET", ts.URL, nil)
+	resp, err := httpClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, len(transfers), 1)
+	assert.Equal(t, transfers[0].key, "proof_of_play:test")
+}
+
+func TestCountingTransportError(t *testing.T) {
+	var transfers []transfer
+	httpClient := &http.Client{
+		Transport: newCountingTransport(nil,
+			newTransferRecorder(&transfers)),
+	}
+
+	_, err := httpClient.Get("http://127.0.0.1:1/")
+	assert.NotNil(t, err)
+	assert.Equal(t, len(transfers), 1)
+	assert.Equal(t, transfers[0].received, int64(0))
+}
@@ -0,0 +1,42 @@
+package vistar
+
+import (
+	"fmt"
+	"strings"
+)
+
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+type ValidationErrors []*FieldError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, fieldErr := range e {
+		messages = append(messages, fieldErr.Error())
+	}
+	return strings.Join(messages, ", ")
+}
+
+func (e *ValidationErrors) add(field string, format string,
+	args ...interface{}) {
+	*e = append(*e, &FieldError{
+		Field:   field,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// errorOrNil returns nil rather than an empty ValidationErrors, so that the
+// result can be compared against nil by callers.
+func (e ValidationErrors) errorOrNil() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
@@ -0,0 +1,470 @@
+// Package vistartest provides helpers for testing code that uses the vistar
+// client without a real ad server.
+package vistartest
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"unicode/utf8"
+)
+
+var ErrNoInteraction = errors.New("No recorded interaction matches request")
+
+// RedactedFields are the JSON object fields, at any depth, whose values the
+// Recorder replaces with "REDACTED" in request bodies, so that cassettes do
+// not hold credentials. The Replayer leaves them out when matching bodies.
+var RedactedFields = []string{"api_key"}
+
+const redacted = "REDACTED"
+
+// Interaction is a request and its response, or the error it failed with,
+// as stored in a cassette, one per line.
+type Interaction struct {
+	Request  *RecordedRequest  `json:"request"`
+	Response *RecordedResponse `json:"response,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+type RecordedRequest struct {
+	Method string      `json:"method"`
+	Url    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	Body   *Body       `json:"body,omitempty"`
+}
+
+type RecordedResponse struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       *Body       `json:"body,omitempty"`
+}
+
+// Body is stored as text when it is valid UTF-8, which covers the JSON
+// exchanged with the ad server, and base64 encoded otherwise. Gzip encoded
+// responses are recorded decompressed.
+type Body struct {
+	Text   string `json:"text,omitempty"`
+	Base64 string `json:"base64,omitempty"`
+}
+
+func newBody(data []byte) *Body {
+	if len(data) == 0 {
+		return nil
+	}
+
+	if utf8.Valid(data) {
+		return &Body{Text: string(data)}
+	}
+	return &Body{Base64: base64.StdEncoding.EncodeToString(data)}
+}
+
+func (b *Body) bytes() ([]byte, error) {
+	if b == nil {
+		return nil, nil
+	}
+
+	if b.Base64 != "" {
+		return base64.StdEncoding.DecodeString(b.Base64)
+	}
+	return []byte(b.Text), nil
+}
+
+// Recorder is an http.RoundTripper that writes every request it makes and
+// the response it received to a cassette. The values of RedactedFields in
+// request bodies and of the redacted headers are not written, anything else
+// is, so review a cassette before committing it.
+type Recorder struct {
+	base          http.RoundTripper
+	redactHeaders []string
+	lock          sync.Mutex
+	file          *os.File
+	encoder       *json.Encoder
+}
+
+// NewRecorder creates or truncates the cassette at path. Requests are made
+// with base, or http.DefaultTransport if it is nil. The request and
+// response headers named in redactHeaders, such as Authorization, are
+// recorded as "REDACTED".
+func NewRecorder(path string, base http.RoundTripper,
+	redactHeaders ...string) (*Recorder, error) {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Recorder{
+		base:          base,
+		redactHeaders: redactHeaders,
+		file:          file,
+		encoder:       json.NewEncoder(file),
+	}, nil
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqBody, err := readAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// The caller's request must not be modified, the body that was read is
+	// sent with a clone.
+	if reqBody != nil {
+		req = req.Clone(req.Context())
+		req.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+	}
+
+	interaction := &Interaction{
+		Request: &RecordedRequest{
+			Method: req.Method,
+			Url:    req.URL.String(),
+			Header: r.redactHeader(req.Header),
+			Body:   newBody(redactBody(reqBody)),
+		},
+	}
+
+	resp, err := r.base.RoundTrip(req)
+	if err != nil {
+		interaction.Error = err.Error()
+		r.write(interaction)
+		return nil, err
+	}
+
+	respBody, err := readBody(&resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	header, recordedBody := decompressBody(r.redactHeader(resp.Header),
+		respBody)
+	interaction.Response = &RecordedResponse{
+		StatusCode: resp.StatusCode,
+		Header:     header,
+		Body:       newBody(recordedBody),
+	}
+
+	if err := r.write(interaction); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (r *Recorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.file.Close()
+}
+
+func (r *Recorder) write(interaction *Interaction) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.encoder.Encode(interaction)
+}
+
+func (r *Recorder) redactHeader(header http.Header) http.Header {
+	header = header.Clone()
+	for _, name := range r.redactHeaders {
+		if header.Get(name) != "" {
+			header.Set(name, redacted)
+		}
+	}
+	return header
+}
+
+// redactBody returns body with the values of RedactedFields replaced, or
+// body itself if it is not JSON or has none of them.
+func redactBody(body []byte) []byte {
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return body
+	}
+
+	if !redactFields(value) {
+		return body
+	}
+
+	redactedBody, err := json.Marshal(value)
+	if err != nil {
+		return body
+	}
+	return redactedBody
+}
+
+func redactFields(value interface{}) bool {
+	found := false
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if isRedactedField(key) {
+				v[key] = redacted
+				found = true
+				continue
+			}
+			found = redactFields(field) || found
+		}
+	case []interface{}:
+		for _, item := range v {
+			found = redactFields(item) || found
+		}
+	}
+	return found
+}
+
+func isRedactedField(name string) bool {
+	for _, field := range RedactedFields {
+		if name == field {
+			return true
+		}
+	}
+	return false
+}
+
+// decompressBody returns the header and body of a gzip encoded response as
+// if it had not been encoded, so that the body can be recorded as text. Any
+// other response is returned as it is.
+func decompressBody(header http.Header, body []byte) (http.Header, []byte) {
+	if header.Get("Content-Encoding") != "gzip" {
+		return header, body
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return header, body
+	}
+
+	decompressed, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return header, body
+	}
+
+	header.Del("Content-Encoding")
+	header.Del("Content-Length")
+	return header, decompressed
+}
+
+// readAll reads and closes body, which may be nil.
+func readAll(body io.ReadCloser) ([]byte, error) {
+	if body == nil || body == http.NoBody {
+		return nil, nil
+	}
+
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+// readBody reads body fully and replaces it with a reader of what was read.
+func readBody(body *io.ReadCloser) ([]byte, error) {
+	data, err := readAll(*body)
+	if err != nil || data == nil {
+		return data, err
+	}
+
+	*body = ioutil.NopCloser(bytes.NewReader(data))
+	return data, nil
+}
+
+// Replayer is an http.RoundTripper that answers requests with the responses
+// in a cassette, without using the network. A request matches an
+// interaction with the same method, url and body, where query parameters
+// may be in any order and JSON bodies are compared by value. Matching
+// interactions are replayed in the order they were recorded, and the last
+// one is repeated once they have all been used.
+type Replayer struct {
+	ignoreFields map[string]bool
+	lock         sync.Mutex
+	interactions []*replayInteraction
+}
+
+type replayInteraction struct {
+	*Interaction
+	key  string
+	used bool
+}
+
+// NewReplayer loads the cassette at path. The JSON object fields named in
+// ignoreFields, at any depth, are left out when matching bodies, which is
+// useful for fields that change on every request such as display_time.
+// RedactedFields are always left out.
+func NewReplayer(path string, ignoreFields ...string) (*Replayer, error) {
+	r := &Replayer{ignoreFields: make(map[string]bool)}
+	for _, field := range RedactedFields {
+		r.ignoreFields[field] = true
+	}
+
+	for _, field := range ignoreFields {
+		r.ignoreFields[field] = true
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		interaction := &Interaction{}
+		if err := json.Unmarshal(scanner.Bytes(), interaction); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err.Error())
+		}
+
+		if interaction.Request == nil {
+			return nil, fmt.Errorf("%s:%d: missing request", path, line)
+		}
+
+		body, err := interaction.Request.Body.bytes()
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err.Error())
+		}
+
+		r.interactions = append(r.interactions, &replayInteraction{
+			Interaction: interaction,
+			key: r.matchKey(interaction.Request.Method,
+				interaction.Request.Url, body),
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	interaction := r.next(r.matchKey(req.Method, req.URL.String(), body))
+	if interaction == nil {
+		return nil, fmt.Errorf("%w: %s %s", ErrNoInteraction, req.Method,
+			req.URL.String())
+	}
+
+	if interaction.Response == nil {
+		return nil, errors.New(interaction.Error)
+	}
+
+	respBody, err := interaction.Response.Body.bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	code := interaction.Response.StatusCode
+	header := interaction.Response.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(respBody)),
+		ContentLength: int64(len(respBody)),
+		Request:       req,
+	}, nil
+}
+
+// Unused returns the recorded interactions that have not been replayed.
+func (r *Replayer) Unused() []*Interaction {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	unused := make([]*Interaction, 0)
+	for _, interaction := range r.interactions {
+		if !interaction.used {
+			unused = append(unused, interaction.Interaction)
+		}
+	}
+	return unused
+}
+
+func (r *Replayer) next(key string) *replayInteraction {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var last *replayInteraction
+	for _, interaction := range r.interactions {
+		if interaction.key != key {
+			continue
+		}
+
+		if !interaction.used {
+			interaction.used = true
+			return interaction
+		}
+		last = interaction
+	}
+	return last
+}
+
+func (r *Replayer) matchKey(method string, rawUrl string,
+	body []byte) string {
+	return method + " " + normalizeUrl(rawUrl) + "\n" +
+		r.normalizeBody(body)
+}
+
+func normalizeUrl(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return rawUrl
+	}
+
+	// Encode sorts the parameters by key.
+	u.RawQuery = u.Query().Encode()
+	return u.String()
+}
+
+func (r *Replayer) normalizeBody(body []byte) string {
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return string(body)
+	}
+
+	// Maps are marshalled with sorted keys and without whitespace.
+	normalized, err := json.Marshal(r.dropIgnoredFields(value))
+	if err != nil {
+		return string(body)
+	}
+	return string(normalized)
+}
+
+func (r *Replayer) dropIgnoredFields(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if r.ignoreFields[key] {
+				delete(v, key)
+				continue
+			}
+			v[key] = r.dropIgnoredFields(field)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = r.dropIgnoredFields(item)
+		}
+	}
+	return value
+}
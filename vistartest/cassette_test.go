@@ -0,0 +1,232 @@
+package vistartest
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	vistar "github.com/cortexsystems/vistar-go-client"
+	"github.com/stretchr/testify/assert"
+)
+
+func newCassettePath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "cassette")
+	assert.Nil(t, err)
+	return filepath.Join(dir, "cassette.jsonl"), func() { os.RemoveAll(dir) }
+}
+
+func TestRecordAndReplayClient(t *testing.T) {
+	path, cleanup := newCassettePath(t)
+	defer cleanup()
+
+	requests := 0
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.Header().Set("Content-Type", "application/json")
+			if r.URL.Path == "/assets" {
+				w.Write([]byte(`{"asset": [{"asset_url": "http://a/1.png"}]}`))
+				return
+			}
+			w.Write([]byte(`{"advertisement": [{"id": "ad-1",
+				"asset_url": "http://a/1.png",
+				"proof_of_play_url": "http://pop/1",
+				"expiration_url": "http://expire/1"}]}`))
+		}))
+
+	data, err := vistar.NewDataBuilder("key", "network", "device").
+		DisplayArea("main", 1920, 1080, "image/jpeg").
+		DisplayTime(1).
+		Build()
+	assert.Nil(t, err)
+	request := vistar.NewRequest(ts.URL+"/ads", ts.URL+"/assets", data,
+		false, 0)
+
+	recorder, err := NewRecorder(path, nil)
+	assert.Nil(t, err)
+	client := vistar.NewClient(&vistar.ClientConfig{Transport: recorder})
+	recorded, err := client.GetAd(request)
+	assert.Nil(t, err)
+	recordedAssets, err := client.GetAssets(request)
+	assert.Nil(t, err)
+	client.Close()
+	assert.Nil(t, recorder.Close())
+	ts.Close()
+	assert.Equal(t, requests, 2)
+
+	cassette, _ := ioutil.ReadFile(path)
+	assert.False(t, strings.Contains(string(cassette), `\"key\"`))
+	assert.True(t, strings.Contains(string(cassette), `\"REDACTED\"`))
+
+	data.ApiKey = "other-key"
+	replayer, err := NewReplayer(path, "display_time")
+	assert.Nil(t, err)
+	client = vistar.NewClient(&vistar.ClientConfig{Transport: replayer})
+	defer client.Close()
+
+	data.DisplayTime = 2
+	replayed, err := client.GetAd(request)
+	assert.Nil(t, err)
+	assert.Equal(t, replayed, recorded)
+
+	replayedAssets, err := client.GetAssets(request)
+	assert.Nil(t, err)
+	assert.Equal(t, replayedAssets, recordedAssets)
+	assert.Equal(t, len(replayer.Unused()), 0)
+
+	data.DeviceId = "other"
+	_, err = client.GetAd(request)
+	assert.True(t, errors.Is(err, ErrNoInteraction))
+}
+
+func TestReplayerOrderAndErrors(t *testing.T) {
+	path, cleanup := newCassettePath(t)
+	defer cleanup()
+
+	cassette := strings.Join([]string{
+		`{"request": {"method": "POST", "url": "http://ads/?b=2&a=1",` +
+			` "body": {"text": "{\"id\": 1, \"x\": [1, 2]}"}},` +
+			` "response": {"status_code": 500}}`,
+		`{"request": {"method": "POST", "url": "http://ads/?a=1&b=2",` +
+			` "body": {"text": "{\"x\":[1,2],\"id\":1}"}},` +
+			` "response": {"status_code": 200,` +
+			` "body": {"base64": "AP8="}}}`,
+		`{"request": {"method": "GET", "url": "http://pop/"},` +
+			` "error": "connection refused"}`,
+	}, "\n")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(cassette), 0644))
+
+	replayer, err := NewReplayer(path)
+	assert.Nil(t, err)
+	httpClient := &http.Client{Transport: replayer}
+
+	post := func() *http.Response {
+		resp, err := httpClient.Post("http://ads/?a=1&b=2",
+			"application/json", strings.NewReader(`{"id":1,"x":[1,2]}`))
+		assert.Nil(t, err)
+		return resp
+	}
+
+	assert.Equal(t, post().StatusCode, 500)
+	assert.Equal(t, len(replayer.Unused()), 2)
+
+	resp := post()
+	assert.Equal(t, resp.StatusCode, 200)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, body, []byte{0x00, 0xff})
+
+	// The last match is repeated.
+	assert.Equal(t, post().StatusCode, 200)
+
+	_, err = httpClient.Get("http://pop/")
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "connection refused"))
+	assert.Equal(t, len(replayer.Unused()), 0)
+}
+
+func TestRecorderRecordsErrors(t *testing.T) {
+	path, cleanup := newCassettePath(t)
+	defer cleanup()
+
+	recorder, err := NewRecorder(path, nil)
+	assert.Nil(t, err)
+
+	_, err = (&http.Client{Transport: recorder}).Get("http://127.0.0.1:1/")
+	assert.NotNil(t, err)
+	assert.Nil(t, recorder.Close())
+
+	replayer, err := NewReplayer(path)
+	assert.Nil(t, err)
+	_, err = (&http.Client{Transport: replayer}).Get("http://127.0.0.1:1/")
+	assert.NotNil(t, err)
+	assert.False(t, errors.Is(err, ErrNoInteraction))
+}
+
+func TestRecorderRedactsHeaders(t *testing.T) {
+	path, cleanup := newCassettePath(t)
+	defer cleanup()
+
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Set-Cookie", "session=secret")
+			w.Write([]byte("not json"))
+		}))
+	defer ts.Close()
+
+	recorder, err := NewRecorder(path, nil, "Authorization", "Set-Cookie")
+	assert.Nil(t, err)
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL,
+		strings.NewReader("api_key=secret"))
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("X-Device", "device")
+	_, err = (&http.Client{Transport: recorder}).Do(req)
+	assert.Nil(t, err)
+	assert.Nil(t, recorder.Close())
+
+	cassette, _ := ioutil.ReadFile(path)
+	interaction := &Interaction{}
+	assert.Nil(t, json.Unmarshal(cassette, interaction))
+	assert.Equal(t, interaction.Request.Header.Get("Authorization"),
+		"REDACTED")
+	assert.Equal(t, interaction.Request.Header.Get("X-Device"), "device")
+	assert.Equal(t, interaction.Response.Header.Get("Set-Cookie"),
+		"REDACTED")
+	// Bodies that are not JSON are recorded as they are.
+	assert.Equal(t, interaction.Request.Body.Text, "api_key=secret")
+}
+
+func TestRecorderDecompressesGzipResponses(t *testing.T) {
+	path, cleanup := newCassettePath(t)
+	defer cleanup()
+
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "gzip")
+			writer := gzip.NewWriter(w)
+			writer.Write([]byte(`{"advertisement": []}`))
+			writer.Close()
+		}))
+	defer ts.Close()
+
+	recorder, err := NewRecorder(path, nil)
+	assert.Nil(t, err)
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL,
+		strings.NewReader(`{"device_id": "device"}`))
+	req.Header.Set("Accept-Encoding", "gzip")
+	body := req.Body
+	resp, err := recorder.RoundTrip(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Nil(t, recorder.Close())
+
+	// The caller's request is left as it is.
+	assert.True(t, req.Body == body)
+
+	cassette, _ := ioutil.ReadFile(path)
+	interaction := &Interaction{}
+	assert.Nil(t, json.Unmarshal(cassette, interaction))
+	assert.Equal(t, interaction.Request.Body.Text, `{"device_id": "device"}`)
+	assert.Equal(t, interaction.Response.Body.Text, `{"advertisement": []}`)
+	assert.Equal(t, interaction.Response.Header.Get("Content-Encoding"), "")
+}
+
+func TestNewReplayerInvalidCassette(t *testing.T) {
+	path, cleanup := newCassettePath(t)
+	defer cleanup()
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("{}\n"), 0644))
+	_, err := NewReplayer(path)
+	assert.NotNil(t, err)
+
+	_, err = NewReplayer(path + ".missing")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,456 @@
+package vistartest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The paths that Server serves the ad server endpoints on.
+const (
+	AdPath          = "/api/v1/get_ad/json"
+	AssetPath       = "/api/v1/get_asset/json"
+	ProofOfPlayPath = "/proof_of_play/"
+	ExpirationPath  = "/expiration/"
+	AssetFilePath   = "/assets/"
+)
+
+var DefaultLeaseDuration = time.Hour
+
+type Endpoint int
+
+const (
+	EndpointAd Endpoint = iota
+	EndpointAsset
+	EndpointProofOfPlay
+	EndpointExpiration
+)
+
+// Step scripts the response to a single request. The zero Step answers
+// normally.
+type Step struct {
+	// Latency delays the response.
+	Latency time.Duration
+	// Status responds with this status code and Body instead of the normal
+	// response.
+	Status int
+	Body   string
+	// Empty responds without ads or assets.
+	Empty bool
+	// Disconnect closes the connection without a response.
+	Disconnect bool
+}
+
+type ServerConfig struct {
+	// AdsPerDisplayArea is the number of ads returned for each display area
+	// in the request. Defaults to 1.
+	AdsPerDisplayArea int
+	// LeaseDuration is how long after the request the lease_expiry of the
+	// ads is. Defaults to DefaultLeaseDuration.
+	LeaseDuration time.Duration
+	// LengthInSeconds is the length of every ad. Defaults to 15.
+	LengthInSeconds int64
+}
+
+// AdRecord is what the server knows about an ad it handed out.
+type AdRecord struct {
+	Id            string
+	DisplayAreaId string
+	LeaseExpiry   int64
+	Confirms      int
+	Expires       int
+	DisplayTime   int64
+}
+
+// Finalized reports whether the ad was confirmed or expired.
+func (r AdRecord) Finalized() bool {
+	return r.Confirms+r.Expires > 0
+}
+
+// Server is an in process fake ad server. It hands out ads, serves their
+// assets, and records the proof of play and expiration requests it receives
+// so that tests can check that every ad was confirmed or expired exactly
+// once.
+type Server struct {
+	URL string
+
+	server *httptest.Server
+	config ServerConfig
+	now    func() time.Time
+	lock   sync.Mutex
+	nextId int
+	ads    map[string]*AdRecord
+	order  []string
+	steps  map[Endpoint][]Step
+	counts map[Endpoint]int
+}
+
+func NewServer(config *ServerConfig) *Server {
+	s := &Server{
+		now:    time.Now,
+		ads:    make(map[string]*AdRecord),
+		steps:  make(map[Endpoint][]Step),
+		counts: make(map[Endpoint]int),
+	}
+
+	if config != nil {
+		s.config = *config
+	}
+
+	if s.config.AdsPerDisplayArea <= 0 {
+		s.config.AdsPerDisplayArea = 1
+	}
+
+	if s.config.LeaseDuration <= 0 {
+		s.config.LeaseDuration = DefaultLeaseDuration
+	}
+
+	if s.config.LengthInSeconds <= 0 {
+		s.config.LengthInSeconds = 15
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(AdPath, s.handleAd)
+	mux.HandleFunc(AssetPath, s.handleAsset)
+	mux.HandleFunc(ProofOfPlayPath, s.handleProofOfPlay)
+	mux.HandleFunc(ExpirationPath, s.handleExpiration)
+	mux.HandleFunc(AssetFilePath, s.handleAssetFile)
+
+	s.server = httptest.NewServer(mux)
+	s.URL = s.server.URL
+	return s
+}
+
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+func (s *Server) AdUrl() string {
+	return s.URL + AdPath
+}
+
+func (s *Server) AssetUrl() string {
+	return s.URL + AssetPath
+}
+
+// Script sets the responses to the next requests to endpoint, in order,
+// after the steps that are already scripted. Once they are used up requests
+// are answered normally again.
+func (s *Server) Script(endpoint Endpoint, steps ...Step) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.steps[endpoint] = append(s.steps[endpoint], steps...)
+}
+
+// Requests returns the number of requests endpoint received.
+func (s *Server) Requests(endpoint Endpoint) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.counts[endpoint]
+}
+
+// Ads returns the ads handed out, in order.
+func (s *Server) Ads() []AdRecord {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ads := make([]AdRecord, 0, len(s.order))
+	for _, id := range s.order {
+		ads = append(ads, *s.ads[id])
+	}
+	return ads
+}
+
+func (s *Server) Ad(id string) (AdRecord, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ad, ok := s.ads[id]
+	if !ok {
+		return AdRecord{}, false
+	}
+	return *ad, true
+}
+
+// Confirmed returns the ids of the ads that were confirmed at least once.
+func (s *Server) Confirmed() []string {
+	return s.adIds(func(ad *AdRecord) bool { return ad.Confirms > 0 })
+}
+
+// Expired returns the ids of the ads that were expired at least once.
+func (s *Server) Expired() []string {
+	return s.adIds(func(ad *AdRecord) bool { return ad.Expires > 0 })
+}
+
+// Pending returns the ids of the ads that were neither confirmed nor
+// expired.
+func (s *Server) Pending() []string {
+	return s.adIds(func(ad *AdRecord) bool { return !ad.Finalized() })
+}
+
+// DoubleFinalized returns the ids of the ads that were confirmed or expired
+// more than once in total, such as an ad confirmed twice or confirmed and
+// then expired.
+func (s *Server) DoubleFinalized() []string {
+	return s.adIds(func(ad *AdRecord) bool {
+		return ad.Confirms+ad.Expires > 1
+	})
+}
+
+// CheckExactlyOnce returns an error naming the ads that were not confirmed
+// or expired exactly once, or nil if every ad handed out was.
+func (s *Server) CheckExactlyOnce() error {
+	pending := s.Pending()
+	double := s.DoubleFinalized()
+	if len(pending) == 0 && len(double) == 0 {
+		return nil
+	}
+	return fmt.Errorf("ads not finalized: %v, ads finalized more than once: %v",
+		pending, double)
+}
+
+func (s *Server) adIds(match func(*AdRecord) bool) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ids := make([]string, 0)
+	for _, id := range s.order {
+		if match(s.ads[id]) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// step counts the request and returns the scripted step for it. It returns
+// false if the request has been answered.
+func (s *Server) step(endpoint Endpoint, w http.ResponseWriter) (Step,
+	bool) {
+	s.lock.Lock()
+	s.counts[endpoint]++
+	var step Step
+	if steps := s.steps[endpoint]; len(steps) > 0 {
+		step = steps[0]
+		s.steps[endpoint] = steps[1:]
+	}
+	s.lock.Unlock()
+
+	if step.Latency > 0 {
+		time.Sleep(step.Latency)
+	}
+
+	if step.Disconnect {
+		if hijacker, ok := w.(http.Hijacker); ok {
+			conn, _, err := hijacker.Hijack()
+			if err == nil {
+				conn.Close()
+				return step, false
+			}
+		}
+		step.Status = http.StatusBadGateway
+	}
+
+	if step.Status != 0 {
+		w.WriteHeader(step.Status)
+		w.Write([]byte(step.Body))
+		return step, false
+	}
+	return step, true
+}
+
+type displayArea struct {
+	Id             string   `json:"id"`
+	Width          int64    `json:"width"`
+	Height         int64    `json:"height"`
+	SupportedMedia []string `json:"supported_media"`
+}
+
+type adRequest struct {
+	DisplayAreas []displayArea `json:"display_area"`
+}
+
+func (s *Server) handleAd(w http.ResponseWriter, r *http.Request) {
+	step, ok := s.step(EndpointAd, w)
+	if !ok {
+		return
+	}
+
+	request, ok := s.readRequest(w, r)
+	if !ok {
+		return
+	}
+
+	ads := make([]map[string]interface{}, 0)
+	if !step.Empty {
+		ads = s.newAds(request)
+	}
+	writeJSON(w, map[string]interface{}{"advertisement": ads})
+}
+
+func (s *Server) handleAsset(w http.ResponseWriter, r *http.Request) {
+	step, ok := s.step(EndpointAsset, w)
+	if !ok {
+		return
+	}
+
+	request, ok := s.readRequest(w, r)
+	if !ok {
+		return
+	}
+
+	assets := make([]map[string]interface{}, 0)
+	if !step.Empty {
+		for _, area := range displayAreas(request) {
+			assets = append(assets, map[string]interface{}{
+				"asset_id":  "asset-" + area.Id,
+				"asset_url": s.assetFileUrl(area.Id),
+				"mime_type": "image/png",
+				"width":     area.Width,
+				"height":    area.Height,
+			})
+		}
+	}
+	writeJSON(w, map[string]interface{}{"asset": assets})
+}
+
+func (s *Server) handleProofOfPlay(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.step(EndpointProofOfPlay, w); !ok {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		DisplayTime int64 `json:"display_time"`
+	}
+	data, _ := ioutil.ReadAll(r.Body)
+	if err := json.Unmarshal(data, &body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.finalize(w, strings.TrimPrefix(r.URL.Path, ProofOfPlayPath),
+		func(ad *AdRecord) {
+			ad.Confirms++
+			ad.DisplayTime = body.DisplayTime
+		})
+}
+
+func (s *Server) handleExpiration(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.step(EndpointExpiration, w); !ok {
+		return
+	}
+
+	s.finalize(w, strings.TrimPrefix(r.URL.Path, ExpirationPath),
+		func(ad *AdRecord) { ad.Expires++ })
+}
+
+// handleAssetFile serves a few bytes for any asset, so that assets can be
+// downloaded and cached.
+func (s *Server) handleAssetFile(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write([]byte(r.URL.Path))
+}
+
+func (s *Server) finalize(w http.ResponseWriter, id string,
+	update func(*AdRecord)) {
+	s.lock.Lock()
+	ad, ok := s.ads[id]
+	if ok {
+		update(ad)
+	}
+	s.lock.Unlock()
+
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown ad %s", id), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) readRequest(w http.ResponseWriter, r *http.Request) (
+	*adRequest, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+
+	request := &adRequest{}
+	data, _ := ioutil.ReadAll(r.Body)
+	if err := json.Unmarshal(data, request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return request, true
+}
+
+func (s *Server) newAds(request *adRequest) []map[string]interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	leaseExpiry := s.now().Add(s.config.LeaseDuration).Unix()
+	ads := make([]map[string]interface{}, 0)
+	for _, area := range displayAreas(request) {
+		for i := 0; i < s.config.AdsPerDisplayArea; i++ {
+			s.nextId++
+			id := fmt.Sprintf("ad-%d", s.nextId)
+			s.ads[id] = &AdRecord{
+				Id:            id,
+				DisplayAreaId: area.Id,
+				LeaseExpiry:   leaseExpiry,
+			}
+			s.order = append(s.order, id)
+
+			ads = append(ads, map[string]interface{}{
+				"id":                     id,
+				"display_area_id":        area.Id,
+				"asset_id":               "asset-" + id,
+				"asset_url":              s.assetFileUrl(id),
+				"mime_type":              mimeType(area),
+				"width":                  area.Width,
+				"height":                 area.Height,
+				"length_in_seconds":      s.config.LengthInSeconds,
+				"length_in_milliseconds": s.config.LengthInSeconds * 1000,
+				"lease_expiry":           leaseExpiry,
+				"proof_of_play_url":      s.URL + ProofOfPlayPath + id,
+				"expiration_url":         s.URL + ExpirationPath + id,
+			})
+		}
+	}
+	return ads
+}
+
+func (s *Server) assetFileUrl(id string) string {
+	return s.URL + AssetFilePath + id + ".png"
+}
+
+// displayAreas returns the display areas of the request, or a single
+// unnamed one if there are none.
+func displayAreas(request *adRequest) []displayArea {
+	if len(request.DisplayAreas) == 0 {
+		return []displayArea{{}}
+	}
+	return request.DisplayAreas
+}
+
+func mimeType(area displayArea) string {
+	if len(area.SupportedMedia) > 0 {
+		return area.SupportedMedia[0]
+	}
+	return "image/png"
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
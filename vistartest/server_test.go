@@ -0,0 +1,186 @@
+package vistartest
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	vistar "github.com/cortexsystems/vistar-go-client"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRequest(s *Server) vistar.Request {
+	data := &vistar.Data{
+		ApiKey:    "api-key",
+		NetworkId: "network",
+		DeviceId:  "device",
+		DisplayAreas: []vistar.DisplayArea{
+			{Id: "main", Width: 1920, Height: 1080,
+				SupportedMedia: []string{"video/mp4"}},
+			{Id: "side", Width: 400, Height: 1080,
+				SupportedMedia: []string{"image/jpeg"}},
+		},
+	}
+	return vistar.NewRequest(s.AdUrl(), s.AssetUrl(), data, false, 0)
+}
+
+func TestServerHandsOutAds(t *testing.T) {
+	s := NewServer(&ServerConfig{
+		AdsPerDisplayArea: 2,
+		LeaseDuration:     time.Minute,
+	})
+	defer s.Close()
+
+	now := time.Now()
+	client := vistar.NewClient(&vistar.ClientConfig{})
+	defer client.Close()
+
+	resp, err := client.GetAd(newTestRequest(s))
+	assert.Nil(t, err)
+	assert.Equal(t, len(resp.Advertisement), 4)
+
+	ad := resp.Advertisement[0]
+	assert.Equal(t, ad["id"], "ad-1")
+	assert.Equal(t, ad["display_area_id"], "main")
+	assert.Equal(t, ad["mime_type"], "video/mp4")
+	assert.Equal(t, ad["width"], float64(1920))
+	assert.InDelta(t, ad["lease_expiry"], float64(now.Unix()+60), 1)
+	assert.Equal(t, resp.Advertisement[3]["display_area_id"], "side")
+
+	_, err = client.Confirm("ad-1", now.Unix())
+	assert.Nil(t, err)
+	assert.Nil(t, client.Expire("ad-2"))
+
+	assert.Equal(t, s.Confirmed(), []string{"ad-1"})
+	assert.Equal(t, s.Expired(), []string{"ad-2"})
+	assert.Equal(t, s.Pending(), []string{"ad-3", "ad-4"})
+	assert.Equal(t, len(s.DoubleFinalized()), 0)
+
+	record, ok := s.Ad("ad-1")
+	assert.True(t, ok)
+	assert.Equal(t, record.DisplayTime, now.Unix())
+	assert.Equal(t, s.Requests(EndpointAd), 1)
+	assert.Equal(t, s.Requests(EndpointProofOfPlay), 1)
+	assert.Equal(t, len(s.Ads()), 4)
+
+	assets, err := client.GetAssets(newTestRequest(s))
+	assert.Nil(t, err)
+	assert.Equal(t, len(assets.Assets), 2)
+
+	assetResp, err := http.Get(assets.Assets[0]["asset_url"].(string))
+	assert.Nil(t, err)
+	assetResp.Body.Close()
+	assert.Equal(t, assetResp.StatusCode, http.StatusOK)
+}
+
+func TestServerTracksDoubleFinalized(t *testing.T) {
+	s := NewServer(nil)
+	defer s.Close()
+
+	client := vistar.NewClient(&vistar.ClientConfig{})
+	defer client.Close()
+
+	resp, err := client.GetAd(newTestRequest(s))
+	assert.Nil(t, err)
+
+	popUrl := resp.Advertisement[0]["proof_of_play_url"].(string)
+	for i := 0; i < 2; i++ {
+		r, err := http.Post(popUrl, "application/json",
+			bytes.NewBufferString(`{"display_time": 1}`))
+		assert.Nil(t, err)
+		r.Body.Close()
+	}
+	assert.Equal(t, s.DoubleFinalized(), []string{"ad-1"})
+	assert.NotNil(t, s.CheckExactlyOnce())
+
+	r, err := http.Post(s.URL+ProofOfPlayPath+"unknown", "application/json",
+		bytes.NewBufferString(`{"display_time": 1}`))
+	assert.Nil(t, err)
+	r.Body.Close()
+	assert.Equal(t, r.StatusCode, http.StatusNotFound)
+}
+
+func TestClientFinalizesExactlyOnce(t *testing.T) {
+	s := NewServer(&ServerConfig{AdsPerDisplayArea: 2})
+	defer s.Close()
+
+	client := vistar.NewClient(&vistar.ClientConfig{})
+	defer client.Close()
+
+	_, err := client.GetAd(newTestRequest(s))
+	assert.Nil(t, err)
+	assert.NotNil(t, s.CheckExactlyOnce())
+
+	for _, id := range []string{"ad-1", "ad-2", "ad-3"} {
+		_, err = client.Confirm(id, time.Now().Unix())
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, client.Expire("ad-4"))
+
+	_, err = client.Confirm("ad-1", time.Now().Unix())
+	assert.Equal(t, err, vistar.ErrAlreadyFinalized)
+	assert.Equal(t, client.Expire("ad-4"), vistar.ErrAlreadyFinalized)
+	assert.Nil(t, s.CheckExactlyOnce())
+}
+
+func TestServerScenarios(t *testing.T) {
+	s := NewServer(nil)
+	defer s.Close()
+
+	s.Script(EndpointAd,
+		Step{Status: http.StatusServiceUnavailable, Body: "down"},
+		Step{Disconnect: true},
+		Step{Empty: true},
+		Step{Latency: 200 * time.Millisecond})
+
+	client := vistar.NewClient(&vistar.ClientConfig{
+		ReqTimeout: 100 * time.Millisecond,
+	})
+	defer client.Close()
+	request := newTestRequest(s)
+
+	_, err := client.GetAd(request)
+	serverErr, ok := err.(*vistar.ServerError)
+	assert.True(t, ok)
+	assert.Equal(t, serverErr.StatusCode, http.StatusServiceUnavailable)
+	assert.Equal(t, serverErr.Body, "down")
+
+	_, err = client.GetAd(request)
+	assert.NotNil(t, err)
+
+	resp, err := client.GetAd(request)
+	assert.Nil(t, err)
+	assert.Equal(t, len(resp.Advertisement), 0)
+
+	_, err = client.GetAd(request)
+	assert.NotNil(t, err)
+
+	resp, err = client.GetAd(request)
+	assert.Nil(t, err)
+	assert.Equal(t, len(resp.Advertisement), 2)
+	assert.Equal(t, s.Requests(EndpointAd), 5)
+}
+
+func TestServerScriptedProofOfPlay(t *testing.T) {
+	s := NewServer(nil)
+	defer s.Close()
+
+	s.Script(EndpointProofOfPlay, Step{Status: http.StatusBadRequest})
+
+	client := vistar.NewClient(&vistar.ClientConfig{})
+	defer client.Close()
+
+	_, err := client.GetAd(newTestRequest(s))
+	assert.Nil(t, err)
+
+	_, err = client.Confirm("ad-1", time.Now().Unix())
+	popErr, ok := err.(*vistar.PoPError)
+	assert.True(t, ok)
+	assert.Equal(t, popErr.Status, http.StatusBadRequest)
+	assert.Equal(t, len(s.Confirmed()), 0)
+
+	_, err = client.Confirm("ad-2", time.Now().Unix())
+	assert.Nil(t, err)
+	assert.Equal(t, s.Confirmed(), []string{"ad-2"})
+}